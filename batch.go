@@ -0,0 +1,378 @@
+package filtertag
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BatchConfig is the batching and retrying part of the config of the sinks which send the
+// lines in batches (Loki, NSQ, Elasticsearch etc.). The zero values mean the defaults.
+type BatchConfig struct {
+	MaxLines int           // per batch, 1000
+	MaxBytes int           // per batch, 1MB
+	MaxDelay time.Duration // how long a line may wait for its batch to fill, 1s
+
+	// The bounded buffer for the lines waiting to be batched (while the batch before them is
+	// being retried, above all); DefaultBufferLines and DefaultBufferBytes if zero.
+	BufferLines int
+	BufferBytes int
+	// When the buffer is full, the lines go to the disk instead of pushing out the oldest
+	// ones, see SpillQueue; the sink doesn't close it
+	Spill *SpillQueue
+
+	Backoff    Backoff // between the retries, DefaultBackoff if zero
+	MaxRetries int     // of a batch, before its lines are lost; 10 if zero, negative for none
+}
+
+func (config *BatchConfig) setDefaults() {
+	if config.MaxLines <= 0 {
+		config.MaxLines = 1000
+	}
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = 1 << 20
+	}
+	if config.MaxDelay <= 0 {
+		config.MaxDelay = time.Second
+	}
+	if config.Backoff.Min <= 0 {
+		config.Backoff = DefaultBackoff
+	}
+	if config.MaxRetries == 0 {
+		config.MaxRetries = 10
+	}
+}
+
+// batcher is the common part of the batching sinks: they embed it for the Write(), Close()
+// and Stats(), and give it the send function. The send is only ever called from the
+// batcher's goroutine, and must not keep the lines after it returns.
+type batcher struct {
+	sinkCounters // first, for the 64-bit alignment of the atomics
+	sinkHealth
+
+	config    BatchConfig
+	queue     *lineQueue
+	send      func(ctx context.Context, lines [][]byte) error
+	closing   chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func makeBatcher(
+	ctx context.Context,
+	config BatchConfig,
+	send func(ctx context.Context, lines [][]byte) error,
+) *batcher {
+	config.setDefaults()
+	b := &batcher{
+		config:  config,
+		send:    send,
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	b.queue = makeLineQueue(config.BufferLines, config.BufferBytes, config.Spill, &b.sinkCounters)
+
+	go b.run(ctx)
+	if config.Spill != nil {
+		go b.queue.refill(ctx, b.closing)
+	}
+	return b
+}
+
+// Write never blocks, the line is only queued
+func (b *batcher) Write(p []byte) (int, error) {
+	if b.isClosing() {
+		atomic.AddUint64(&b.lost, 1)
+		return 0, ErrSinkClosed
+	}
+	b.queue.push(p)
+	return len(p), nil
+}
+
+func (b *batcher) WriteLines(lines [][]byte) error {
+	return writeLinesEach(b, lines)
+}
+
+// Close sends what's still buffered (with one attempt per batch, no retries), and waits
+// for it; the lines written after Close are lost.
+func (b *batcher) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.closing)
+	})
+	<-b.done
+	return nil
+}
+
+func (b *batcher) isClosing() bool {
+	select {
+	case <-b.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+func (b *batcher) run(ctx context.Context) {
+	var batch [][]byte
+	size := 0
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	var timerC <-chan time.Time
+	closing := false
+
+	defer close(b.done)
+
+	flush := func() {
+		if timerC != nil {
+			timer.Stop()
+			timerC = nil
+		}
+		if len(batch) > 0 {
+			b.deliver(ctx, batch)
+		}
+		batch, size = batch[:0], 0
+	}
+
+	for {
+		var line []byte
+		if closing {
+			select {
+			case line = <-b.queue.ch:
+			default:
+				flush()
+				return
+			}
+		} else {
+			select {
+			case <-ctx.Done():
+				atomic.AddUint64(&b.lost, uint64(len(batch)))
+				for {
+					select {
+					case line = <-b.queue.ch:
+						b.queue.taken(line)
+						atomic.AddUint64(&b.lost, 1)
+					default:
+						return
+					}
+				}
+			case <-b.closing:
+				closing = true
+				continue
+			case <-timerC:
+				timerC = nil
+				flush()
+				continue
+			case line = <-b.queue.ch:
+			}
+		}
+
+		b.queue.taken(line)
+		if len(batch) > 0 && size+len(line) > b.config.MaxBytes {
+			flush()
+		}
+		batch = append(batch, line)
+		size += len(line)
+		if len(batch) == 1 && timerC == nil {
+			timer.Reset(b.config.MaxDelay)
+			timerC = timer.C
+		}
+		if len(batch) >= b.config.MaxLines || size >= b.config.MaxBytes {
+			flush()
+		}
+	}
+}
+
+// Sends the batch, retrying as configured; the lines are either written or lost in the end.
+// The sink is down while a batch is being retried.
+func (b *batcher) deliver(ctx context.Context, lines [][]byte) {
+	for attempt := 0; ; attempt++ {
+		err := b.send(ctx, lines)
+		if err == nil {
+			b.setDown(nil)
+			atomic.AddUint64(&b.written, uint64(len(lines)))
+			return
+		}
+		atomic.AddUint64(&b.errors, 1)
+		if pe, ok := err.(*partialError); ok {
+			atomic.AddUint64(&b.written, uint64(len(lines)-len(pe.failed)-pe.lost))
+			atomic.AddUint64(&b.lost, uint64(pe.lost))
+			lines, err = pe.failed, pe.err
+			if len(lines) == 0 {
+				b.setDown(nil)
+				return
+			}
+		}
+
+		// the lines rejected for good don't make the sink down
+		if _, ok := err.(*permanentError); ok {
+			atomic.AddUint64(&b.lost, uint64(len(lines)))
+			return
+		}
+		b.setDown(err)
+		if attempt >= b.config.MaxRetries || b.isClosing() {
+			atomic.AddUint64(&b.lost, uint64(len(lines)))
+			return
+		}
+
+		delay := b.config.Backoff.Delay(attempt)
+		if se, ok := err.(*httpStatusError); ok && se.RetryAfter > delay {
+			delay = se.RetryAfter
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			atomic.AddUint64(&b.lost, uint64(len(lines)))
+			return
+		case <-b.closing:
+			// one last attempt, right now
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// Sends the lines grouped by their keys (in the order the keys appear, keeping the order of
+// the lines within a group), the groups are the indexes into the lines. Every group is tried,
+// and has a result of its own: a group failed for good (a permanentError) is lost, the other
+// failed ones are retried, and the groups sent are done.
+func sendGrouped(
+	lines [][]byte,
+	keyOf func(i int) string,
+	send func(key string, group []int) error,
+) error {
+	var keys []string
+	groups := map[string][]int{}
+	for i := range lines {
+		key := keyOf(i)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], i)
+	}
+
+	var failed [][]byte
+	lost := 0
+	var retryErr, permanentErr error
+	for _, key := range keys {
+		err := send(key, groups[key])
+		if err == nil {
+			continue
+		}
+		if _, ok := err.(*permanentError); ok {
+			lost += len(groups[key])
+			permanentErr = err
+			continue
+		}
+		for _, i := range groups[key] {
+			failed = append(failed, lines[i])
+		}
+		retryErr = err
+	}
+
+	switch {
+	case retryErr != nil:
+		return &partialError{failed: failed, lost: lost, err: retryErr}
+	case permanentErr != nil:
+		return &partialError{lost: lost, err: permanentErr}
+	}
+	return nil
+}
+
+// The error which retrying won't fix (a malformed request, a rejected auth etc.)
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+// Some of the lines were delivered, the failed ones are to be retried (by the err), and the
+// lost ones (just counted) were rejected for good
+type partialError struct {
+	failed [][]byte
+	lost   int
+	err    error
+}
+
+func (e *partialError) Error() string {
+	return fmt.Sprintf("%v lines failed: %v", len(e.failed), e.err)
+}
+
+type httpStatusError struct {
+	StatusCode int
+	Body       string
+	RetryAfter time.Duration
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("HTTP %v: %v", e.StatusCode, e.Body)
+}
+
+const maxHTTPResponseBody = 4 << 20
+
+// Posts the body, and returns the response body of a 2xx; 429 and 5xx are the retryable
+// errors, any other status is a permanent one.
+func postHTTP(
+	ctx context.Context,
+	client *http.Client,
+	url string,
+	header http.Header,
+	contentType string,
+	contentEncoding string,
+	body []byte,
+) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, &permanentError{err}
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", contentType)
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, maxHTTPResponseBody))
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return respBody, err
+	}
+
+	if len(respBody) > 512 {
+		respBody = respBody[:512]
+	}
+	se := &httpStatusError{StatusCode: resp.StatusCode, Body: string(bytes.TrimSpace(respBody))}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+			se.RetryAfter = time.Duration(secs) * time.Second
+		}
+		return nil, se
+	}
+	return nil, &permanentError{se}
+}
+
+func gzipBytes(data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	zw.Close()
+	return buf.Bytes()
+}
@@ -0,0 +1,227 @@
+package filtertag
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LinesWriter is implemented by the sinks which take the lines in batches; the BatchWriter
+// gives them the lines one by one in a single call, instead of a concatenated Write (the
+// sinks expect a line per Write).
+type LinesWriter interface {
+	WriteLines(lines [][]byte) error
+}
+
+// For the sinks which take the lines one by one anyway
+func writeLinesEach(w io.Writer, lines [][]byte) error {
+	var first error
+	for _, line := range lines {
+		if _, err := w.Write(line); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Writes the bufs with one writev if the w is a net.Conn or an *os.File (on linux), with a
+// Write each otherwise
+func writeBuffers(w io.Writer, bufs net.Buffers) error {
+	switch out := w.(type) {
+	case net.Conn:
+		_, err := bufs.WriteTo(out)
+		return err
+	case *os.File:
+		if ok, err := writevFile(out, bufs); ok {
+			return err
+		}
+	}
+	for _, b := range bufs {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type BatchWriterConfig struct {
+	MaxLines int           // per write, 100 if zero
+	MaxBytes int           // per write, 64KB if zero
+	MaxDelay time.Duration // how long a line may wait for its batch, 10ms if zero
+}
+
+// BatchWriter is to be the Logger.Output in front of the real one: it collects the lines,
+// and writes them in one Write (or one WriteLines, see LinesWriter) when there's MaxLines
+// or MaxBytes of them, or the first of them has waited for MaxDelay. So a file or a pipe gets
+// a syscall per batch, not per line. The lines are copied into one buffer, as they must be
+// kept; but a line of MaxBytes or more is not, it goes right after the collected ones,
+// with one writev when the Output is a net.Conn or an *os.File (see writeBuffers).
+//
+// The error of a write made by the timer is returned by the next Write. The ExitFunc
+// flushes it (see the Logger), but a line may still wait up to MaxDelay before the crash.
+type BatchWriter struct {
+	sinkCounters // first, for the 64-bit alignment of the atomics
+
+	Output io.Writer
+	Config BatchWriterConfig
+
+	mu     sync.Mutex
+	buf    []byte
+	ends   []int // of the lines in the buf
+	batch  [][]byte
+	bufs   net.Buffers
+	timer  *time.Timer
+	armed  bool
+	err    error // of the last flush by the timer
+	closed bool
+}
+
+func MakeBatchWriter(output io.Writer, config BatchWriterConfig) *BatchWriter {
+	if config.MaxLines <= 0 {
+		config.MaxLines = 100
+	}
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = 64 << 10
+	}
+	if config.MaxDelay <= 0 {
+		config.MaxDelay = 10 * time.Millisecond
+	}
+	w := &BatchWriter{
+		Output: output,
+		Config: config,
+	}
+	w.timer = time.AfterFunc(time.Hour, w.flushByTimer)
+	w.timer.Stop()
+	return w
+}
+
+func (w *BatchWriter) Write(p []byte) (int, error) {
+	atomic.AddUint64(&w.lines, 1)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		atomic.AddUint64(&w.lost, 1)
+		return 0, ErrSinkClosed
+	}
+
+	var err error
+	if len(p) >= w.Config.MaxBytes {
+		err = w.flushWith(p)
+	} else {
+		if len(w.ends) > 0 && len(w.buf)+len(p) > w.Config.MaxBytes {
+			w.flush()
+		}
+		w.buf = append(w.buf, p...)
+		w.ends = append(w.ends, len(w.buf))
+		if !w.armed {
+			w.timer.Reset(w.Config.MaxDelay)
+			w.armed = true
+		}
+		if len(w.ends) >= w.Config.MaxLines || len(w.buf) >= w.Config.MaxBytes {
+			err = w.flush()
+		}
+	}
+	if w.err != nil {
+		err, w.err = w.err, nil
+	}
+	if err != nil {
+		return len(p), err
+	}
+	return len(p), nil
+}
+
+func (w *BatchWriter) flushByTimer() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.armed = false
+	if err := w.flush(); err != nil {
+		w.err = err
+	}
+}
+
+// Must be called with the mu held
+func (w *BatchWriter) flush() error {
+	return w.flushWith(nil)
+}
+
+// Writes the collected lines, and the line after them if it's not nil
+func (w *BatchWriter) flushWith(line []byte) error {
+	if w.armed {
+		w.timer.Stop()
+		w.armed = false
+	}
+	n := len(w.ends)
+	if line != nil {
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+
+	var err error
+	if lw, ok := w.Output.(LinesWriter); ok {
+		w.batch = w.batch[:0]
+		start := 0
+		for _, end := range w.ends {
+			w.batch = append(w.batch, w.buf[start:end])
+			start = end
+		}
+		if line != nil {
+			w.batch = append(w.batch, line)
+		}
+		err = lw.WriteLines(w.batch)
+		for i := range w.batch {
+			w.batch[i] = nil
+		}
+	} else {
+		bufs := w.bufs[:0]
+		if len(w.buf) > 0 {
+			bufs = append(bufs, w.buf)
+		}
+		if line != nil {
+			bufs = append(bufs, line)
+		}
+		err = writeBuffers(w.Output, bufs)
+		for i := range bufs {
+			bufs[i] = nil
+		}
+		w.bufs = bufs[:0]
+	}
+	if err != nil {
+		atomic.AddUint64(&w.errors, 1)
+		atomic.AddUint64(&w.lost, uint64(n))
+	} else {
+		atomic.AddUint64(&w.written, uint64(n))
+	}
+
+	w.ends = w.ends[:0]
+	if cap(w.buf) > 4*w.Config.MaxBytes {
+		// after a huge line
+		w.buf = nil
+	} else {
+		w.buf = w.buf[:0]
+	}
+	return err
+}
+
+// Flush writes what's collected right now
+func (w *BatchWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.flush()
+}
+
+// Close flushes; the Output is left open (it's os.Stderr often enough), the lines written
+// after it are lost
+func (w *BatchWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.flush()
+}
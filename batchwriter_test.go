@@ -0,0 +1,200 @@
+package filtertag
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+type countWriter struct {
+	mu     sync.Mutex
+	writes int
+	buf    bytes.Buffer
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writes++
+	return w.buf.Write(p)
+}
+
+type linesRec struct {
+	mu    sync.Mutex
+	calls [][]string
+}
+
+func (w *linesRec) Write(p []byte) (int, error) { panic("no") }
+func (w *linesRec) WriteLines(lines [][]byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var c []string
+	for _, l := range lines {
+		c = append(c, string(l))
+	}
+	w.calls = append(w.calls, c)
+	return nil
+}
+
+func TestBatchWriter(t *testing.T) {
+	cw := &countWriter{}
+	w := MakeBatchWriter(cw, BatchWriterConfig{MaxLines: 10, MaxDelay: 20 * time.Millisecond})
+	for i := 0; i < 25; i++ {
+		w.Write([]byte(strconv.Itoa(i) + "\n"))
+	}
+	cw.mu.Lock()
+	if cw.writes != 2 {
+		t.Fatal(cw.writes)
+	}
+	cw.mu.Unlock()
+	time.Sleep(60 * time.Millisecond)
+	cw.mu.Lock()
+	if cw.writes != 3 {
+		t.Fatal(cw.writes)
+	}
+	cw.mu.Unlock()
+	w.Close()
+	if st := w.Stats(); st.Written != 25 {
+		t.Fatal(st)
+	}
+
+	lr := &linesRec{}
+	w = MakeBatchWriter(lr, BatchWriterConfig{MaxBytes: 10})
+	for i := 0; i < 5; i++ {
+		w.Write([]byte("abcd"))
+	}
+	w.Flush()
+	if len(lr.calls) != 3 || len(lr.calls[0]) != 2 || lr.calls[2][0] != "abcd" {
+		t.Fatal(lr.calls)
+	}
+}
+
+func TestBatchWriterFileSink(t *testing.T) {
+	dir := t.TempDir()
+	fs, _ := MakeFileSink(context.Background(), FileSinkConfig{Path: filepath.Join(dir, "a.log"), MaxSize: 30})
+	w := MakeBatchWriter(fs, BatchWriterConfig{})
+	for i := 0; i < 10; i++ {
+		w.Write([]byte("0123456789\n"))
+	}
+	w.Close()
+	fs.Close()
+	m, _ := filepath.Glob(filepath.Join(dir, "a-*.log"))
+	if len(m) != 4 {
+		t.Fatal(m)
+	}
+	for _, f := range m {
+		b, _ := os.ReadFile(f)
+		if len(b) != 22 {
+			t.Fatal(len(b))
+		}
+	}
+	if st := fs.Stats(); st.Written != 10 || st.Lines != 10 {
+		t.Fatal(st)
+	}
+}
+
+// A line of MaxBytes or more goes right after the collected ones, not copied, with a writev
+func TestBatchWriterBigLine(t *testing.T) {
+	r, wp, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	big := bytes.Repeat([]byte("x"), 200<<10)
+	big[len(big)-1] = '\n'
+	want := "a\nb\n" + string(big) + "c\n"
+	for _, c := range []struct {
+		out io.Writer
+		in  io.ReadCloser
+	}{{wp, r}, {conn, sc}} {
+		got := make(chan []byte)
+		go func(in io.Reader) {
+			b, _ := io.ReadAll(in)
+			got <- b
+		}(c.in)
+		w := MakeBatchWriter(c.out, BatchWriterConfig{MaxBytes: 1000})
+		w.Write([]byte("a\n"))
+		w.Write([]byte("b\n"))
+		w.Write(big)
+		w.Write([]byte("c\n"))
+		w.Close()
+		c.out.(io.Closer).Close()
+		if b := <-got; string(b) != want {
+			t.Fatalf("got %v bytes, want %v", len(b), len(want))
+		}
+		if st := w.Stats(); st.Written != 4 {
+			t.Fatal(st)
+		}
+		c.in.Close()
+	}
+}
+
+func benchmarkBatchWriter(b *testing.B, out io.Writer) {
+	line := []byte(`{"msg":"hello world","filtertags":{"logger":["INFO"]}}` + "\n")
+	big := append(bytes.Repeat([]byte("x"), 64<<10), '\n')
+	b.Run("direct", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			out.Write(line)
+		}
+	})
+	b.Run("batched", func(b *testing.B) {
+		w := MakeBatchWriter(out, BatchWriterConfig{})
+		for i := 0; i < b.N; i++ {
+			w.Write(line)
+		}
+		w.Close()
+	})
+	// every 10th line is a big one, which goes with a writev
+	b.Run("batched-big", func(b *testing.B) {
+		b.SetBytes(int64(9*len(line)+len(big)) / 10)
+		w := MakeBatchWriter(out, BatchWriterConfig{})
+		for i := 0; i < b.N; i++ {
+			if i%10 == 9 {
+				w.Write(big)
+			} else {
+				w.Write(line)
+			}
+		}
+		w.Close()
+	})
+}
+
+func BenchmarkBatchWriterPipe(b *testing.B) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		b.Fatal(err)
+	}
+	go io.Copy(io.Discard, r)
+	defer w.Close()
+	benchmarkBatchWriter(b, w)
+}
+
+// The os.Stderr as it's often enough, redirected to a file (the go test captures the real one)
+func BenchmarkBatchWriterStderr(b *testing.B) {
+	f, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	benchmarkBatchWriter(b, f)
+}
@@ -0,0 +1,357 @@
+package filtertag
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// The binary encoders (CBOR, MessagePack) can't use the newline as a line separator,
+// so every line on the stream is length-prefixed: 4 bytes big-endian uint32 length,
+// followed by the payload. The length doesn't include the prefix itself.
+const (
+	FrameHeaderSize = 4
+	MaxFrameSize    = 16 << 20
+)
+
+func beginFrame(dst []byte) ([]byte, int) {
+	at := len(dst)
+	return append(dst, 0, 0, 0, 0), at
+}
+
+func endFrame(dst []byte, at int) ([]byte, error) {
+	n := len(dst) - at - FrameHeaderSize
+	if n > MaxFrameSize {
+		return dst[:at], fmt.Errorf("frame of %v bytes exceeds MaxFrameSize", n)
+	}
+	binary.BigEndian.PutUint32(dst[at:], uint32(n))
+	return dst, nil
+}
+
+// Returns the payload of the single frame, as produced by the binary encoders.
+func framePayload(frame []byte) ([]byte, error) {
+	if len(frame) < FrameHeaderSize {
+		return nil, fmt.Errorf("frame too short: %v bytes", len(frame))
+	}
+	n := binary.BigEndian.Uint32(frame)
+	if int(n) != len(frame)-FrameHeaderSize {
+		return nil, fmt.Errorf("frame length mismatch: header says %v, got %v", n, len(frame)-FrameHeaderSize)
+	}
+	return frame[FrameHeaderSize:], nil
+}
+
+// ReadFrame reads one complete length-prefixed frame (including the prefix) from r,
+// reusing buf if it's big enough. It returns io.EOF only on a clean frame boundary.
+func ReadFrame(r io.Reader, buf []byte) (frame []byte, err error) {
+	var hdr [FrameHeaderSize]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint32(hdr[:]))
+	if n > MaxFrameSize {
+		return nil, fmt.Errorf("frame of %v bytes exceeds MaxFrameSize", n)
+	}
+	if cap(buf) < FrameHeaderSize+n {
+		buf = make([]byte, FrameHeaderSize+n)
+	}
+	frame = buf[:FrameHeaderSize+n]
+	copy(frame, hdr[:])
+	if _, err = io.ReadFull(r, frame[FrameHeaderSize:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return frame, nil
+}
+
+// TranscodeToJSON reads a stored stream of length-prefixed binary lines from src,
+// and writes them to dst as JSON lines.
+func TranscodeToJSON(dst io.Writer, src io.Reader, dec Decoder) (lines int, err error) {
+	r := bufio.NewReader(src)
+	var buf []byte
+	for {
+		buf, err = ReadFrame(r, buf)
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return lines, err
+		}
+		fields, err := dec.Decode(buf)
+		if err != nil {
+			return lines, fmt.Errorf("line %v: %v", lines+1, err)
+		}
+		out, err := json.Marshal(fields)
+		if err != nil {
+			return lines, fmt.Errorf("line %v: %v", lines+1, err)
+		}
+		out = append(out, '\n')
+		if _, err = dst.Write(out); err != nil {
+			return lines, err
+		}
+		lines++
+	}
+}
+
+// binaryFormat is the set of primitives the CBOR and MessagePack writers have in common;
+// the walk over the Go values is shared (appendBinaryValue).
+type binaryFormat interface {
+	appendNil(dst []byte) []byte
+	appendBool(dst []byte, b bool) []byte
+	appendInt(dst []byte, i int64) []byte
+	appendUint(dst []byte, u uint64) []byte
+	appendFloat(dst []byte, f float64) []byte
+	appendString(dst []byte, s string) []byte
+	appendBytes(dst []byte, b []byte) []byte
+	appendArrayHeader(dst []byte, n int) []byte
+	appendMapHeader(dst []byte, n int) []byte
+}
+
+func encodeBinaryLine(f binaryFormat, dst []byte, fields map[string]interface{}) ([]byte, error) {
+	start := len(dst)
+	dst, at := beginFrame(dst)
+	dst, err := appendBinaryMap(f, dst, fields, 0)
+	if err != nil {
+		return dst[:start], err
+	}
+	return endFrame(dst, at)
+}
+
+func appendBinaryMap(f binaryFormat, dst []byte, m map[string]interface{}, depth int) ([]byte, error) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var err error
+	dst = f.appendMapHeader(dst, len(keys))
+	for _, k := range keys {
+		dst = f.appendString(dst, k)
+		dst, err = appendBinaryValue(f, dst, m[k], depth+1)
+		if err != nil {
+			return dst, err
+		}
+	}
+	return dst, nil
+}
+
+func appendBinaryValue(f binaryFormat, dst []byte, v interface{}, depth int) ([]byte, error) {
+	if depth > DefaultMaxDepth {
+		return dst, errTooDeep
+	}
+	switch v := v.(type) {
+	case nil:
+		return f.appendNil(dst), nil
+	case string:
+		return f.appendString(dst, v), nil
+	case *Timestamp:
+		if v == nil {
+			return f.appendNil(dst), nil
+		}
+		return f.appendString(dst, v.String()), nil
+	case LazyValue:
+		return appendBinaryValue(f, dst, v.Value(), depth)
+	case json.RawMessage:
+		return appendBinaryJSON(f, dst, v, depth)
+	case *json.RawMessage:
+		if v == nil {
+			return f.appendNil(dst), nil
+		}
+		return appendBinaryJSON(f, dst, *v, depth)
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return f.appendInt(dst, i), nil
+		}
+		fl, err := v.Float64()
+		if err != nil {
+			return dst, err
+		}
+		return f.appendFloat(dst, fl), nil
+	case []byte:
+		return f.appendBytes(dst, v), nil
+	case bool:
+		return f.appendBool(dst, v), nil
+	case int:
+		return f.appendInt(dst, int64(v)), nil
+	case int8:
+		return f.appendInt(dst, int64(v)), nil
+	case int16:
+		return f.appendInt(dst, int64(v)), nil
+	case int32:
+		return f.appendInt(dst, int64(v)), nil
+	case int64:
+		return f.appendInt(dst, v), nil
+	case uint:
+		return f.appendUint(dst, uint64(v)), nil
+	case uint8:
+		return f.appendUint(dst, uint64(v)), nil
+	case uint16:
+		return f.appendUint(dst, uint64(v)), nil
+	case uint32:
+		return f.appendUint(dst, uint64(v)), nil
+	case uint64:
+		return f.appendUint(dst, v), nil
+	case float32:
+		return f.appendFloat(dst, float64(v)), nil
+	case float64:
+		return f.appendFloat(dst, v), nil
+	case time.Duration:
+		// same as json.Marshal does it
+		return f.appendInt(dst, int64(v)), nil
+	case time.Time:
+		return f.appendString(dst, v.Format(time.RFC3339Nano)), nil
+	case error:
+		return f.appendString(dst, v.Error()), nil
+	case []string:
+		dst = f.appendArrayHeader(dst, len(v))
+		for i := range v {
+			dst = f.appendString(dst, v[i])
+		}
+		return dst, nil
+	case map[string][]string:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		dst = f.appendMapHeader(dst, len(keys))
+		for _, k := range keys {
+			dst = f.appendString(dst, k)
+			dst, _ = appendBinaryValue(f, dst, v[k], depth+1)
+		}
+		return dst, nil
+	case map[string]interface{}:
+		return appendBinaryMap(f, dst, v, depth)
+	case []interface{}:
+		var err error
+		dst = f.appendArrayHeader(dst, len(v))
+		for i := range v {
+			dst, err = appendBinaryValue(f, dst, v[i], depth+1)
+			if err != nil {
+				return dst, err
+			}
+		}
+		return dst, nil
+	}
+
+	// anything else goes through its JSON form, so that the binary line carries
+	// exactly the same data as the JSON one would
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr && rv.IsNil() {
+		return f.appendNil(dst), nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return dst, err
+	}
+	return appendBinaryJSON(f, dst, b, depth)
+}
+
+func appendBinaryJSON(f binaryFormat, dst []byte, raw []byte, depth int) ([]byte, error) {
+	var v interface{}
+	if err := unmarshalUseNumber(raw, &v); err != nil {
+		return dst, err
+	}
+	return appendBinaryValue(f, dst, v, depth)
+}
+
+// Keeps a cyclic map from overflowing the stack
+var errTooDeep = fmt.Errorf("nesting deeper than %v (a cycle?)", DefaultMaxDepth)
+
+func unmarshalUseNumber(raw []byte, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	return d.Decode(v)
+}
+
+// binaryReader is a cursor over one binary payload, shared by the CBOR and MessagePack decoders.
+type binaryReader struct {
+	b     []byte
+	pos   int
+	depth int
+}
+
+const maxDecodeDepth = 100
+
+func (r *binaryReader) byte() (byte, error) {
+	if r.pos >= len(r.b) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	c := r.b[r.pos]
+	r.pos++
+	return c, nil
+}
+
+func (r *binaryReader) next(n uint64) ([]byte, error) {
+	if n > uint64(len(r.b)-r.pos) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	p := r.b[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return p, nil
+}
+
+func (r *binaryReader) uint(size int) (uint64, error) {
+	p, err := r.next(uint64(size))
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(p[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(p)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(p)), nil
+	default:
+		return binary.BigEndian.Uint64(p), nil
+	}
+}
+
+// A container can't have more elements than there are bytes left, this keeps
+// a corrupt length from allocating gigabytes.
+func (r *binaryReader) checkCount(n uint64) error {
+	if n > uint64(len(r.b)-r.pos) {
+		return fmt.Errorf("container length %v exceeds remaining %v bytes", n, len(r.b)-r.pos)
+	}
+	return nil
+}
+
+func (r *binaryReader) float32(p []byte) float64 {
+	return float64(math.Float32frombits(binary.BigEndian.Uint32(p)))
+}
+
+func decodeBinaryLine(line []byte, decodeValue func(r *binaryReader) (interface{}, error)) (fields map[string]interface{}, err error) {
+	payload, err := framePayload(line)
+	if err != nil {
+		return nil, err
+	}
+	r := &binaryReader{b: payload}
+	v, err := decodeValue(r)
+	if err != nil {
+		return nil, err
+	}
+	if r.pos != len(payload) {
+		return nil, fmt.Errorf("%v trailing bytes after the value", len(payload)-r.pos)
+	}
+	fields, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("line is %T, not a map", v)
+	}
+	return fields, nil
+}
+
+func mapKey(k interface{}) string {
+	if s, ok := k.(string); ok {
+		return s
+	}
+	return fmt.Sprint(k)
+}
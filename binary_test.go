@@ -0,0 +1,71 @@
+package filtertag
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func sampleFields() map[string]interface{} {
+	raw := json.RawMessage(`{"a":{"b":1,"c":"x y"},"arr":[1,-2,3.5]}`)
+	return map[string]interface{}{
+		"timestamp": "2021-01-01", "host": "h", "service": "/bin/x", "subsystem": "", "filtertag": nil,
+		"ctxpretext": "", "err": "", "msg": "hello world",
+		"filtertags": map[string][]string{"logger": {"INFO", "L3"}},
+		"nested":     &raw, "neg": -100000, "big": uint64(1) << 63, "d": time.Second, "f": 1.5,
+		"long": string(make([]byte, 300)),
+	}
+}
+
+func TestBinaryRoundtrip(t *testing.T) {
+	for _, c := range []struct {
+		e Encoder
+		d Decoder
+	}{{&CBOREncoder{}, &CBORDecoder{}}, {&MsgpackEncoder{}, &MsgpackDecoder{}}} {
+		var stream []byte
+		var err error
+		for i := 0; i < 3; i++ {
+			stream, err = c.e.Encode(stream, sampleFields())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		var out bytes.Buffer
+		n, err := TranscodeToJSON(&out, bytes.NewReader(stream), c.d)
+		if err != nil || n != 3 {
+			t.Fatal(n, err)
+		}
+		want, _ := (&JSONEncoder{}).Encode(nil, sampleFields())
+		var a, b interface{}
+		json.Unmarshal(want, &a)
+		json.Unmarshal(bytes.SplitN(out.Bytes(), []byte("\n"), 2)[0], &b)
+		aj, _ := json.Marshal(a)
+		bj, _ := json.Marshal(b)
+		if !bytes.Equal(aj, bj) {
+			t.Fatalf("\n%s\n%s", aj, bj)
+		}
+	}
+}
+
+func BenchmarkEncoders(b *testing.B) {
+	f := sampleFields()
+	for name, e := range map[string]Encoder{"json": &JSONEncoder{}, "cbor": &CBOREncoder{}, "msgpack": &MsgpackEncoder{}, "logfmt": &LogfmtEncoder{}} {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			var buf []byte
+			for i := 0; i < b.N; i++ {
+				buf, _ = e.Encode(buf[:0], f)
+			}
+		})
+	}
+	// the baseline, the same Fields by the encoding/json
+	b.Run("json.Marshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := json.Marshal(f); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,236 @@
+package filtertag
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// CBOREncoder renders the Fields as a CBOR map (RFC 8949), length-prefixed on the stream.
+type CBOREncoder struct{}
+
+func (enc *CBOREncoder) Encode(dst []byte, fields map[string]interface{}) ([]byte, error) {
+	return encodeBinaryLine(cborFormat{}, dst, fields)
+}
+
+type CBORDecoder struct{}
+
+func (dec *CBORDecoder) Decode(line []byte) (fields map[string]interface{}, err error) {
+	return decodeBinaryLine(line, decodeCBORValue)
+}
+
+const (
+	cborUint   = 0 << 5
+	cborNegint = 1 << 5
+	cborBytes  = 2 << 5
+	cborText   = 3 << 5
+	cborArray  = 4 << 5
+	cborMap    = 5 << 5
+	cborTag    = 6 << 5
+	cborSimple = 7 << 5
+)
+
+type cborFormat struct{}
+
+func (cborFormat) head(dst []byte, major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(dst, major|byte(n))
+	case n <= math.MaxUint8:
+		return append(dst, major|24, byte(n))
+	case n <= math.MaxUint16:
+		return append(dst, major|25, byte(n>>8), byte(n))
+	case n <= math.MaxUint32:
+		return append(dst, major|26, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	dst = append(dst, major|27)
+	return appendUint64(dst, n)
+}
+
+func appendUint64(dst []byte, n uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], n)
+	return append(dst, b[:]...)
+}
+
+func (cborFormat) appendNil(dst []byte) []byte {
+	return append(dst, 0xf6)
+}
+
+func (cborFormat) appendBool(dst []byte, b bool) []byte {
+	if b {
+		return append(dst, 0xf5)
+	}
+	return append(dst, 0xf4)
+}
+
+func (f cborFormat) appendInt(dst []byte, i int64) []byte {
+	if i < 0 {
+		return f.head(dst, cborNegint, uint64(-(i + 1)))
+	}
+	return f.head(dst, cborUint, uint64(i))
+}
+
+func (f cborFormat) appendUint(dst []byte, u uint64) []byte {
+	return f.head(dst, cborUint, u)
+}
+
+func (cborFormat) appendFloat(dst []byte, fl float64) []byte {
+	dst = append(dst, 0xfb)
+	return appendUint64(dst, math.Float64bits(fl))
+}
+
+func (f cborFormat) appendString(dst []byte, s string) []byte {
+	dst = f.head(dst, cborText, uint64(len(s)))
+	return append(dst, s...)
+}
+
+func (f cborFormat) appendBytes(dst []byte, b []byte) []byte {
+	dst = f.head(dst, cborBytes, uint64(len(b)))
+	return append(dst, b...)
+}
+
+func (f cborFormat) appendArrayHeader(dst []byte, n int) []byte {
+	return f.head(dst, cborArray, uint64(n))
+}
+
+func (f cborFormat) appendMapHeader(dst []byte, n int) []byte {
+	return f.head(dst, cborMap, uint64(n))
+}
+
+// Decodes the definite-length subset of CBOR, i.e. what CBOREncoder produces,
+// plus half/single floats and tags (the tag number is skipped).
+func decodeCBORValue(r *binaryReader) (interface{}, error) {
+	c, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	major, info := c&0xe0, c&0x1f
+
+	if major == cborSimple {
+		switch info {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22, 23:
+			return nil, nil
+		case 25:
+			p, err := r.next(2)
+			if err != nil {
+				return nil, err
+			}
+			return halfToFloat64(binary.BigEndian.Uint16(p)), nil
+		case 26:
+			p, err := r.next(4)
+			if err != nil {
+				return nil, err
+			}
+			return r.float32(p), nil
+		case 27:
+			p, err := r.next(8)
+			if err != nil {
+				return nil, err
+			}
+			return math.Float64frombits(binary.BigEndian.Uint64(p)), nil
+		}
+		return nil, fmt.Errorf("cbor: unsupported simple value %v", info)
+	}
+
+	var n uint64
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info <= 27:
+		n, err = r.uint(1 << (info - 24))
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("cbor: unsupported additional info %v (indefinite lengths aren't supported)", info)
+	}
+
+	switch major {
+	case cborUint:
+		if n <= math.MaxInt64 {
+			return int64(n), nil
+		}
+		return n, nil
+	case cborNegint:
+		if n > math.MaxInt64 {
+			return nil, fmt.Errorf("cbor: negative integer overflows int64")
+		}
+		return -1 - int64(n), nil
+	case cborBytes:
+		p, err := r.next(n)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), p...), nil
+	case cborText:
+		p, err := r.next(n)
+		if err != nil {
+			return nil, err
+		}
+		return string(p), nil
+	case cborTag:
+		return decodeCBORNested(r)
+	case cborArray:
+		if err = r.checkCount(n); err != nil {
+			return nil, err
+		}
+		a := make([]interface{}, n)
+		for i := range a {
+			if a[i], err = decodeCBORNested(r); err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	default: // cborMap
+		if err = r.checkCount(n); err != nil {
+			return nil, err
+		}
+		m := make(map[string]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			k, err := decodeCBORNested(r)
+			if err != nil {
+				return nil, err
+			}
+			if m[mapKey(k)], err = decodeCBORNested(r); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	}
+}
+
+func decodeCBORNested(r *binaryReader) (interface{}, error) {
+	r.depth++
+	defer func() { r.depth-- }()
+	if r.depth > maxDecodeDepth {
+		return nil, fmt.Errorf("cbor: nesting deeper than %v", maxDecodeDepth)
+	}
+	return decodeCBORValue(r)
+}
+
+func halfToFloat64(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		return -f
+	}
+	return f
+}
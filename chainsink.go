@@ -0,0 +1,188 @@
+package filtertag
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// What a ChainSink does when a write to a link fails (or the link is down, see DownReporter);
+// in any case, the line then goes to the next link, if there's one
+const (
+	SinkPolicy_Skip    int = iota // the line is skipped for the link, the next line tries it again
+	SinkPolicy_Retry              // the link is skipped until the Backoff's delay is over, then the next line tries it
+	SinkPolicy_Disable            // the link is skipped for the DisableFor
+)
+
+// A link of the ChainSink. The sinks which queue the lines (the network ones, the WatchdogSink)
+// take every line, they fail when delivering it, later; so they can only be a link followed
+// by the others if they report that they're down (they do, see DownReporter).
+type ChainLink struct {
+	Sink   io.Writer
+	Name   string // for the diagnostics, like "loki"; "sink #N" if empty
+	Policy int    // one of the SinkPolicy_...
+
+	Retries    int           // for the SinkPolicy_Retry: the failed tries in a row before it's disabled for the DisableFor; 3 if zero
+	Backoff    Backoff       // between the tries, for the SinkPolicy_Retry; 10ms to 100ms if zero
+	DisableFor time.Duration // 30s if zero
+}
+
+type ChainSinkConfig struct {
+	// The sinks in the order of preference, like a network one, then a file, then os.Stderr;
+	// every line goes to the first one which takes it
+	Links []ChainLink
+
+	// Called on every failed write to a link (or a link found down), with the link's Name
+	ErrorFunc func(name string, err error)
+
+	// Encodes the diagnostic lines: when a link starts failing (and when it's back), a
+	// LOGGER-tagged line about it is written to the link which took the line instead.
+	// The default one if nil (the JSONEncoder); match it with the Entry.Encoder.
+	Encoder Encoder
+}
+
+// ChainSink is the Logger.Output with the fallbacks: it writes every line to the first of
+// its links which is up, so the lines keep going somewhere while a sink is down. It fails
+// the Write only when all of the links failed (then the Logger.ErrorFunc has it).
+type ChainSink struct {
+	sinkCounters // first, for the 64-bit alignment of the atomics
+
+	Config ChainSinkConfig
+
+	mu     sync.Mutex
+	states []chainLinkState
+	host   string
+	exe    string
+}
+
+type chainLinkState struct {
+	failing       bool
+	reported      bool  // by a diagnostic line
+	err           error // the last one
+	attempts      int   // the failed tries in a row, for the SinkPolicy_Retry
+	disabledUntil time.Time
+}
+
+func MakeChainSink(config ChainSinkConfig) *ChainSink {
+	links := make([]ChainLink, len(config.Links))
+	for i, link := range config.Links {
+		if link.Name == "" {
+			link.Name = fmt.Sprintf("sink #%v", i)
+		}
+		if link.Retries <= 0 {
+			link.Retries = 3
+		}
+		if link.Backoff.Min <= 0 {
+			link.Backoff = Backoff{Min: 10 * time.Millisecond, Max: 100 * time.Millisecond, Factor: 2}
+		}
+		if link.DisableFor <= 0 {
+			link.DisableFor = 30 * time.Second
+		}
+		links[i] = link
+	}
+	config.Links = links
+	if config.Encoder == nil {
+		config.Encoder = defaultEncoder
+	}
+
+	sink := &ChainSink{
+		Config: config,
+		states: make([]chainLinkState, len(links)),
+	}
+	sink.host, _ = os.Hostname()
+	sink.exe = filepath.Base(os.Args[0])
+	return sink
+}
+
+func (sink *ChainSink) Write(p []byte) (int, error) {
+	atomic.AddUint64(&sink.lines, 1)
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+
+	now := time.Now()
+	var lastErr error
+	for i := range sink.Config.Links {
+		state := &sink.states[i]
+		if now.Before(state.disabledUntil) {
+			continue
+		}
+		err := sink.writeLink(i, p)
+		if err == nil {
+			if state.failing {
+				*state = chainLinkState{}
+				sink.diagnostic(i, fmt.Sprintf("filtertag sink %v is back", sink.Config.Links[i].Name), nil)
+			}
+			for j := range sink.states {
+				if f := &sink.states[j]; f.failing && !f.reported {
+					f.reported = true
+					sink.diagnostic(i, fmt.Sprintf("filtertag sink %v failed, the lines go to %v", sink.Config.Links[j].Name, sink.Config.Links[i].Name), f.err)
+				}
+			}
+			atomic.AddUint64(&sink.written, 1)
+			return len(p), nil
+		}
+
+		lastErr = err
+		state.err = err
+		atomic.AddUint64(&sink.errors, 1)
+		if sink.Config.ErrorFunc != nil {
+			sink.Config.ErrorFunc(sink.Config.Links[i].Name, err)
+		}
+		// no waiting here, it's the logger goroutine; the next lines try the link again
+		switch link := &sink.Config.Links[i]; link.Policy {
+		case SinkPolicy_Retry:
+			if state.attempts < link.Retries {
+				state.disabledUntil = now.Add(link.Backoff.Delay(state.attempts))
+			} else {
+				state.disabledUntil = now.Add(link.DisableFor)
+			}
+			state.attempts++
+		case SinkPolicy_Disable:
+			state.disabledUntil = now.Add(link.DisableFor)
+		}
+		state.failing = true
+	}
+
+	atomic.AddUint64(&sink.lost, 1)
+	if lastErr == nil {
+		lastErr = fmt.Errorf("filtertag: all the %v sinks of the chain are disabled", len(sink.Config.Links))
+	}
+	return 0, lastErr
+}
+
+func (sink *ChainSink) WriteLines(lines [][]byte) error {
+	return writeLinesEach(sink, lines)
+}
+
+// A link which is down fails without the write, the line goes to the next one
+func (sink *ChainSink) writeLink(i int, p []byte) error {
+	link := &sink.Config.Links[i]
+	if dr, ok := link.Sink.(DownReporter); ok {
+		if err := dr.Down(); err != nil {
+			return err
+		}
+	}
+	_, err := link.Sink.Write(p)
+	return err
+}
+
+// Writes the LOGGER line about the link's failure (or recovery) to the link i; its own
+// failure is let go, it's just a diagnostic
+func (sink *ChainSink) diagnostic(i int, msg string, err error) {
+	tags := []string{"LOGGER", "ERROR"}
+	if err == nil {
+		tags = []string{"LOGGER", "INFO"}
+	}
+	buf := getLineBuffer()
+	defer putLineBuffer(buf)
+	line, encErr := appendDiagnosticLine(sink.Config.Encoder, buf.b[:0], sink.host, sink.exe, tags, msg, err)
+	if encErr != nil {
+		return
+	}
+	buf.b = line
+	sink.Config.Links[i].Sink.Write(line)
+}
@@ -0,0 +1,125 @@
+package filtertag
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type flakyWriter struct {
+	mu    sync.Mutex
+	fail  bool
+	calls int
+	buf   bytes.Buffer
+}
+
+func (w *flakyWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.calls++
+	if w.fail {
+		return 0, errors.New("down")
+	}
+	return w.buf.Write(p)
+}
+
+func TestChainSink(t *testing.T) {
+	a, b, c := &flakyWriter{}, &flakyWriter{}, &flakyWriter{}
+	sink := MakeChainSink(ChainSinkConfig{
+		Links: []ChainLink{
+			{Sink: a, Name: "net", Policy: SinkPolicy_Disable, DisableFor: 50 * time.Millisecond},
+			{Sink: b, Name: "file", Policy: SinkPolicy_Retry, Retries: 2, Backoff: Backoff{Min: time.Hour, Max: time.Hour}},
+			{Sink: c, Name: "stderr"},
+		},
+	})
+	sink.Write([]byte("1\n"))
+	a.fail = true
+	sink.Write([]byte("2\n"))
+	sink.Write([]byte("3\n"))
+	if a.calls != 2 {
+		t.Fatal("not disabled", a.calls)
+	}
+	b.fail = true
+	start := time.Now()
+	sink.Write([]byte("4\n"))
+	// the retry is after the Backoff, not in the Write
+	if time.Since(start) > time.Second || b.calls != 3+1 {
+		t.Fatal("retried in the Write", b.calls)
+	}
+	if !strings.Contains(c.buf.String(), "4\n") || !strings.Contains(c.buf.String(), "file failed") {
+		t.Fatal(c.buf.String())
+	}
+	if !strings.Contains(b.buf.String(), `"LOGGER"`) || !strings.Contains(b.buf.String(), "net failed") {
+		t.Fatal(b.buf.String())
+	}
+	c.fail = true
+	if _, err := sink.Write([]byte("5\n")); err == nil {
+		t.Fatal("no err")
+	}
+	a.fail, b.fail, c.fail = false, false, false
+	time.Sleep(60 * time.Millisecond)
+	sink.Write([]byte("6\n"))
+	if !strings.Contains(a.buf.String(), "net is back") || !strings.HasPrefix(a.buf.String(), "1\n6\n") {
+		t.Fatal(a.buf.String())
+	}
+	if b.calls != 4 {
+		t.Fatal("the file was tried before its Backoff", b.calls)
+	}
+	if st := sink.Stats(); st.Written != 5 || st.Lost != 1 {
+		t.Fatal(st)
+	}
+}
+
+// After the Retries failed tries in a row the link is disabled for the DisableFor
+func TestChainSinkRetry(t *testing.T) {
+	a, b := &flakyWriter{fail: true}, &flakyWriter{}
+	sink := MakeChainSink(ChainSinkConfig{
+		Links: []ChainLink{
+			{Sink: a, Policy: SinkPolicy_Retry, Retries: 2, Backoff: Backoff{Min: time.Millisecond, Max: time.Millisecond}, DisableFor: time.Hour},
+			{Sink: b},
+		},
+	})
+	for i := 0; i < 10; i++ {
+		sink.Write([]byte("x\n"))
+		time.Sleep(5 * time.Millisecond)
+	}
+	if a.calls != 3 {
+		t.Fatal("tried", a.calls)
+	}
+	if st := sink.Stats(); st.Written != 10 {
+		t.Fatal(st)
+	}
+}
+
+// A NetSink takes every line, but it's down while it can't connect, so the lines go on
+func TestChainSinkDownLink(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	ns := MakeNetSink(context.Background(), NetSinkConfig{Network: "tcp", Address: addr, Backoff: Backoff{Min: time.Millisecond, Max: time.Millisecond}})
+	defer ns.Close()
+	b := &flakyWriter{}
+	sink := MakeChainSink(ChainSinkConfig{Links: []ChainLink{{Sink: ns, Name: "net"}, {Sink: b, Name: "file"}}})
+
+	sink.Write([]byte("1\n"))
+	deadline := time.Now().Add(5 * time.Second)
+	for ns.Down() == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if ns.Down() == nil {
+		t.Fatal("not down")
+	}
+	sink.Write([]byte("2\n"))
+	if !strings.Contains(b.buf.String(), "2\n") || !strings.Contains(b.buf.String(), "net failed") {
+		t.Fatal(b.buf.String())
+	}
+}
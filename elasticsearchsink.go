@@ -0,0 +1,189 @@
+package filtertag
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type ElasticsearchSinkConfig struct {
+	URL string // of the cluster (or a node), e.g. "http://localhost:9200"; the "/_bulk" is added
+
+	// The index of a line: the holes are filled from its fields (see LogTemplate()), and the
+	// rest is the time layout of its timestamp in UTC, like "logs-{service}-2006.01.02"; so
+	// mind the digits and the words like "Jan" or "Mon" outside the holes. "filtertag-2006.01.02"
+	// if empty.
+	Index string
+	// The "create" op instead of the "index"; the data streams accept only that
+	Create   bool
+	Pipeline string // the ingest pipeline, if any
+
+	Gzip   bool
+	Header http.Header // auth (Basic or ApiKey) etc.
+	Client *http.Client
+
+	// Reads the lines back into the documents; must match the Entry.Encoder, JSONDecoder if nil
+	Decoder Decoder
+
+	BatchConfig
+}
+
+// ElasticsearchSink indexes the lines into Elasticsearch or OpenSearch with the _bulk API:
+// a document per line, with its fields and the "@timestamp". The documents the bulk response
+// reports as failed with 429 or 5xx are retried (and only they); the ones rejected otherwise
+// (a mapping conflict etc.) are lost.
+type ElasticsearchSink struct {
+	*batcher
+	Config ElasticsearchSinkConfig
+
+	bulkURL string
+	index   fieldTemplate
+}
+
+func MakeElasticsearchSink(ctx context.Context, config ElasticsearchSinkConfig) *ElasticsearchSink {
+	if config.Index == "" {
+		config.Index = "filtertag-2006.01.02"
+	}
+	if config.Decoder == nil {
+		config.Decoder = &JSONDecoder{}
+	}
+
+	sink := &ElasticsearchSink{
+		Config:  config,
+		bulkURL: strings.TrimRight(config.URL, "/") + "/_bulk",
+		index:   parseFieldTemplate(config.Index),
+	}
+	if config.Pipeline != "" {
+		sink.bulkURL += "?pipeline=" + url.QueryEscape(config.Pipeline)
+	}
+	sink.batcher = makeBatcher(ctx, config.BatchConfig, sink.send)
+	return sink
+}
+
+func (sink *ElasticsearchSink) send(ctx context.Context, lines [][]byte) error {
+	op := "index"
+	if sink.Config.Create {
+		op = "create"
+	}
+
+	var body []byte
+	for _, line := range lines {
+		fields, err := sink.Config.Decoder.Decode(line)
+		if err != nil {
+			fields = map[string]interface{}{"msg": string(line)}
+		}
+		t := lineTime(fields)
+		if _, ok := fields["@timestamp"]; !ok {
+			fields["@timestamp"] = t.UTC().Format(time.RFC3339Nano)
+		}
+		doc, err := json.Marshal(fields)
+		if err != nil {
+			doc, _ = json.Marshal(map[string]interface{}{
+				"@timestamp": t.UTC().Format(time.RFC3339Nano),
+				"msg":        string(line),
+			})
+		}
+
+		// {"index":{"_index":"..."}}\n{...document...}\n
+		body = append(body, `{"`...)
+		body = append(body, op...)
+		body = append(body, `":{"_index":`...)
+		body = appendJSONString(body, sink.indexName(fields, t))
+		body = append(body, "}}\n"...)
+		body = append(body, doc...)
+		body = append(body, '\n')
+	}
+
+	contentEncoding := ""
+	if sink.Config.Gzip {
+		body = gzipBytes(body)
+		contentEncoding = "gzip"
+	}
+	resp, err := postHTTP(ctx, sink.Config.Client, sink.bulkURL, sink.Config.Header, "application/x-ndjson", contentEncoding, body)
+	if err != nil {
+		return err
+	}
+	return bulkErrors(resp, lines)
+}
+
+func (sink *ElasticsearchSink) indexName(fields map[string]interface{}, t time.Time) string {
+	var b []byte
+	for _, p := range sink.index {
+		if p.hole {
+			b = append(b, fieldString(fields, p.text)...)
+		} else {
+			b = t.UTC().AppendFormat(b, p.text)
+		}
+	}
+	return esIndexName(string(b))
+}
+
+// The index names are lowercase, without the \ / * ? " < > | , # : and spaces, can't start
+// with the - _ +, and are 255 bytes at most (Elasticsearch rejects the documents for the
+// others, for good); the characters a name can't have become "_"
+func esIndexName(name string) string {
+	b := []byte(strings.ToLower(name))
+	for i, c := range b {
+		switch c {
+		case '\\', '/', '*', '?', '"', '<', '>', '|', ',', '#', ':', ' ', '\t', '\n', '\r':
+			b[i] = '_'
+		}
+	}
+	b = bytes.TrimLeft(b, "-_+")
+	if len(b) > 255 {
+		b = b[:255]
+	}
+	if len(b) == 0 || string(b) == "." || string(b) == ".." {
+		return "filtertag"
+	}
+	return string(b)
+}
+
+// The per-item errors of the bulk response: the items are in the order of the request
+func bulkErrors(resp []byte, lines [][]byte) error {
+	var result struct {
+		Errors bool
+		Items  []map[string]struct {
+			Status int
+			Error  json.RawMessage
+		}
+	}
+	if err := json.Unmarshal(resp, &result); err != nil {
+		// it was accepted as a whole, just not understood
+		return nil
+	}
+	if !result.Errors {
+		return nil
+	}
+
+	var failed [][]byte
+	var lost int
+	var firstErr string
+	for i, item := range result.Items {
+		if i >= len(lines) {
+			break
+		}
+		for _, r := range item {
+			if r.Status >= 200 && r.Status < 300 {
+				continue
+			}
+			if firstErr == "" {
+				firstErr = fmt.Sprintf("HTTP %v: %s", r.Status, r.Error)
+			}
+			if r.Status == http.StatusTooManyRequests || r.Status >= 500 {
+				failed = append(failed, lines[i])
+			} else {
+				lost++
+			}
+		}
+	}
+	if len(failed) == 0 && lost == 0 {
+		return nil
+	}
+	return &partialError{failed: failed, lost: lost, err: fmt.Errorf("bulk items failed, the first one with %v", firstErr)}
+}
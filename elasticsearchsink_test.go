@@ -0,0 +1,108 @@
+package filtertag
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The bulk endpoint: the "busy" document gets a 429 the first time, the "bad" one a 400
+func TestElasticsearchSinkBulk(t *testing.T) {
+	var mu sync.Mutex
+	var calls [][]string // the msgs of every request
+	var indexes []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_bulk" || r.URL.Query().Get("pipeline") != "p1" || r.Header.Get("Content-Type") != "application/x-ndjson" {
+			t.Errorf("got the request %v %v", r.URL, r.Header)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		var msgs, items []string
+		sc := bufio.NewScanner(r.Body)
+		for sc.Scan() {
+			var action map[string]map[string]string
+			if err := json.Unmarshal(sc.Bytes(), &action); err != nil {
+				t.Errorf("bad action %q: %v", sc.Bytes(), err)
+			}
+			sc.Scan()
+			var doc map[string]interface{}
+			if err := json.Unmarshal(sc.Bytes(), &doc); err != nil {
+				t.Errorf("bad document %q: %v", sc.Bytes(), err)
+			}
+			if doc["@timestamp"] == nil {
+				t.Errorf("no @timestamp in %v", doc)
+			}
+			msg, _ := doc["msg"].(string)
+			indexes = append(indexes, action["create"]["_index"])
+			msgs = append(msgs, msg)
+			status := 201
+			switch {
+			case msg == "busy" && len(calls) == 0:
+				status = 429
+			case msg == "bad":
+				status = 400
+			}
+			items = append(items, fmt.Sprintf(`{"create":{"status":%d,"error":{"type":"x"}}}`, status))
+		}
+		calls = append(calls, msgs)
+		fmt.Fprintf(w, `{"took":1,"errors":true,"items":[%s]}`, strings.Join(items, ","))
+	}))
+	defer srv.Close()
+
+	sink := MakeElasticsearchSink(context.Background(), ElasticsearchSinkConfig{
+		URL:      srv.URL + "/",
+		Index:    "{service}-logs-2006.01.02",
+		Create:   true,
+		Pipeline: "p1",
+		BatchConfig: BatchConfig{
+			MaxDelay: 10 * time.Millisecond,
+			Backoff:  Backoff{Min: time.Millisecond, Max: time.Millisecond},
+		},
+	})
+	for _, m := range []string{"ok", "busy", "bad"} {
+		sink.Write([]byte(`{"timestamp":"2021-03-04T23:59:00Z","service":"_My Svc/API","msg":"` + m + `"}` + "\n"))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for sink.Stats().Written+sink.Stats().Lost < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	sink.Close()
+
+	if st := sink.Stats(); st.Written != 2 || st.Lost != 1 {
+		t.Fatalf("got %+v", st)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(calls) != 2 || len(calls[1]) != 1 || calls[1][0] != "busy" {
+		t.Fatalf("got the requests %v", calls)
+	}
+	for _, index := range indexes {
+		if index != "my_svc_api-logs-2021.03.04" {
+			t.Fatalf("got the indexes %v", indexes)
+		}
+	}
+}
+
+func TestElasticsearchIndexName(t *testing.T) {
+	for name, want := range map[string]string{
+		"Logs-2021.03.04":        "logs-2021.03.04",
+		`a\b/c*d?e"f<g>h|i,j`:    "a_b_c_d_e_f_g_h_i_j",
+		"svc#1:x y":              "svc_1_x_y",
+		"-_+logs":                "logs",
+		"_":                      "filtertag",
+		"..":                     "filtertag",
+		"":                       "filtertag",
+		strings.Repeat("x", 300): strings.Repeat("x", 255),
+	} {
+		if got := esIndexName(name); got != want {
+			t.Errorf("esIndexName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
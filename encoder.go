@@ -0,0 +1,32 @@
+package filtertag
+
+import (
+	"encoding/json"
+)
+
+// Encoder renders the Entry.Fields into one complete output line (including
+// its framing, e.g. the trailing newline), appended to dst.
+type Encoder interface {
+	Encode(dst []byte, fields map[string]interface{}) ([]byte, error)
+}
+
+// Decoder is the reverse of the Encoder, it reads one line back into Fields.
+type Decoder interface {
+	Decode(line []byte) (fields map[string]interface{}, err error)
+}
+
+type JSONDecoder struct{}
+
+func (dec *JSONDecoder) Decode(line []byte) (fields map[string]interface{}, err error) {
+	err = json.Unmarshal(line, &fields)
+	return
+}
+
+var defaultEncoder = &JSONEncoder{Safe: true}
+
+func (entry *Entry) encoder() Encoder {
+	if entry.Encoder == nil {
+		return defaultEncoder
+	}
+	return entry.Encoder
+}
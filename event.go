@@ -0,0 +1,216 @@
+package filtertag
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event is the chained builder of one line:
+//
+//	entry.Event("INPRODENV").Str("user", u).Int("n", n).Msg("done")
+//
+// The filtertags are checked by the Entry.Filter right in the Event(), and if the line
+// isn't going to pass, Event() returns nil, and all the methods of a nil *Event do nothing,
+// so no fields are collected and nothing is encoded.
+type Event struct {
+	entry      *Entry
+	filtertags []string
+	fields     []Field
+}
+
+var eventPool = sync.Pool{
+	New: func() interface{} {
+		return &Event{fields: make([]Field, 0, 8)}
+	},
+}
+
+func (entry *Entry) Event(filtertags ...string) (ev *Event) {
+	for i := range filtertags {
+		filtertags[i] = strings.ToUpper(filtertags[i])
+	}
+	if !entry.Passes(filtertags) {
+		return nil
+	}
+	ev = eventPool.Get().(*Event)
+	ev.entry = entry
+	ev.filtertags = filtertags
+	return ev
+}
+
+func (ev *Event) Str(key string, val string) *Event {
+	return ev.Fields(String(key, val))
+}
+
+func (ev *Event) Int(key string, val int) *Event {
+	return ev.Fields(Int(key, val))
+}
+
+func (ev *Event) Int64(key string, val int64) *Event {
+	return ev.Fields(Int64(key, val))
+}
+
+func (ev *Event) Float64(key string, val float64) *Event {
+	return ev.Fields(Float64(key, val))
+}
+
+func (ev *Event) Bool(key string, val bool) *Event {
+	return ev.Fields(Bool(key, val))
+}
+
+func (ev *Event) Dur(key string, val time.Duration) *Event {
+	return ev.Fields(Dur(key, val))
+}
+
+func (ev *Event) Time(key string, val time.Time) *Event {
+	return ev.Fields(Time(key, val))
+}
+
+func (ev *Event) Err(err error) *Event {
+	return ev.Fields(Err(err))
+}
+
+func (ev *Event) Any(key string, val interface{}) *Event {
+	return ev.Fields(Any(key, val))
+}
+
+func (ev *Event) Object(key string, val interface{}) *Event {
+	return ev.Fields(Object(key, val))
+}
+
+func (ev *Event) Fields(fields ...Field) *Event {
+	if ev == nil {
+		return nil
+	}
+	ev.fields = append(ev.fields, fields...)
+	return ev
+}
+
+// Ctx adds the trace and span IDs of the ctx to the line, if it has them, see
+// ContextWithTraceIDs()
+func (ev *Event) Ctx(ctx context.Context) *Event {
+	if ev == nil {
+		return nil
+	}
+	ev.fields = appendTraceIDs(ev.fields, ctx)
+	return ev
+}
+
+// Enabled tells whether the line is going to be logged; useful to skip some
+// costly preparations of the fields.
+func (ev *Event) Enabled() bool {
+	return ev != nil
+}
+
+// Msg logs the line; the Event must not be used after that.
+func (ev *Event) Msg(msg string) {
+	if ev == nil {
+		return
+	}
+	ev.entry.logWith(nil, ev.filtertags, msg, ev.fields)
+	ev.release()
+}
+
+func (ev *Event) Msgf(formatString string, args ...interface{}) {
+	if ev == nil {
+		return
+	}
+	ev.Msg(fmt.Sprintf(formatString, args...))
+}
+
+// Send logs the line with an empty msg.
+func (ev *Event) Send() {
+	ev.Msg("")
+}
+
+func (ev *Event) release() {
+	for i := range ev.fields {
+		ev.fields[i] = Field{}
+	}
+	ev.entry = nil
+	ev.filtertags = nil
+	ev.fields = ev.fields[:0]
+	eventPool.Put(ev)
+}
+
+// LogFields is the Logft() with the typed fields and a plain msg (no formatting).
+// The fields are only set for this one line, and the Entry.Fields are then put back as
+// they were.
+func (entry *Entry) LogFields(
+	filtertags []string,
+	msg string,
+	fields ...Field,
+) {
+	for i := range filtertags {
+		filtertags[i] = strings.ToUpper(filtertags[i])
+	}
+	if !entry.Passes(filtertags) {
+		return
+	}
+	entry.logWith(nil, filtertags, msg, fields)
+}
+
+// The fields are set for the one line, see logLine for the done
+func (entry *Entry) logWith(done <-chan struct{}, filtertags []string, msg string, fields []Field) bool {
+	if len(fields) == 0 {
+		return entry.logLine(filtertags, msg, done)
+	}
+
+	type savedField struct {
+		key     string
+		value   interface{}
+		existed bool
+	}
+	saved := make([]savedField, 0, len(fields))
+	for i := range fields {
+		old, existed := entry.Fields[fields[i].Key]
+		saved = append(saved, savedField{key: fields[i].Key, value: old, existed: existed})
+		entry.Fields[fields[i].Key] = fields[i].Value()
+	}
+
+	sent := entry.logLine(filtertags, msg, done)
+
+	// backwards, so that a key given twice ends up with its original value
+	for i := len(saved) - 1; i >= 0; i-- {
+		if saved[i].existed {
+			entry.Fields[saved[i].key] = saved[i].value
+		} else {
+			delete(entry.Fields, saved[i].key)
+		}
+	}
+	return sent
+}
+
+type traceIDsKey struct{}
+
+type traceIDs struct {
+	traceID string
+	spanID  string
+}
+
+// ContextWithTraceIDs returns the ctx carrying the trace and span IDs (hex, as in the W3C
+// traceparent), so that the lines logged with it (the LogftCtx(), the Event's Ctx()) have
+// them in the "trace_id" and "span_id" fields; the OTLPSink sends these as the LogRecord's
+// trace_id and span_id.
+func ContextWithTraceIDs(ctx context.Context, traceID, spanID string) context.Context {
+	return context.WithValue(ctx, traceIDsKey{}, traceIDs{traceID: traceID, spanID: spanID})
+}
+
+// TraceIDsFromContext returns the IDs set by the ContextWithTraceIDs(), empty if none
+func TraceIDsFromContext(ctx context.Context) (traceID, spanID string) {
+	ids, _ := ctx.Value(traceIDsKey{}).(traceIDs)
+	return ids.traceID, ids.spanID
+}
+
+func appendTraceIDs(fields []Field, ctx context.Context) []Field {
+	traceID, spanID := TraceIDsFromContext(ctx)
+	if traceID != "" {
+		fields = append(fields, String("trace_id", traceID))
+	}
+	if spanID != "" {
+		fields = append(fields, String("span_id", spanID))
+	}
+	return fields
+}
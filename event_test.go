@@ -0,0 +1,137 @@
+package filtertag
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// How each kind of the Field ends up in the line, by the JSON and the logfmt encoders
+func TestFieldEncoded(t *testing.T) {
+	ts := time.Date(2021, 3, 4, 5, 6, 7, 500000000, time.UTC)
+	for _, c := range []struct {
+		field  Field
+		json   string
+		logfmt string
+	}{
+		{String("k", "a b"), `"a b"`, `k="a b"`},
+		{Int("k", 42), `42`, `k=42`},
+		{Int64("k", -7), `-7`, `k=-7`},
+		{Float64("k", 1.5), `1.5`, `k=1.5`},
+		{Bool("k", true), `true`, `k=true`},
+		{Bool("k", false), `false`, `k=false`},
+		{Dur("k", 1500*time.Millisecond), `1500000000`, `k=1.5s`},
+		{Time("k", ts), `"2021-03-04T05:06:07.5Z"`, `k="2021-03-04 05:06:07.5 +0000 UTC"`},
+		{Err(errors.New("bad")), `"bad"`, `err=bad`},
+		{Err(nil), `""`, `err=`},
+		{NamedErr("cause", errors.New("x y")), `"x y"`, `cause="x y"`},
+		{Any("k", []int{1, 2}), `[1,2]`, `k=1,2`},
+		{Any("k", nil), `null`, `k=`},
+		{Object("k", struct {
+			A int
+			B string `json:"b"`
+		}{1, "x"}), `{"A":1,"b":"x"}`, `k.A=1 k.b=x`},
+	} {
+		fields := map[string]interface{}{c.field.Key: c.field.Value()}
+		line, err := (&JSONEncoder{}).Encode(nil, fields)
+		if err != nil {
+			t.Fatalf("%+v: %v", c.field, err)
+		}
+		if want := `{"` + c.field.Key + `":` + c.json + "}\n"; string(line) != want {
+			t.Errorf("%+v: got %s, want %s", c.field, line, want)
+		}
+		line, err = (&LogfmtEncoder{}).Encode(nil, fields)
+		if err != nil {
+			t.Fatalf("%+v: %v", c.field, err)
+		}
+		if string(line) != c.logfmt+"\n" {
+			t.Errorf("%+v: got %s, want %s", c.field, line, c.logfmt)
+		}
+	}
+}
+
+// The builder chain: the fields are there for the one line, the filtertags uppercased, and
+// an Event which doesn't pass the Filter is a nil doing nothing
+func TestEvent(t *testing.T) {
+	entry := testEntry()
+	entry.Filter = AnyOf("inProdEnv")
+	entry.Fields["user"] = "original"
+
+	ctx := ContextWithTraceIDs(context.Background(), "0af7651916cd43dd8448eb211c80319c", "b7ad6b7169203331")
+	ev := entry.Event("inProdEnv", "billing")
+	if !ev.Enabled() {
+		t.Fatal("not enabled")
+	}
+	ev.Str("user", "bob").Int("n", 3).Int64("big", 1<<40).Float64("f", 0.25).Bool("ok", true).
+		Dur("d", time.Second).Time("at", time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)).
+		Err(errors.New("oops")).Any("list", []string{"a"}).Object("o", map[string]interface{}{"a": 1}).
+		Fields(NamedErr("cause", errors.New("root"))).Ctx(ctx).Msgf("done %v", 1)
+
+	fields := readLine(t, entry)
+	want := map[string]interface{}{
+		"user": "bob", "n": 3.0, "big": float64(1 << 40), "f": 0.25, "ok": true, "d": 1e9,
+		"at": "2021-01-02T03:04:05Z", "err": "oops", "cause": "root", "msg": "done 1",
+		"trace_id": "0af7651916cd43dd8448eb211c80319c", "span_id": "b7ad6b7169203331",
+	}
+	for k, v := range want {
+		if fields[k] != v {
+			t.Errorf("%v: got %#v, want %#v", k, fields[k], v)
+		}
+	}
+	if got := fields["filtertags"].(map[string]interface{})["logger"].([]interface{}); len(got) != 2 || got[0] != "INPRODENV" || got[1] != "BILLING" {
+		t.Errorf("filtertags %v", got)
+	}
+	if l := fields["list"].([]interface{}); len(l) != 1 || l[0] != "a" {
+		t.Errorf("list %v", l)
+	}
+	if o := fields["o"].(map[string]interface{}); o["a"] != 1.0 {
+		t.Errorf("o %v", o)
+	}
+
+	// the Fields are back as they were
+	if entry.Fields["user"] != "original" || entry.Fields["err"] != "" || entry.Fields["msg"] != "" {
+		t.Fatalf("got %v", entry.Fields)
+	}
+	for _, k := range []string{"n", "o", "cause", "trace_id"} {
+		if _, ok := entry.Fields[k]; ok {
+			t.Fatalf("%v left in %v", k, entry.Fields)
+		}
+	}
+
+	entry.Event("INPRODENV").Send()
+	if fields := readLine(t, entry); fields["msg"] != "" {
+		t.Fatalf("got %v", fields)
+	}
+
+	ev = entry.Event("trace")
+	if ev != nil || ev.Enabled() {
+		t.Fatal("the filtered out Event isn't nil")
+	}
+	ev.Str("a", "b").Int("n", 1).Err(errors.New("x")).Ctx(ctx).Msg("x")
+	ev.Send()
+	if len(entry.LoggerCh) != 0 {
+		t.Fatal("the filtered out Event logged")
+	}
+
+	if c := entry.Copy(); c.Event("TRACE") != nil || c.Event("INPRODENV") == nil {
+		t.Fatal("the Copy lost the Filter")
+	}
+}
+
+// A key given twice has the last value in the line, and the original one after it
+func TestLogFieldsDuplicateKey(t *testing.T) {
+	entry := testEntry()
+	entry.Fields["k"] = "original"
+	entry.LogFields([]string{"info"}, "m", String("k", "a"), String("k", "b"), String("new", "x"))
+	fields := readLine(t, entry)
+	if fields["k"] != "b" || fields["new"] != "x" {
+		t.Fatalf("got %v", fields)
+	}
+	if entry.Fields["k"] != "original" {
+		t.Fatalf("got %v", entry.Fields["k"])
+	}
+	if _, ok := entry.Fields["new"]; ok {
+		t.Fatal("new left in the Fields")
+	}
+}
@@ -0,0 +1,236 @@
+package filtertag
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fastforward is a pre-marshaled JSON line template, see MakeFastforward() and LogFastforward().
+//
+// The whole line is marshaled once, with the timestamp and the slot values replaced
+// by the marker tokens, and then split at these tokens. Every LogFastforward() call
+// then only concatenates the chunks with the current timestamp and the caller-supplied,
+// already JSON-encoded slot values: no fmt.Sprintf(), no json.Marshal(), no map writes.
+//
+// The template is made by the Entry.Encoder, which must be a JSONEncoder for that; with any
+// other one (or when the Fields can't be encoded), the lines are logged the regular way,
+// by the Encoder, as slow as the LogFields().
+type Fastforward struct {
+	Slots []string
+
+	tags []string // for the lanes, see SetLanes
+	msg  string
+
+	// chunks[i] goes before the i-th gap, the last chunk closes the line;
+	// gaps[i] is the index into Slots, or gapTimestamp
+	chunks [][]byte
+	gaps   []int
+	size   int
+
+	// the slots under the Entry.Redactor's KeyPatterns are always written masked
+	masked []bool
+	mask   []byte
+
+	// the snapshot of the Fields, when there's no template (the regular way)
+	fields map[string]interface{}
+	err    error // of a template which can't be logged at all
+}
+
+const gapTimestamp = -1
+
+// TimestampLayout is how the "timestamp" field is rendered
+const TimestampLayout = "2006-01-02 15:04:05.000 MST"
+
+// MakeFastforward builds the template from a snapshot of the entry.Fields, with the
+// given filtertags and constant msg. Later changes to entry.Fields don't affect the
+// template. Each of the slots becomes a top-level key, filled on every LogFastforward().
+func (entry *Entry) MakeFastforward(
+	filtertags []string,
+	msg string,
+	slots ...string,
+) (ff *Fastforward) {
+	tags := make([]string, len(filtertags))
+	for i := range filtertags {
+		tags[i] = strings.ToUpper(filtertags[i])
+	}
+	ff = &Fastforward{Slots: slots, tags: tags, msg: msg, masked: make([]bool, len(slots))}
+	for _, k := range slots {
+		switch k {
+		case "timestamp", "filtertags", "msg":
+			ff.err = fmt.Errorf("filtertag: the %q can't be a Fastforward slot", k)
+			return ff
+		}
+	}
+
+	snapshot := make(map[string]interface{}, len(entry.Fields))
+	for k, v := range entry.Fields {
+		switch k {
+		case "timestamp", "filtertags", "msg":
+		default:
+			snapshot[k] = v
+		}
+	}
+	enc, ok := entry.encoder().(*JSONEncoder)
+	if !ok {
+		ff.fields = snapshot
+		return ff
+	}
+
+	nonce := strconv.FormatInt(time.Now().UnixNano(), 36)
+	token := func(i int) string {
+		return `"\u0000ff` + nonce + `:` + strconv.Itoa(i) + `\u0000"`
+	}
+
+	fields := make(map[string]interface{}, len(snapshot)+len(slots)+3)
+	for k, v := range snapshot {
+		fields[k] = v
+	}
+	fields["filtertags"] = map[string][]string{
+		"logger": tags,
+	}
+	fields["msg"] = msg
+	fields["timestamp"] = json.RawMessage(token(0))
+	for i, k := range slots {
+		fields[k] = json.RawMessage(token(i + 1))
+	}
+
+	if entry.Redactor != nil {
+		fields = entry.Redactor.RedactFields(fields)
+		for i, k := range slots {
+			if entry.Redactor.KeyMatches(k) {
+				ff.masked[i] = true
+			}
+		}
+	}
+
+	line, err := encodeRecovered(enc, nil, fields)
+	if err != nil {
+		// the regular way has the fallback for that, see logLine
+		ff.fields = snapshot
+		return ff
+	}
+
+	for len(line) > 0 {
+		at, gap := -1, 0
+		for i := 0; i <= len(slots); i++ {
+			if j := bytes.Index(line, []byte(token(i))); j >= 0 && (at < 0 || j < at) {
+				at, gap = j, i
+			}
+		}
+		if at < 0 {
+			ff.chunks = append(ff.chunks, line)
+			break
+		}
+		ff.chunks = append(ff.chunks, line[:at])
+		ff.gaps = append(ff.gaps, gap-1)
+		line = line[at+len(token(gap)):]
+	}
+	if len(ff.gaps) != len(slots)+1 {
+		// some of the tokens are gone (the line is over the encoder's MaxBytes, say)
+		ff.chunks, ff.gaps = nil, nil
+		ff.fields = snapshot
+		return ff
+	}
+	for _, c := range ff.chunks {
+		ff.size += len(c)
+	}
+	if entry.Redactor != nil {
+		ff.mask = appendJSONString(nil, entry.Redactor.mask())
+	}
+	return ff
+}
+
+// LogFastforward logs the line of the template ff, with args filling its slots in the
+// order they were given to MakeFastforward(). Each arg must be a valid JSON value,
+// use the FastforwardString() & Co helpers, or a pre-marshaled json. The line passes the
+// Entry.Filter, as any other one. An error (and nothing logged) for the wrong count of the
+// args, or the template which can't be logged.
+func (entry *Entry) LogFastforward(
+	ff *Fastforward,
+	args ...[]byte,
+) error {
+	if ff.err != nil {
+		return ff.err
+	}
+	if len(args) != len(ff.Slots) {
+		return fmt.Errorf("filtertag: LogFastforward() got %v args for the %v slots", len(args), len(ff.Slots))
+	}
+	if !entry.Passes(ff.tags) {
+		return nil
+	}
+	if ff.fields != nil {
+		entry.logFastforwardFields(ff, args)
+		return nil
+	}
+
+	msg := getLoggerMsg()
+	msg.Command = Cmd_WriteLine
+	msg.buffer = getLineBuffer()
+	line := msg.buffer.b[:0]
+	size := ff.size + len(TimestampLayout) + 8 + len(ff.mask)*len(args)
+	for i := range args {
+		size += len(args[i])
+	}
+	if cap(line) < size {
+		line = make([]byte, 0, size)
+	}
+	for i, gap := range ff.gaps {
+		line = append(line, ff.chunks[i]...)
+		if gap == gapTimestamp {
+			line = append(line, '"')
+			line = time.Now().AppendFormat(line, TimestampLayout)
+			line = append(line, '"')
+		} else if ff.masked[gap] {
+			line = append(line, ff.mask...)
+		} else {
+			line = append(line, args[gap]...)
+		}
+	}
+	line = append(line, ff.chunks[len(ff.chunks)-1]...)
+	msg.buffer.b = line
+	msg.RawLine = line
+
+	entry.sendLine(msg, ff.tags, nil)
+	return nil
+}
+
+// The regular way, for the templates without the chunks: the snapshot and the args (decoded
+// from their JSON) go through the LogFields()' machinery, and the Entry.Encoder
+func (entry *Entry) logFastforwardFields(ff *Fastforward, args [][]byte) {
+	fields := make([]Field, 0, len(ff.fields)+len(args))
+	for k, v := range ff.fields {
+		fields = append(fields, Any(k, v))
+	}
+	for i, k := range ff.Slots {
+		var v interface{}
+		if err := json.Unmarshal(args[i], &v); err != nil {
+			v = string(args[i])
+		}
+		fields = append(fields, Any(k, v))
+	}
+	entry.logWith(nil, ff.tags, ff.msg, fields)
+}
+
+func FastforwardString(s string) []byte {
+	return appendJSONString(nil, s)
+}
+
+func FastforwardInt(i int64) []byte {
+	return strconv.AppendInt(nil, i, 10)
+}
+
+func FastforwardFloat(f float64) []byte {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return FastforwardString(strconv.FormatFloat(f, 'g', -1, 64))
+	}
+	return strconv.AppendFloat(nil, f, 'g', -1, 64)
+}
+
+func FastforwardBool(b bool) []byte {
+	return strconv.AppendBool(nil, b)
+}
@@ -0,0 +1,155 @@
+package filtertag
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+)
+
+// An entry with the default Fields, its lines are read from the LoggerCh by the test
+func testEntry() *Entry {
+	return &Entry{
+		Fields: map[string]interface{}{
+			"timestamp":  "",
+			"host":       "testhost",
+			"service":    "/usr/bin/test",
+			"subsystem":  "",
+			"filtertag":  "INFO",
+			"ctxpretext": "",
+			"err":        "",
+			"msg":        "",
+		},
+		LoggerCh: make(chan *LoggerChType, 16),
+		Encoder:  &JSONEncoder{Safe: true},
+	}
+}
+
+func readLine(t *testing.T, entry *Entry) map[string]interface{} {
+	t.Helper()
+	select {
+	case msg := <-entry.LoggerCh:
+		defer msg.release()
+		var fields map[string]interface{}
+		if err := json.Unmarshal(msg.RawLine, &fields); err != nil {
+			t.Fatalf("bad line %q: %v", msg.RawLine, err)
+		}
+		return fields
+	default:
+		t.Fatal("no line logged")
+		return nil
+	}
+}
+
+func TestFastforward(t *testing.T) {
+	entry := testEntry()
+	ff := entry.MakeFastforward([]string{"info"}, "paid", "user", "amount")
+	if err := entry.LogFastforward(ff, FastforwardString("bob \"x\""), FastforwardInt(42)); err != nil {
+		t.Fatal(err)
+	}
+	fields := readLine(t, entry)
+	if fields["user"] != `bob "x"` || fields["amount"] != 42.0 || fields["msg"] != "paid" || fields["host"] != "testhost" {
+		t.Errorf("got %v", fields)
+	}
+	if ts, _ := fields["timestamp"].(string); len(ts) < len("2006-01-02 15:04:05.000") {
+		t.Errorf("got the timestamp %q", fields["timestamp"])
+	}
+	if ft, _ := fields["filtertags"].(map[string]interface{}); ft == nil || ft["logger"].([]interface{})[0] != "INFO" {
+		t.Errorf("got the filtertags %v", fields["filtertags"])
+	}
+}
+
+func TestFastforwardFilter(t *testing.T) {
+	entry := testEntry()
+	entry.Filter = AnyOf("ERROR")
+	ff := entry.MakeFastforward([]string{"info"}, "paid", "user")
+	if err := entry.LogFastforward(ff, FastforwardString("bob")); err != nil {
+		t.Fatal(err)
+	}
+	if len(entry.LoggerCh) != 0 {
+		t.Error("the line didn't pass the Filter, but was logged")
+	}
+}
+
+func TestFastforwardArgs(t *testing.T) {
+	entry := testEntry()
+	ff := entry.MakeFastforward([]string{"info"}, "paid", "user", "amount")
+	if err := entry.LogFastforward(ff, FastforwardString("bob")); err == nil {
+		t.Error("no error for the missing arg")
+	}
+	ff = entry.MakeFastforward([]string{"info"}, "paid", "timestamp")
+	if err := entry.LogFastforward(ff, FastforwardInt(1)); err == nil {
+		t.Error("no error for the timestamp slot")
+	}
+	if len(entry.LoggerCh) != 0 {
+		t.Error("logged a line for the bad call")
+	}
+}
+
+// The encoder other than the JSONEncoder encodes the lines, the regular way
+func TestFastforwardEncoder(t *testing.T) {
+	entry := testEntry()
+	entry.Encoder = &LogfmtEncoder{}
+	ff := entry.MakeFastforward([]string{"info"}, "paid", "user", "amount")
+	if err := entry.LogFastforward(ff, FastforwardString("bob"), FastforwardInt(42)); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-entry.LoggerCh
+	line := string(msg.RawLine)
+	for _, want := range []string{"user=bob", "amount=42", "msg=paid", "host=testhost"} {
+		if !strings.Contains(line, want) {
+			t.Errorf("no %q in %q", want, line)
+		}
+	}
+	if entry.Fields["user"] != nil || entry.Fields["msg"] != "" {
+		t.Errorf("the Fields were left changed: %v", entry.Fields)
+	}
+}
+
+// The Fields which the encoder rejects don't panic, the line goes with the marshalerrors
+func TestFastforwardMarshalError(t *testing.T) {
+	entry := testEntry()
+	entry.Encoder = &JSONEncoder{}
+	entry.Fields["ratio"] = math.NaN()
+	ff := entry.MakeFastforward([]string{"info"}, "paid", "user")
+	if err := entry.LogFastforward(ff, FastforwardString("bob")); err != nil {
+		t.Fatal(err)
+	}
+	fields := readLine(t, entry)
+	if fields["marshalerrors"] == nil || fields["msg"] != "paid" {
+		t.Errorf("got %v", fields)
+	}
+}
+
+// Compare with BenchmarkLogft, on the same default Fields
+func BenchmarkLogFastforward(b *testing.B) {
+	entry := testEntry()
+	go func() {
+		for msg := range entry.LoggerCh {
+			msg.release()
+		}
+	}()
+	defer close(entry.LoggerCh)
+	ff := entry.MakeFastforward([]string{"info"}, "paid", "user", "amount")
+	user := FastforwardString("bob")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		entry.LogFastforward(ff, user, FastforwardInt(int64(i)))
+	}
+}
+
+func BenchmarkLogft(b *testing.B) {
+	entry := testEntry()
+	go func() {
+		for msg := range entry.LoggerCh {
+			msg.release()
+		}
+	}()
+	defer close(entry.LoggerCh)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		entry.Logft([]string{"info"}, "paid user=%v amount=%v", "bob", i)
+	}
+}
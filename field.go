@@ -0,0 +1,105 @@
+package filtertag
+
+import (
+	"time"
+)
+
+// Field is a typed key/value, for the LogFields() and the Event builder.
+// Use the constructors (String(), Int(), Dur(), Err(), Any(), Object() etc.)
+// rather than filling it by hand.
+type Field struct {
+	Key       string
+	Type      FieldType
+	Integer   int64
+	Float     float64
+	Str       string
+	Interface interface{}
+}
+
+type FieldType int
+
+const (
+	FieldType_Any FieldType = iota
+	FieldType_String
+	FieldType_Int
+	FieldType_Float
+	FieldType_Bool
+	FieldType_Duration
+	FieldType_Time
+	FieldType_Error
+	FieldType_Object
+)
+
+func String(key string, val string) Field {
+	return Field{Key: key, Type: FieldType_String, Str: val}
+}
+
+func Int(key string, val int) Field {
+	return Field{Key: key, Type: FieldType_Int, Integer: int64(val)}
+}
+
+func Int64(key string, val int64) Field {
+	return Field{Key: key, Type: FieldType_Int, Integer: val}
+}
+
+func Float64(key string, val float64) Field {
+	return Field{Key: key, Type: FieldType_Float, Float: val}
+}
+
+func Bool(key string, val bool) Field {
+	f := Field{Key: key, Type: FieldType_Bool}
+	if val {
+		f.Integer = 1
+	}
+	return f
+}
+
+func Dur(key string, val time.Duration) Field {
+	return Field{Key: key, Type: FieldType_Duration, Integer: int64(val)}
+}
+
+func Time(key string, val time.Time) Field {
+	return Field{Key: key, Type: FieldType_Time, Interface: val}
+}
+
+// Err goes into the standard "err" key; a nil error is logged as "".
+func Err(err error) Field {
+	return Field{Key: "err", Type: FieldType_Error, Interface: err}
+}
+
+func NamedErr(key string, err error) Field {
+	return Field{Key: key, Type: FieldType_Error, Interface: err}
+}
+
+// Any takes whatever value, and leaves it to the encoder.
+func Any(key string, val interface{}) Field {
+	return Field{Key: key, Type: FieldType_Any, Interface: val}
+}
+
+// Object is for the structs and maps, which are nested into the line as objects
+// (JSON) or as dotted keys (logfmt).
+func Object(key string, val interface{}) Field {
+	return Field{Key: key, Type: FieldType_Object, Interface: val}
+}
+
+// Value returns the field's value as it goes into the Entry.Fields
+func (f Field) Value() interface{} {
+	switch f.Type {
+	case FieldType_String:
+		return f.Str
+	case FieldType_Int:
+		return f.Integer
+	case FieldType_Float:
+		return f.Float
+	case FieldType_Bool:
+		return f.Integer != 0
+	case FieldType_Duration:
+		return time.Duration(f.Integer)
+	case FieldType_Error:
+		if f.Interface == nil {
+			return ""
+		}
+		return f.Interface.(error)
+	}
+	return f.Interface
+}
@@ -0,0 +1,435 @@
+package filtertag
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+type FileSinkConfig struct {
+	Path     string      // of the current file; the rotated ones go next to it
+	FileMode os.FileMode // 0644 if zero
+
+	MaxSize     int64         // rotates when the file would grow over it; 0 for no limit
+	RotateEvery time.Duration // rotates at the multiples of it (in UTC, so 24h is at the UTC midnight); 0 for never
+	Compress    bool          // gzips the rotated files (in the background)
+
+	// The retention of the rotated files, the oldest ones are removed first; zeros for no limit
+	MaxFiles      int
+	MaxAge        time.Duration
+	MaxTotalBytes int64 // of the rotated files
+
+	// Reopens the file on SIGHUP, for the external logrotate (with its "create", not the
+	// "copytruncate"); note that then the SIGHUP no longer terminates the process.
+	ReopenOnSIGHUP bool
+}
+
+// FileSink writes the lines to a file, rotating it by the size or the time. The rotated files
+// are named <name>-<UTC time of the rotation><ext>, like "app-20210304T235900.123.log", so they
+// sort chronologically; and ".gz" is added when they're compressed.
+//
+// Unlike the network sinks it writes in the logger goroutine, the file is synced and renamed
+// there on the rotation too; the compression and the retention run in its own goroutine.
+type FileSink struct {
+	sinkCounters // first, for the 64-bit alignment of the atomics
+
+	Config FileSinkConfig
+
+	mu         sync.Mutex
+	file       *os.File
+	size       int64
+	nextRotate time.Time
+	closed     bool
+	chunk      []byte // of the WriteLines
+
+	reopen    int32 // atomic, set by the SIGHUP
+	rotated   chan string
+	closing   chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+const fileSinkTimeLayout = "20060102T150405.000"
+
+func MakeFileSink(ctx context.Context, config FileSinkConfig) (*FileSink, error) {
+	if config.FileMode == 0 {
+		config.FileMode = 0644
+	}
+	sink := &FileSink{
+		Config:  config,
+		rotated: make(chan string, 64),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if err := os.MkdirAll(filepath.Dir(config.Path), 0755); err != nil {
+		return nil, err
+	}
+	if err := sink.open(time.Now()); err != nil {
+		return nil, err
+	}
+
+	var hup chan os.Signal
+	if config.ReopenOnSIGHUP {
+		hup = make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+	}
+	go sink.run(ctx, hup)
+	return sink, nil
+}
+
+// Must be called with the mu held (or before the sink is shared)
+func (sink *FileSink) open(now time.Time) error {
+	f, err := os.OpenFile(sink.Config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, sink.Config.FileMode)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	sink.file = f
+	sink.size = info.Size()
+	if sink.Config.RotateEvery > 0 {
+		sink.nextRotate = now.Truncate(sink.Config.RotateEvery).Add(sink.Config.RotateEvery)
+	}
+	return nil
+}
+
+func (sink *FileSink) Write(p []byte) (int, error) {
+	atomic.AddUint64(&sink.lines, 1)
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.closed {
+		atomic.AddUint64(&sink.lost, 1)
+		return 0, ErrSinkClosed
+	}
+	return sink.write(p, 1, time.Now())
+}
+
+// The lines go in as few writes as the rotation allows
+func (sink *FileSink) WriteLines(lines [][]byte) error {
+	atomic.AddUint64(&sink.lines, uint64(len(lines)))
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.closed {
+		atomic.AddUint64(&sink.lost, uint64(len(lines)))
+		return ErrSinkClosed
+	}
+
+	now := time.Now()
+	var firstErr error
+	chunk, count := sink.chunk[:0], 0
+	for i, line := range lines {
+		chunk = append(chunk, line...)
+		count++
+		last := i == len(lines)-1
+		if !last && (sink.Config.MaxSize <= 0 || sink.size+int64(len(chunk)+len(lines[i+1])) <= sink.Config.MaxSize) {
+			continue
+		}
+		if _, err := sink.write(chunk, count, now); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		chunk, count = chunk[:0], 0
+	}
+	sink.chunk = chunk
+	return firstErr
+}
+
+// Writes the count lines in the p, rotating or reopening the file before it if needed
+func (sink *FileSink) write(p []byte, count int, now time.Time) (int, error) {
+	if atomic.CompareAndSwapInt32(&sink.reopen, 1, 0) && sink.file != nil {
+		sink.file.Close()
+		sink.file = nil
+	}
+	if sink.file != nil && sink.rotateDue(now, len(p)) {
+		if err := sink.rotate(now); err != nil {
+			atomic.AddUint64(&sink.errors, 1)
+		}
+	}
+	if sink.file == nil {
+		if err := sink.open(now); err != nil {
+			atomic.AddUint64(&sink.errors, 1)
+			atomic.AddUint64(&sink.lost, uint64(count))
+			return 0, err
+		}
+	}
+
+	n, err := sink.file.Write(p)
+	sink.size += int64(n)
+	if err != nil {
+		atomic.AddUint64(&sink.errors, 1)
+		atomic.AddUint64(&sink.lost, uint64(count))
+		return n, err
+	}
+	atomic.AddUint64(&sink.written, uint64(count))
+	return n, nil
+}
+
+func (sink *FileSink) rotateDue(now time.Time, n int) bool {
+	if sink.Config.MaxSize > 0 && sink.size > 0 && sink.size+int64(n) > sink.Config.MaxSize {
+		return true
+	}
+	if sink.nextRotate.IsZero() || now.Before(sink.nextRotate) {
+		return false
+	}
+	if sink.size == 0 {
+		// nothing to rotate, this one's just the file of the next period
+		sink.nextRotate = now.Truncate(sink.Config.RotateEvery).Add(sink.Config.RotateEvery)
+		return false
+	}
+	return true
+}
+
+// Syncs and closes the current file and renames it; the next one is opened by the Write
+func (sink *FileSink) rotate(now time.Time) error {
+	f := sink.file
+	sink.file = nil
+	f.Sync()
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	dir, name, ext := sink.nameParts()
+	stamp := now.UTC().Format(fileSinkTimeLayout)
+	target := filepath.Join(dir, name+"-"+stamp+ext)
+	for i := 1; fileExists(target) || fileExists(target+".gz"); i++ {
+		target = filepath.Join(dir, name+"-"+stamp+"-"+strconv.Itoa(i)+ext)
+	}
+	if err := os.Rename(sink.Config.Path, target); err != nil {
+		return err
+	}
+	select {
+	case sink.rotated <- target:
+	default:
+		// the cleanup is behind, it'll catch up with the next one
+	}
+	return nil
+}
+
+func (sink *FileSink) nameParts() (dir string, name string, ext string) {
+	dir, name = filepath.Split(sink.Config.Path)
+	ext = filepath.Ext(name)
+	return dir, strings.TrimSuffix(name, ext), ext
+}
+
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// Reopen closes the file and opens it again, by its Path, at the next Write (which is what
+// the SIGHUP does when ReopenOnSIGHUP)
+func (sink *FileSink) Reopen() {
+	atomic.StoreInt32(&sink.reopen, 1)
+}
+
+// Rotate rotates the file right now
+func (sink *FileSink) Rotate() error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.closed || sink.file == nil {
+		return nil
+	}
+	return sink.rotate(time.Now())
+}
+
+// Sync flushes the file to the disk
+func (sink *FileSink) Sync() error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if sink.file == nil {
+		return nil
+	}
+	return sink.file.Sync()
+}
+
+// Close syncs and closes the file, and waits for the compression of the rotated ones
+func (sink *FileSink) Close() error {
+	var err error
+	sink.closeOnce.Do(func() {
+		sink.mu.Lock()
+		sink.closed = true
+		if sink.file != nil {
+			sink.file.Sync()
+			err = sink.file.Close()
+			sink.file = nil
+		}
+		sink.mu.Unlock()
+		close(sink.closing)
+	})
+	<-sink.done
+	return err
+}
+
+func (sink *FileSink) run(ctx context.Context, hup chan os.Signal) {
+	defer close(sink.done)
+	if hup != nil {
+		defer signal.Stop(hup)
+	}
+
+	// the leftovers of the last run, like the files not compressed before a crash
+	sink.cleanup()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sink.closing:
+			for {
+				select {
+				case <-sink.rotated:
+				default:
+					sink.cleanup()
+					return
+				}
+			}
+		case <-hup:
+			sink.Reopen()
+		case <-sink.rotated:
+			sink.cleanup()
+		}
+	}
+}
+
+type rotatedFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+	stamp   time.Time // of the name
+	seq     int       // the -N of the name, 0 if none
+}
+
+// Compresses the rotated files (if so configured), and removes the ones over the retention
+func (sink *FileSink) cleanup() {
+	dir, name, ext := sink.nameParts()
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	var files []rotatedFile
+	for _, e := range entries {
+		fname := e.Name()
+		if strings.HasPrefix(fname, name+"-") && strings.HasSuffix(fname, ".gz.tmp") {
+			// of a compression cut short
+			os.Remove(filepath.Join(dir, fname))
+			continue
+		}
+		if e.IsDir() || !strings.HasPrefix(fname, name+"-") {
+			continue
+		}
+		stem := strings.TrimSuffix(fname, ".gz")
+		if !strings.HasSuffix(stem, ext) || len(stem) < len(name)+1+len(ext) {
+			continue
+		}
+		stamp, seq, ok := parseFileSinkStamp(stem[len(name)+1 : len(stem)-len(ext)])
+		if !ok {
+			continue
+		}
+		path := filepath.Join(dir, fname)
+		if sink.Config.Compress && stem == fname {
+			if gz, err := gzipFile(path); err == nil {
+				path = gz
+			}
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		files = append(files, rotatedFile{path: path, size: info.Size(), modTime: info.ModTime(), stamp: stamp, seq: seq})
+	}
+
+	// the newest first: by the stamp, then by the -N (the "app-<stamp>.log" is the first one of
+	// the stamp, and "-10" comes after "-9"), which the plain names don't sort by
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].stamp.Equal(files[j].stamp) {
+			return files[i].stamp.After(files[j].stamp)
+		}
+		return files[i].seq > files[j].seq
+	})
+	var total int64
+	for i, f := range files {
+		total += f.size
+		if sink.Config.MaxFiles > 0 && i >= sink.Config.MaxFiles ||
+			sink.Config.MaxAge > 0 && time.Since(f.modTime) > sink.Config.MaxAge ||
+			sink.Config.MaxTotalBytes > 0 && total > sink.Config.MaxTotalBytes {
+			os.Remove(f.path)
+		}
+	}
+}
+
+// 20060102T150405.000, maybe with a -N
+func parseFileSinkStamp(s string) (stamp time.Time, seq int, ok bool) {
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		n, err := strconv.Atoi(s[i+1:])
+		if err != nil || n < 1 {
+			return time.Time{}, 0, false
+		}
+		s, seq = s[:i], n
+	}
+	stamp, err := time.Parse(fileSinkTimeLayout, s)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	return stamp, seq, true
+}
+
+// Writes the path.gz (synced, via a temp file, so a crash never leaves a broken one), and
+// removes the path
+func gzipFile(path string) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	tmp := path + ".gz.tmp"
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return "", err
+	}
+	zw := gzip.NewWriter(dst)
+	zw.Name = filepath.Base(path)
+	zw.ModTime = info.ModTime()
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	gz := path + ".gz"
+	if err := os.Rename(tmp, gz); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	// keeps the time of the original for the MaxAge
+	os.Chtimes(gz, info.ModTime(), info.ModTime())
+	os.Remove(path)
+	return gz, nil
+}
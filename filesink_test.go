@@ -0,0 +1,220 @@
+package filtertag
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func readDirNames(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func readGzip(t *testing.T, path string) string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// Makes the rotated files of the same stamp, the "app-<stamp>.log" and then the -1 to -n
+// ones, each one a second newer than the one before
+func makeRotatedFiles(t *testing.T, dir string, n int, size int) {
+	t.Helper()
+	names := []string{"app-20200101T000000.000.log"}
+	for i := 1; i <= n; i++ {
+		names = append(names, fmt.Sprintf("app-20200101T000000.000-%d.log", i))
+	}
+	for i, name := range names {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := time.Now().Add(time.Duration(i-len(names)) * time.Second)
+		os.Chtimes(path, mtime, mtime)
+	}
+}
+
+// Rotated by the size, many times within the same millisecond, gzipped; the MaxFiles keeps
+// the newest ones
+func TestFileSinkRotateSize(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "sub")
+	path := filepath.Join(dir, "app.log")
+	sink, err := MakeFileSink(context.Background(), FileSinkConfig{Path: path, MaxSize: 100, Compress: true, MaxFiles: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := func(i int) string { return fmt.Sprintf("%039d\n", i) }
+	for i := 0; i < 20; i++ {
+		if _, err := sink.Write([]byte(line(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	names := readDirNames(t, dir)
+	if len(names) != 4 || names[3] != "app.log" {
+		t.Fatalf("got %v", names)
+	}
+	var got []string
+	for _, name := range names[:3] {
+		if !strings.HasSuffix(name, ".log.gz") {
+			t.Fatalf("not compressed: %v", names)
+		}
+		got = append(got, readGzip(t, filepath.Join(dir, name)))
+	}
+	sort.Strings(got)
+	for i, s := range got {
+		if want := line(12+2*i) + line(13+2*i); s != want {
+			t.Fatalf("file %d: got %q, want %q", i, s, want)
+		}
+	}
+	if b, _ := os.ReadFile(path); string(b) != line(18)+line(19) {
+		t.Fatalf("got %q", b)
+	}
+	if st := sink.Stats(); st.Written != 20 || st.Lost != 0 || st.Errors != 0 {
+		t.Fatalf("got %+v", st)
+	}
+	if _, err := sink.Write([]byte("x\n")); err != ErrSinkClosed {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestFileSinkRotateTime(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	sink, err := MakeFileSink(context.Background(), FileSinkConfig{Path: path, RotateEvery: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	sink.Write([]byte("a\n"))
+	time.Sleep(60 * time.Millisecond)
+	sink.Write([]byte("b\n"))
+
+	rotated, _ := filepath.Glob(filepath.Join(dir, "app-*.log"))
+	if len(rotated) != 1 {
+		t.Fatalf("got %v", rotated)
+	}
+	if b, _ := os.ReadFile(rotated[0]); string(b) != "a\n" {
+		t.Fatalf("got %q", b)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "b\n" {
+		t.Fatalf("got %q", b)
+	}
+}
+
+// The -N files of a stamp are newer than the one without it, the -10 newer than the -9
+func TestFileSinkMaxFilesOrder(t *testing.T) {
+	dir := t.TempDir()
+	makeRotatedFiles(t, dir, 10, 1)
+	sink, err := MakeFileSink(context.Background(), FileSinkConfig{Path: filepath.Join(dir, "app.log"), MaxFiles: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Close()
+	names := readDirNames(t, dir)
+	want := []string{"app-20200101T000000.000-10.log", "app-20200101T000000.000-8.log", "app-20200101T000000.000-9.log", "app.log"}
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Fatalf("got %v", names)
+	}
+}
+
+func TestFileSinkMaxTotalBytes(t *testing.T) {
+	dir := t.TempDir()
+	makeRotatedFiles(t, dir, 4, 10)
+	sink, err := MakeFileSink(context.Background(), FileSinkConfig{Path: filepath.Join(dir, "app.log"), MaxTotalBytes: 25})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Close()
+	names := readDirNames(t, dir)
+	want := []string{"app-20200101T000000.000-3.log", "app-20200101T000000.000-4.log", "app.log"}
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Fatalf("got %v", names)
+	}
+}
+
+// The files over the MaxAge and the leftovers of a compression cut short are removed, the
+// files of other names are left alone
+func TestFileSinkMaxAge(t *testing.T) {
+	dir := t.TempDir()
+	old := filepath.Join(dir, "app-20200101T000000.000.log")
+	os.WriteFile(old, []byte("x"), 0644)
+	os.Chtimes(old, time.Now().Add(-48*time.Hour), time.Now().Add(-48*time.Hour))
+	fresh := filepath.Join(dir, "app-20200102T000000.000.log")
+	os.WriteFile(fresh, []byte("x"), 0644)
+	os.WriteFile(filepath.Join(dir, "app-20200102T000000.000.log.gz.tmp"), []byte("x"), 0644)
+	os.WriteFile(filepath.Join(dir, "app-x.log"), []byte("x"), 0644)
+	os.WriteFile(filepath.Join(dir, "other-20200101T000000.000.log"), []byte("x"), 0644)
+
+	sink, err := MakeFileSink(context.Background(), FileSinkConfig{Path: filepath.Join(dir, "app.log"), MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Close()
+	names := readDirNames(t, dir)
+	want := []string{"app-20200102T000000.000.log", "app-x.log", "app.log", "other-20200101T000000.000.log"}
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Fatalf("got %v", names)
+	}
+}
+
+// The logrotate renames the file and sends the SIGHUP, the lines after it go to a new file
+func TestFileSinkReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	sink, err := MakeFileSink(context.Background(), FileSinkConfig{Path: path, ReopenOnSIGHUP: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	sink.Write([]byte("a\n"))
+	os.Rename(path, path+".1")
+	sink.Reopen()
+	sink.Write([]byte("b\n"))
+
+	os.Rename(path, path+".2")
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	waitFor(t, "the SIGHUP", func() bool { return atomic.LoadInt32(&sink.reopen) == 1 })
+	sink.Write([]byte("c\n"))
+
+	for name, want := range map[string]string{".1": "a\n", ".2": "b\n", "": "c\n"} {
+		if b, _ := os.ReadFile(path + name); string(b) != want {
+			t.Fatalf("app.log%s: got %q, want %q", name, b, want)
+		}
+	}
+}
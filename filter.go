@@ -0,0 +1,38 @@
+package filtertag
+
+import (
+	"strings"
+)
+
+// FilterFunc decides on the user side, before anything is formatted or encoded, whether
+// a line with these (uppercase) filtertags gets logged at all. The nil Entry.Filter
+// lets everything through.
+type FilterFunc func(filtertags []string) bool
+
+func (entry *Entry) Passes(filtertags []string) bool {
+	return entry.Filter == nil || entry.Filter(filtertags)
+}
+
+// Route is the user-side equivalent of the rule action "ROUTE <to>": the lines which pass
+// the Filter go to the To (a topic, a tag; up to the sink, see NSQSinkConfig.Routes).
+type Route struct {
+	Filter FilterFunc
+	To     string
+}
+
+// AnyOf is the user-side equivalent of the rule "anyof . {...}": the line passes if it
+// has at least one of the filtertags.
+func AnyOf(filtertags ...string) FilterFunc {
+	set := make(map[string]bool, len(filtertags))
+	for _, ft := range filtertags {
+		set[strings.ToUpper(ft)] = true
+	}
+	return func(filtertags []string) bool {
+		for _, ft := range filtertags {
+			if set[ft] {
+				return true
+			}
+		}
+		return false
+	}
+}
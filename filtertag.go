@@ -1,12 +1,15 @@
 package filtertag
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	deepCopy "github.com/mitchellh/copystructure"
@@ -17,15 +20,37 @@ type Logger struct {
 	FiltertagsProRule string
 	ExitFunc          func(int)
 	OverflowFunc      func()
+	// Called when the Output.Write fails, the line is lost then; see the ChainSink for
+	// the fallbacks
+	ErrorFunc func(error)
+
+	// The overflow policy of the LoggerCh: when it's half full, the lines go to the disk
+	// instead of the Output, and are written out from there in between the new ones (which
+	// go to the disk too, while there's anything there, to keep the order); so a slow Output
+	// makes the lines late, and the OverflowFunc is never called. See SpillQueue.
+	Spill *SpillQueue
+
+	// Called with the count of the TryLogft and LogftCtx calls dropped since the last call,
+	// once a second while there are any (the lines of these are just dropped, the
+	// OverflowFunc isn't called for them); see the Entry.DroppedCalls
+	DroppedFunc func(n uint64)
 }
 
 type Entry struct {
 	Fields   map[string]interface{}
 	LoggerCh chan *LoggerChType
 	ChDown   chan *LoggerChType
+	Encoder  Encoder
+	Filter   FilterFunc
+	Redactor *Redactor
 
 	prevEntryFiltertag string
 	rawLine            []byte
+	lanes              *lanes // see SetLanes
+	pipeline           *Pipeline
+	shard              int     // of the pipeline
+	droppedCalls       *uint64 // atomic, shared by the copies
+	blockedCalls       *uint32 // atomic, shared by the copies; see sendMsg
 }
 
 type LoggerChType struct {
@@ -34,6 +59,35 @@ type LoggerChType struct {
 	RawLine        []byte
 	RuleASTPointer *filtertagpro.RuleAST
 	ChDown         chan *LoggerChType
+
+	lanes *lanes // for the Cmd_SetLanes
+
+	// set when the RawLine is in a pooled buffer, see release()
+	buffer *lineBuffer
+	pooled bool
+}
+
+var loggerMsgPool = sync.Pool{
+	New: func() interface{} {
+		return &LoggerChType{pooled: true}
+	},
+}
+
+func getLoggerMsg() *LoggerChType {
+	return loggerMsgPool.Get().(*LoggerChType)
+}
+
+// Returns the line buffer, and the msg itself (if it came from the pool), for reuse;
+// the msg must not be touched after that.
+func (msg *LoggerChType) release() {
+	if msg.buffer != nil {
+		putLineBuffer(msg.buffer)
+		msg.buffer = nil
+	}
+	if msg.pooled {
+		*msg = LoggerChType{pooled: true}
+		loggerMsgPool.Put(msg)
+	}
 }
 
 const (
@@ -42,6 +96,7 @@ const (
 	Cmd_SetLogger
 	Cmd_ExitFunc
 	Cmd_GetRuleASTPointer
+	Cmd_SetLanes
 )
 
 func MakePrimordialEntryWithLogger(ctx context.Context) (entry *Entry) {
@@ -71,6 +126,22 @@ func MakePrimordialEntryWithLogger(ctx context.Context) (entry *Entry) {
 		logger.ExitFunc(1)
 	}
 
+	// at most a message a second, a broken Output usually fails every line
+	var lastOutputError time.Time
+	logger.ErrorFunc = func(err error) {
+		if time.Since(lastOutputError) < time.Second {
+			return
+		}
+		lastOutputError = time.Now()
+		os.Stderr.WriteString(fmt.Sprintf("ERROR AT FILTERTAG: output write failed, the line is lost: %v\n", err))
+	}
+
+	logger.DroppedFunc = func(n uint64) {
+		os.Stderr.WriteString(fmt.Sprintf("WARNING AT FILTERTAG: %v TryLogft/LogftCtx calls dropped, the channel was full\n", n))
+	}
+	droppedCalls := new(uint64)
+	blockedCalls := new(uint32)
+
 	ch_i1 := make(chan *LoggerChType, 500+2)
 	host, err := os.Hostname()
 	if err != nil {
@@ -93,76 +164,185 @@ func MakePrimordialEntryWithLogger(ctx context.Context) (entry *Entry) {
 			"msg":        "",
 		},
 		LoggerCh: ch_i1,
+		Encoder:  &JSONEncoder{Safe: true},
+
+		droppedCalls: droppedCalls,
+		blockedCalls: blockedCalls,
 	}
 
 	go func() {
 		var msg *LoggerChType
+		var highLane, normalLane, lowLane *lane // see SetLanes
+		var droppedReported uint64
+		dropTicker := time.NewTicker(time.Second)
+		defer dropTicker.Stop()
+		alerted := false // of the LoggerCh filling up
+		var spillRetry *time.Timer // after a failed write of a spilled line
+		spillAttempt := 0
+		writeSpilledLine := func() {
+			if err := writeSpilled(logger); err != nil {
+				// the line stays in the Spill, the new ones go after it
+				spillRetry = time.NewTimer(DefaultBackoff.Delay(spillAttempt))
+				spillAttempt++
+				return
+			}
+			spillAttempt = 0
+		}
 		for {
-			select {
-			case msg = <-ch_i1:
-				if len(ch_i1) >= 500 {
-					logger.OverflowFunc()
-				}
-				if len(ch_i1) >= 500/2 {
-					entry.Alert([]string{"LOGGER"}, "Logger input channel reached dangerous levels - risk of overflow and crash")
+			var spilled <-chan struct{}
+			var spillWait <-chan time.Time
+			if logger.Spill != nil && logger.Spill.Len() > 0 {
+				if spillRetry == nil {
+					spilled = closedChan
+				} else {
+					spillWait = spillRetry.C
 				}
-				switch msg.Command {
-				case Cmd_WriteLine:
-					_, err = logger.Output.Write(msg.RawLine)
-					if err != nil {
-						panic(fmt.Errorf("!!! filtertag.go:109 / *** at \"_, err = logger.Output.Write( msg.CookedLogLine.RawLine )\": %v", err))
-					}
-				case Cmd_GetLogger:
-					// we can't return the original, because a user may start touching it, and it'll race-condition-crash the program
+			}
 
-					logger2, err := deepCopy.Copy(logger)
-					if err != nil {
+			// the High lane first, then the LoggerCh and the Normal lane (and the Spill), and
+			// the Low lane only when there's nothing else; no lanes, no nil channels picked
+			var from *lane
+			select {
+			case msg = <-highLane.channel():
+				from = highLane
+			default:
+				select {
+				case msg = <-ch_i1:
+				case msg = <-normalLane.channel():
+					from = normalLane
+				case <-spilled:
+					writeSpilledLine()
+					continue
+				case <-spillWait:
+					spillRetry = nil
+					continue
+				case <-dropTicker.C:
+					droppedReported = reportDropped(logger, droppedCalls, droppedReported)
+					continue
+				case <-ctx.Done():
+					return
+				default:
+					select {
+					case msg = <-highLane.channel():
+						from = highLane
+					case msg = <-ch_i1:
+					case msg = <-normalLane.channel():
+						from = normalLane
+					case msg = <-lowLane.channel():
+						from = lowLane
+					case <-spilled:
+						writeSpilledLine()
 						continue
+					case <-spillWait:
+						spillRetry = nil
+						continue
+					case <-dropTicker.C:
+						droppedReported = reportDropped(logger, droppedCalls, droppedReported)
+						continue
+					case <-ctx.Done():
+						return
 					}
+				}
+			}
 
-					func() {
-						defer func() {
-							if errrec := recover(); errrec != nil {
-								err = fmt.Errorf("try{} panicked at \"msg.Logger = logger2.(*Logger)\": %v", errrec)
-							}
-						}()
-						err = nil
-						msg.Logger = logger2.(*Logger)
-					}()
-					if err != nil {
+			queued, size, blocked := len(ch_i1), 500, blockedCalls
+			if from != nil {
+				queued, size, blocked = len(from.ch), from.size, &from.blocked
+			}
+			// a full channel is the overflow only if it held a caller (see sendMsg), the
+			// TryLogft ones are just dropped; with the Spill, it holds them for a moment only,
+			// and the lanes which drop the lines don't hold anybody
+			wasBlocked := atomic.LoadUint32(blocked) != 0 && atomic.SwapUint32(blocked, 0) != 0
+			if wasBlocked && queued >= size && logger.Spill == nil && (from == nil || from.overflow == LaneOverflow_Block) {
+				logger.OverflowFunc()
+			}
+			// right to the Output, a logging call here would wait for this very goroutine
+			if from == nil && !alerted && len(ch_i1) >= 500/2 && logger.Spill == nil {
+				alerted = true
+				line, err := appendDiagnosticLine(defaultEncoder, nil, host, executable, []string{"LOGGER", "ALERT", "L6"},
+					"Logger input channel reached dangerous levels - risk of overflow and crash", nil)
+				if err == nil {
+					writeOutput(logger, line)
+				}
+			} else if alerted && len(ch_i1) < 500/4 {
+				alerted = false
+			}
+			switch msg.Command {
+			case Cmd_WriteLine:
+				// the High lane's lines are never late
+				if logger.Spill != nil && (from == nil || from != highLane) && (queued >= size/2 || logger.Spill.Len() > 0) {
+					// if the spill fails, the line is written right away, late or not
+					if _, err = logger.Spill.append(msg.RawLine); err == nil {
+						msg.release()
 						continue
 					}
+				}
+				writeOutput(logger, msg.RawLine)
+				msg.release()
+			case Cmd_GetLogger:
+				// we can't return the original, because a user may start touching it, and it'll race-condition-crash the program
+
+				logger2, err := deepCopy.Copy(logger)
+				if err != nil {
+					continue
+				}
 
-					msg.Logger.Output = logger.Output
+				func() {
+					defer func() {
+						if errrec := recover(); errrec != nil {
+							err = fmt.Errorf("try{} panicked at \"msg.Logger = logger2.(*Logger)\": %v", errrec)
+						}
+					}()
+					err = nil
+					msg.Logger = logger2.(*Logger)
+				}()
+				if err != nil {
+					continue
+				}
 
-					select {
-					case msg.ChDown <- msg:
-					default:
-					}
-				case Cmd_SetLogger:
-					// we can't set the original, because a user may start touching it, and it'll race-condition-crash the program
+				msg.Logger.Output = logger.Output
+				msg.Logger.Spill = logger.Spill
 
-					logger2, _ := deepCopy.Copy(msg.Logger)
-					if err != nil {
-						continue
-					}
+				select {
+				case msg.ChDown <- msg:
+				default:
+				}
+			case Cmd_SetLogger:
+				// we can't set the original, because a user may start touching it, and it'll race-condition-crash the program
 
-					func() {
-						defer func() {
-							if errrec := recover(); errrec != nil {
-								err = fmt.Errorf("try{} panicked at \"logger = logger2.(*Logger)\": %v", errrec)
-							}
-						}()
-						err = nil
-						logger = logger2.(*Logger)
-					}()
+				logger2, _ := deepCopy.Copy(msg.Logger)
+				if err != nil {
+					continue
+				}
 
-					logger.Output = msg.Logger.Output
-				case Cmd_ExitFunc:
-					logger.ExitFunc(1)
+				func() {
+					defer func() {
+						if errrec := recover(); errrec != nil {
+							err = fmt.Errorf("try{} panicked at \"logger = logger2.(*Logger)\": %v", errrec)
+						}
+					}()
+					err = nil
+					logger = logger2.(*Logger)
+				}()
+
+				logger.Output = msg.Logger.Output
+				logger.Spill = msg.Logger.Spill
+				// the new Output is tried right away
+				if spillRetry != nil {
+					spillRetry.Stop()
+					spillRetry, spillAttempt = nil, 0
 				}
-			case <-ctx.Done():
-				return
+			case Cmd_SetLanes:
+				// the lines still in the old lanes, if any, go out first
+				drainLanes(logger, highLane, normalLane, lowLane)
+				highLane, normalLane, lowLane = msg.lanes.high, msg.lanes.normal, msg.lanes.low
+			case Cmd_ExitFunc:
+				// the EXITFUNC line may still wait in a lane, or in a BatchWriter
+				drainLanes(logger, highLane, normalLane, lowLane)
+				if f, ok := logger.Output.(interface{ Flush() error }); ok {
+					f.Flush()
+				}
+				logger.ExitFunc(1)
 			}
 		}
 	}()
@@ -170,6 +350,73 @@ func MakePrimordialEntryWithLogger(ctx context.Context) (entry *Entry) {
 	return entry
 }
 
+var closedChan = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
+// Calls the DroppedFunc with the calls dropped since the reported; returns the new reported
+func reportDropped(logger *Logger, droppedCalls *uint64, reported uint64) uint64 {
+	n := atomic.LoadUint64(droppedCalls)
+	if n != reported && logger.DroppedFunc != nil {
+		logger.DroppedFunc(n - reported)
+	}
+	return n
+}
+
+// Writes out the lines waiting in the lanes, highest first
+func drainLanes(logger *Logger, lanes ...*lane) {
+	for _, l := range lanes {
+		if l == nil {
+			continue
+		}
+	drain:
+		for {
+			select {
+			case msg := <-l.ch:
+				writeOutput(logger, msg.RawLine)
+				msg.release()
+			default:
+				break drain
+			}
+		}
+	}
+}
+
+// Writes the oldest of the spilled lines to the Output; it's popped only when written, so
+// on an error it's still the oldest one, to be tried again
+func writeSpilled(logger *Logger) error {
+	line, pos, err := logger.Spill.peek()
+	if err != nil {
+		logger.Spill.skipSegment(pos)
+		return nil
+	}
+	if line == nil {
+		return nil
+	}
+	if err := writeOutput(logger, line); err != nil {
+		return err
+	}
+	logger.Spill.pop(pos)
+	return nil
+}
+
+// A failed (or panicked) write goes to the ErrorFunc, and is returned; the logger goroutine
+// goes on
+func writeOutput(logger *Logger, line []byte) (err error) {
+	defer func() {
+		if errrec := recover(); errrec != nil {
+			err = fmt.Errorf("output write panicked: %v", errrec)
+		}
+		if err != nil && logger.ErrorFunc != nil {
+			logger.ErrorFunc(err)
+		}
+	}()
+	_, err = logger.Output.Write(line)
+	return err
+}
+
 // DO NOT run Get/Set logger concurrently! Only one thread is allowed to run them
 // (technically you can, and it will (kind of) work; but most certainly it's gonna be a bug due to race condition)
 func (entry *Entry) GetLogger() (logger *Logger) {
@@ -207,7 +454,13 @@ func (entry *Entry) Copy() *Entry {
 		panic(fmt.Errorf("!!! filtertag.go:188 / *** at \"entry2, err := deep_copy.Copy( entry)\": %v", err))
 	}
 
-	return entry2.(*Entry)
+	// the copystructure skips the unexported fields, and the lanes must be shared anyway
+	entry3 := entry2.(*Entry)
+	entry3.lanes = entry.lanes
+	entry3.SetPipeline(entry.pipeline)
+	entry3.droppedCalls = entry.droppedCalls
+	entry3.blockedCalls = entry.blockedCalls
+	return entry3
 }
 
 func (entry *Entry) GetRuleASTPointer(logger *Logger) {
@@ -232,6 +485,7 @@ func (entry *Entry) GetRuleASTPointer(logger *Logger) {
 type Writer struct {
 	Entry      *Entry
 	Filtertags []string
+	Decoder    Decoder
 }
 
 func (entry *Entry) Writer(
@@ -243,12 +497,57 @@ func (entry *Entry) Writer(
 	}
 	return w
 }
+
+// Same as Writer(), but every line written is first parsed with the decoder (e.g. the
+// LogfmtDecoder or JSONDecoder), and the resulting fields are logged as fields, not as a text.
+func (entry *Entry) WriterDecoder(
+	filtertags []string,
+	decoder Decoder,
+) (w io.Writer) {
+	w = &Writer{
+		Entry:      entry,
+		Filtertags: filtertags,
+		Decoder:    decoder,
+	}
+	return w
+}
+
 func (w *Writer) Write(p []byte) (n int, err error) {
-	w.Entry.Logft(w.Filtertags, string(p))
+	if w.Decoder == nil {
+		w.Entry.Logft(w.Filtertags, string(p))
+		n = len(p)
+		return
+	}
+
+	for _, line := range bytes.Split(p, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		fields, err := w.Decoder.Decode(line)
+		if err != nil {
+			return n, err
+		}
+		w.logDecoded(fields)
+	}
 	n = len(p)
 	return
 }
 
+func (w *Writer) logDecoded(fields map[string]interface{}) {
+	msg, _ := fields["msg"].(string)
+
+	extra := make([]Field, 0, len(fields))
+	for k, v := range fields {
+		switch k {
+		case "timestamp", "filtertags", "msg":
+			continue
+		}
+		extra = append(extra, Any(k, v))
+	}
+
+	w.Entry.LogFields(w.Filtertags, msg, extra...)
+}
+
 // If you use filtertag.Writer(), the message end up logged as a text string in "msg" JSON key;
 // that's not what we want here. Therefore, we will use a unique feature of filtertag,
 // the WriterNestedJSON() function, which will nest the output as nested struct into the
@@ -294,35 +593,168 @@ func (entry *Entry) Logft(
 	formatString string,
 	args ...interface{},
 ) {
-	var err error
+	entry.logft(nil, filtertags, formatString, args, nil)
+}
+
+// TryLogft is the Logft for the latency-critical paths: it never waits for the full channel
+// (or lane, or shard), the line is dropped then, and false returned. A line filtered out
+// is true. The dropped calls are counted, see DroppedCalls and the Logger.DroppedFunc.
+func (entry *Entry) TryLogft(
+	filtertags []string,
+	formatString string,
+	args ...interface{},
+) bool {
+	return entry.logft(closedChan, filtertags, formatString, args, nil)
+}
 
-	msg := &LoggerChType{
-		Command: Cmd_WriteLine,
+// LogftCtx is the Logft which gives up waiting for the full channel when the ctx is done;
+// false then, the same as with the TryLogft. The trace and span IDs of the ctx (see
+// ContextWithTraceIDs) go into the line.
+func (entry *Entry) LogftCtx(
+	ctx context.Context,
+	filtertags []string,
+	formatString string,
+	args ...interface{},
+) bool {
+	return entry.logft(ctx.Done(), filtertags, formatString, args, appendTraceIDs(nil, ctx))
+}
+
+// DroppedCalls returns the count of the TryLogft and LogftCtx calls dropped so far, by the
+// entry and all the entries sharing its LoggerCh
+func (entry *Entry) DroppedCalls() uint64 {
+	if entry.droppedCalls == nil {
+		return 0
 	}
+	return atomic.LoadUint64(entry.droppedCalls)
+}
 
+// A nil done waits for as long as it takes; the fields are set for the line, see logWith
+func (entry *Entry) logft(
+	done <-chan struct{},
+	filtertags []string,
+	formatString string,
+	args []interface{},
+	fields []Field,
+) bool {
 	for i, _ := range filtertags {
 		filtertags[i] = strings.ToUpper(filtertags[i])
 	}
-	// filtertags array must be allocated _new_ one on user-side, to avoid race conditions
-	entry.Fields["filtertags"] = map[string][]string{
-		"logger": filtertags,
+	if !entry.Passes(filtertags) {
+		return true
+	}
+
+	if len(args) == 0 && strings.IndexByte(formatString, '%') < 0 {
+		return entry.logWith(done, filtertags, formatString, fields)
+	}
+	return entry.logWith(done, filtertags, fmt.Sprintf(formatString, args...), fields)
+}
+
+// Encodes and sends the line; the filtertags are already uppercase, and passed the Filter.
+// False when the done is closed before the line could be sent (see sendLine).
+func (entry *Entry) logLine(filtertags []string, msgText string, done <-chan struct{}) bool {
+	var err error
+
+	msg := getLoggerMsg()
+	msg.Command = Cmd_WriteLine
+
+	// the line is encoded right here, before the Logft() returns, so the filtertags
+	// map can be reused from line to line
+	if ft, ok := entry.Fields["filtertags"].(map[string][]string); ok && len(ft) == 1 && ft["logger"] != nil {
+		ft["logger"] = filtertags
+	} else {
+		entry.Fields["filtertags"] = map[string][]string{
+			"logger": filtertags,
+		}
+	}
+	line := lineFields{set: true, msg: msgText}
+	if entry.pipeline != nil && entry.pipeline.Config.SequenceKey != "" {
+		line.seqKey, line.seq = entry.pipeline.Config.SequenceKey, entry.pipeline.nextSeq()
 	}
-	entry.Fields["msg"] = fmt.Sprintf(formatString, args...)
 
 	// THIS MUST STAY HERE NO MATTER WHAT
-	entry.Fields["timestamp"] = time.Now().Format("2006-01-02 15:04:05.000 MST")
+	if ts, ok := entry.Fields["timestamp"].(*Timestamp); ok && ts != nil {
+		ts.Time = time.Now()
+	} else {
+		entry.Fields["timestamp"] = &Timestamp{Time: time.Now()}
+	}
 
-	msg.RawLine, err = json.Marshal(entry.Fields)
+	msg.buffer = getLineBuffer()
+	if enc, ok := entry.encoder().(*JSONEncoder); ok && entry.Redactor == nil {
+		// the msg and the sequence number go right into the line, see lineFields
+		msg.buffer.b, err = encodeLineRecovered(enc, msg.buffer.b, entry.Fields, line)
+	} else {
+		// the other encoders (and the Redactor) get them in the Fields
+		entry.Fields["msg"] = msgText
+		if line.seqKey != "" {
+			entry.Fields[line.seqKey] = line.seq
+		}
+		fields := entry.Fields
+		if entry.Redactor != nil {
+			fields = entry.Redactor.RedactFields(fields)
+		}
+		msg.buffer.b, err = encodeRecovered(entry.encoder(), msg.buffer.b, fields)
+		if line.seqKey != "" {
+			delete(entry.Fields, line.seqKey)
+		}
+	}
 	if err != nil {
-		panic(fmt.Errorf("!!! filtertag.go:308 / *** at \"entry.rawLine, err = json.Marshal( entry.Fields)\": %v", err))
+		// a logging call must never crash the service, so the line goes out without the Fields
+		entry.Fields["msg"] = msgText
+		msg.buffer.b = entry.encodeFallback(msg.buffer.b[:0], err)
 	}
-	msg.RawLine = append(msg.RawLine, []byte("\n")...)
+	msg.RawLine = msg.buffer.b
 
-	entry.LoggerCh <- msg
+	sent := entry.sendLine(msg, filtertags, done)
+	if !sent && entry.droppedCalls != nil {
+		atomic.AddUint64(entry.droppedCalls, 1)
+	}
 
 	entry.Fields["filtertag"] = nil
 	entry.Fields["err"] = ""
 	entry.Fields["msg"] = ""
+	return sent
+}
+
+// Encodes the line with just the standard fields (which are always encodable), and the
+// reason of the failure in the "marshalerrors"
+func (entry *Entry) encodeFallback(dst []byte, reason error) []byte {
+	fields := map[string]interface{}{
+		"marshalerrors": []string{reason.Error()},
+	}
+	for _, k := range oversizedKeys {
+		v, ok := entry.Fields[k]
+		if !ok {
+			continue
+		}
+		switch v.(type) {
+		case string, *Timestamp, map[string][]string, nil:
+			fields[k] = v
+		}
+	}
+	line, err := encodeRecovered(entry.encoder(), dst, fields)
+	if err != nil {
+		line, _ = defaultEncoder.Encode(dst, fields)
+	}
+	return line
+}
+
+// The encoders call the user's code (Error(), String(), MarshalJSON() etc.), which may panic
+func encodeRecovered(enc Encoder, dst []byte, fields map[string]interface{}) (line []byte, err error) {
+	defer func() {
+		if errrec := recover(); errrec != nil {
+			line, err = dst, fmt.Errorf("encoder panicked: %v", errrec)
+		}
+	}()
+	return enc.Encode(dst, fields)
+}
+
+func encodeLineRecovered(enc *JSONEncoder, dst []byte, fields map[string]interface{}, line lineFields) (out []byte, err error) {
+	defer func() {
+		if errrec := recover(); errrec != nil {
+			out, err = dst, fmt.Errorf("encoder panicked: %v", errrec)
+		}
+	}()
+	return enc.encodeLine(dst, fields, line)
 }
 
 // Log and exit the app
@@ -331,6 +763,9 @@ func (entry *Entry) ExitFunc(
 	args ...interface{},
 ) {
 	entry.Logft([]string{"EXITFUNC"}, formatString, args...)
+	if entry.pipeline != nil {
+		entry.pipeline.Flush()
+	}
 	entry.LoggerCh <- &LoggerChType{Command: Cmd_ExitFunc}
 }
 
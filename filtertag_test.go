@@ -0,0 +1,223 @@
+package filtertag
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Holds the logger goroutine in its Write until the gate is closed; keeps the msgs
+type gatedWriter struct {
+	gate chan struct{}
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (w *gatedWriter) Write(p []byte) (int, error) {
+	<-w.gate
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	s := string(p)
+	i := strings.Index(s, `"msg":"`)
+	s = s[i+7:]
+	w.msgs = append(w.msgs, s[:strings.IndexByte(s, '"')])
+	return len(p), nil
+}
+
+func (w *gatedWriter) lines() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.msgs...)
+}
+
+// The logger with its Output held by the gate, and the OverflowFunc and DroppedFunc counted
+type testLogger struct {
+	entry     *Entry
+	w         *gatedWriter
+	overflows int32
+	mu        sync.Mutex
+	dropped   []uint64
+}
+
+func makeTestLogger(t *testing.T, lanes *LanesConfig) *testLogger {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	tl := &testLogger{entry: MakePrimordialEntryWithLogger(ctx), w: &gatedWriter{gate: make(chan struct{})}}
+	if lanes != nil {
+		tl.entry.SetLanes(*lanes)
+	}
+	logger := tl.entry.GetLogger()
+	logger.Output = tl.w
+	logger.OverflowFunc = func() { atomic.AddInt32(&tl.overflows, 1) }
+	logger.DroppedFunc = func(n uint64) {
+		tl.mu.Lock()
+		tl.dropped = append(tl.dropped, n)
+		tl.mu.Unlock()
+	}
+	logger.ExitFunc = func(int) {}
+	tl.entry.SetLogger(logger)
+	tl.entry.GetLogger()
+	return tl
+}
+
+func (tl *testLogger) reported() []uint64 {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	return append([]uint64(nil), tl.dropped...)
+}
+
+// Waits for the logger goroutine to get the "first" line, and to get stuck in its Write
+func (tl *testLogger) holdOutput() {
+	tl.entry.Info("first")
+	time.Sleep(20 * time.Millisecond)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("no " + what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// The TryLogft calls which find the channel full are dropped and reported, without the
+// OverflowFunc; the logger goroutine doesn't get stuck on its own full channel either
+func TestTryLogftFullChannel(t *testing.T) {
+	tl := makeTestLogger(t, nil)
+	entry := tl.entry.Copy()
+	entry.Filter = AnyOf("INFO")
+	tl.holdOutput()
+
+	ok := 0
+	for i := 0; i < 600; i++ {
+		if entry.TryLogft([]string{"INFO"}, "try %v", i) {
+			ok++
+		}
+	}
+	if ok != 502 || entry.DroppedCalls() != 98 {
+		t.Fatalf("%v sent, %v dropped", ok, entry.DroppedCalls())
+	}
+	if !entry.TryLogft([]string{"TRACE"}, "filtered") || entry.DroppedCalls() != 98 {
+		t.Fatal("a filtered line must be true")
+	}
+	close(tl.w.gate)
+
+	// reported after the burst is over, with nothing more logged
+	waitFor(t, "DroppedFunc", func() bool { return len(tl.reported()) > 0 })
+	if got := tl.reported(); len(got) != 1 || got[0] != 98 {
+		t.Fatalf("reported %v", got)
+	}
+	waitFor(t, "lines", func() bool { return len(tl.w.lines()) >= 1+502+1 })
+	if n := atomic.LoadInt32(&tl.overflows); n != 0 {
+		t.Fatalf("the OverflowFunc called %v times", n)
+	}
+	alerts := 0
+	for _, msg := range tl.w.lines() {
+		if strings.Contains(msg, "dangerous levels") {
+			alerts++
+		}
+	}
+	if alerts != 1 {
+		t.Fatalf("%v alerts", alerts)
+	}
+
+	entry.Info("after")
+	waitFor(t, "line after", func() bool {
+		lines := tl.w.lines()
+		return lines[len(lines)-1] == "after"
+	})
+}
+
+// A LogftCtx gives up on the full channel when its ctx is done
+func TestLogftCtxCancel(t *testing.T) {
+	tl := makeTestLogger(t, nil)
+	entry := tl.entry.Copy()
+	tl.holdOutput()
+	for entry.TryLogft([]string{"INFO"}, "fill") {
+	}
+	dropped := entry.DroppedCalls()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if entry.LogftCtx(ctx, []string{"INFO"}, "ctx") {
+		t.Fatal("sent to the full channel")
+	}
+	if d := time.Since(start); d < 25*time.Millisecond || d > time.Second {
+		t.Fatalf("gave up after %v", d)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if entry.LogftCtx(ctx, []string{"INFO"}, "cancelled") {
+		t.Fatal("sent to the full channel")
+	}
+	if n := entry.DroppedCalls(); n != dropped+2 {
+		t.Fatalf("%v dropped", n)
+	}
+
+	close(tl.w.gate)
+	waitFor(t, "lines", func() bool { return len(tl.w.lines()) >= 1+502 })
+	if !entry.LogftCtx(context.Background(), []string{"INFO"}, "bg") {
+		t.Fatal("not sent")
+	}
+	if n := atomic.LoadInt32(&tl.overflows); n != 0 {
+		t.Fatalf("the OverflowFunc called %v times", n)
+	}
+}
+
+// A Logft held by the full channel is the overflow
+func TestLogftOverflow(t *testing.T) {
+	tl := makeTestLogger(t, nil)
+	entry := tl.entry.Copy()
+	tl.holdOutput()
+	for entry.TryLogft([]string{"INFO"}, "fill") {
+	}
+	done := make(chan struct{})
+	go func() {
+		entry.Copy().Info("blocked")
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(tl.w.gate)
+	<-done
+	waitFor(t, "OverflowFunc", func() bool { return atomic.LoadInt32(&tl.overflows) > 0 })
+}
+
+// The TryLogft calls which find a Block lane full are dropped, the lines which the other
+// lanes drop by their policy aren't the caller's dropped calls
+func TestTryLogftFullLane(t *testing.T) {
+	cfg := DefaultLanesConfig()
+	cfg.Normal.Size = 3
+	tl := makeTestLogger(t, &cfg)
+	entry := tl.entry
+	tl.holdOutput()
+
+	n := 0
+	for i := 0; i < 10; i++ {
+		if entry.TryLogft([]string{"INFO"}, "x") {
+			n++
+		}
+	}
+	for i := 0; i < 20; i++ {
+		if !entry.TryLogft([]string{"TRACE"}, "x") {
+			t.Fatal("the Low lane drops by its policy")
+		}
+	}
+	if n != 5 || entry.DroppedCalls() != 5 {
+		t.Fatalf("%v sent, %v dropped", n, entry.DroppedCalls())
+	}
+	close(tl.w.gate)
+	waitFor(t, "DroppedFunc", func() bool { return len(tl.reported()) > 0 })
+	if got := tl.reported(); got[0] != 5 {
+		t.Fatalf("reported %v", got)
+	}
+	if n := atomic.LoadInt32(&tl.overflows); n != 0 {
+		t.Fatalf("the OverflowFunc called %v times", n)
+	}
+}
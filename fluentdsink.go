@@ -0,0 +1,201 @@
+package filtertag
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+type FluentdSinkConfig struct {
+	Network   string // "tcp" if empty, or "unix"
+	Address   string
+	TLSConfig *tls.Config
+
+	// The tag, with the holes filled from the fields, like "app.{service}" (see LogTemplate()
+	// for the holes); "filtertag" if empty
+	Tag string
+	// Waits for the receiver's ack of every chunk (require_ack_response of the out_forward);
+	// without it, a chunk written to a connection which breaks right then is lost.
+	RequireAck bool
+	AckTimeout time.Duration // 30s if zero
+
+	// Reads the lines back into the records; must match the Entry.Encoder, JSONDecoder if nil
+	Decoder Decoder
+
+	DialTimeout  time.Duration // 5s if zero
+	WriteTimeout time.Duration // 5s if zero
+
+	BatchConfig
+}
+
+// FluentdSink sends the lines to Fluentd or Fluent Bit with the forward protocol (in the
+// Forward mode, one message per tag per batch): the record is the fields of the line, the
+// time is its timestamp, as the EventTime.
+type FluentdSink struct {
+	*batcher
+	Config FluentdSinkConfig
+
+	// used from the batcher's goroutine only
+	conn        net.Conn
+	tagTemplate fieldTemplate
+	buf         []byte
+}
+
+func MakeFluentdSink(ctx context.Context, config FluentdSinkConfig) *FluentdSink {
+	if config.Network == "" {
+		config.Network = "tcp"
+	}
+	if config.Tag == "" {
+		config.Tag = "filtertag"
+	}
+	if config.AckTimeout <= 0 {
+		config.AckTimeout = 30 * time.Second
+	}
+	if config.Decoder == nil {
+		config.Decoder = &JSONDecoder{}
+	}
+	if config.DialTimeout <= 0 {
+		config.DialTimeout = 5 * time.Second
+	}
+	if config.WriteTimeout <= 0 {
+		config.WriteTimeout = 5 * time.Second
+	}
+
+	sink := &FluentdSink{
+		Config:      config,
+		tagTemplate: parseFieldTemplate(config.Tag),
+	}
+	sink.batcher = makeBatcher(ctx, config.BatchConfig, sink.send)
+	return sink
+}
+
+func (sink *FluentdSink) Close() error {
+	sink.batcher.Close()
+	sink.disconnect()
+	return nil
+}
+
+func (sink *FluentdSink) disconnect() {
+	if sink.conn != nil {
+		sink.conn.Close()
+		sink.conn = nil
+	}
+}
+
+type fluentdRecord struct {
+	time   time.Time
+	fields map[string]interface{}
+}
+
+func (sink *FluentdSink) send(ctx context.Context, lines [][]byte) error {
+	// every line is decoded once, for both its tag and its record
+	records := make([]fluentdRecord, len(lines))
+	tagOf := func(i int) string {
+		fields, err := sink.Config.Decoder.Decode(lines[i])
+		if err != nil {
+			fields = map[string]interface{}{"msg": string(lines[i])}
+		}
+		records[i] = fluentdRecord{time: lineTime(fields), fields: fields}
+		return sink.tagTemplate.render(fields)
+	}
+
+	return sendGrouped(lines, tagOf, func(tag string, group []int) error {
+		return sink.forward(ctx, tag, group, records)
+	})
+}
+
+// [tag, [[time, record], ...], {"size": n, "chunk": id}]
+func (sink *FluentdSink) forward(ctx context.Context, tag string, group []int, records []fluentdRecord) error {
+	var f msgpackFormat
+	var err error
+	buf := f.appendArrayHeader(sink.buf[:0], 3)
+	buf = f.appendString(buf, tag)
+	buf = f.appendArrayHeader(buf, len(group))
+	for _, i := range group {
+		rec := records[i]
+		buf = f.appendArrayHeader(buf, 2)
+		buf = appendFluentdEventTime(buf, rec.time)
+		buf, err = appendBinaryMap(f, buf, rec.fields, 0)
+		if err != nil {
+			return &permanentError{err}
+		}
+	}
+	chunk := ""
+	if sink.Config.RequireAck {
+		var id [16]byte
+		rand.Read(id[:])
+		chunk = base64.StdEncoding.EncodeToString(id[:])
+		buf = f.appendMapHeader(buf, 2)
+		buf = f.appendString(buf, "chunk")
+		buf = f.appendString(buf, chunk)
+	} else {
+		buf = f.appendMapHeader(buf, 1)
+	}
+	buf = f.appendString(buf, "size")
+	buf = f.appendUint(buf, uint64(len(group)))
+	sink.buf = buf
+
+	if sink.conn == nil {
+		conn, err := dialSink(ctx, sink.Config.Network, sink.Config.Address, sink.Config.TLSConfig, sink.Config.DialTimeout)
+		if err != nil {
+			return err
+		}
+		sink.conn = conn
+	}
+	sink.conn.SetWriteDeadline(time.Now().Add(sink.Config.WriteTimeout))
+	if _, err := sink.conn.Write(buf); err != nil {
+		sink.disconnect()
+		return err
+	}
+
+	if chunk != "" {
+		if err := sink.readAck(chunk); err != nil {
+			sink.disconnect()
+			return err
+		}
+	}
+	return nil
+}
+
+// The EventTime is the ext type 0: the seconds and the nanoseconds, 4 bytes big-endian each
+func appendFluentdEventTime(dst []byte, t time.Time) []byte {
+	dst = append(dst, 0xd7, 0x00)
+	var b [8]byte
+	binary.BigEndian.PutUint32(b[:4], uint32(t.Unix()))
+	binary.BigEndian.PutUint32(b[4:], uint32(t.Nanosecond()))
+	return append(dst, b[:]...)
+}
+
+// Reads the {"ack": chunk} response
+func (sink *FluentdSink) readAck(chunk string) error {
+	sink.conn.SetReadDeadline(time.Now().Add(sink.Config.AckTimeout))
+	var buf []byte
+	var tmp [512]byte
+	for {
+		n, err := sink.conn.Read(tmp[:])
+		buf = append(buf, tmp[:n]...)
+		if n > 0 {
+			v, decodeErr := decodeMsgpackValue(&binaryReader{b: buf})
+			switch {
+			case decodeErr == io.ErrUnexpectedEOF && len(buf) < 64<<10:
+				// not all of it yet
+			case decodeErr != nil:
+				return decodeErr
+			default:
+				if m, ok := v.(map[string]interface{}); ok && m["ack"] == chunk {
+					return nil
+				}
+				return fmt.Errorf("fluentd acked %v, not the chunk %v", v, chunk)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package filtertag
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFluentdSinkAck(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	got := make(chan []interface{}, 10)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		var buf []byte
+		tmp := make([]byte, 4096)
+		for {
+			n, err := c.Read(tmp)
+			if err != nil {
+				return
+			}
+			buf = append(buf, tmp[:n]...)
+			for {
+				r := &binaryReader{b: buf}
+				v, err := decodeMsgpackValue(r)
+				if err != nil {
+					break
+				}
+				buf = buf[r.pos:]
+				msg := v.([]interface{})
+				got <- msg
+				opt := msg[2].(map[string]interface{})
+				var f msgpackFormat
+				resp := f.appendMapHeader(nil, 1)
+				resp = f.appendString(resp, "ack")
+				resp = f.appendString(resp, opt["chunk"].(string))
+				c.Write(resp[:3])
+				time.Sleep(5 * time.Millisecond)
+				c.Write(resp[3:])
+			}
+		}
+	}()
+	sink := MakeFluentdSink(context.Background(), FluentdSinkConfig{Address: ln.Addr().String(), Tag: "app.{service}", RequireAck: true,
+		BatchConfig: BatchConfig{MaxDelay: 5 * time.Millisecond}})
+	sink.Write([]byte(`{"timestamp":"2024-01-02 03:04:05.678 UTC","service":"a","msg":"1"}`))
+	sink.Write([]byte(`{"service":"b","msg":"2"}`))
+	sink.Write([]byte(`{"service":"a","msg":"3"}`))
+	m1, m2 := <-got, <-got
+	if m1[0] != "app.a" || len(m1[1].([]interface{})) != 2 || m2[0] != "app.b" {
+		t.Fatalf("got %#v, %#v", m1, m2)
+	}
+	ev := m1[1].([]interface{})[0].([]interface{})
+	if ev[1].(map[string]interface{})["msg"] != "1" {
+		t.Fatal(ev)
+	}
+	sink.Close()
+	if st := sink.Stats(); st.Written != 3 || st.Errors != 0 {
+		t.Fatalf("%+v", st)
+	}
+}
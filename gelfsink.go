@@ -0,0 +1,294 @@
+package filtertag
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	GELFCompression_Gzip = "gzip"
+	GELFCompression_Zlib = "zlib"
+	GELFCompression_None = "none"
+)
+
+type GELFSinkConfig struct {
+	Network   string // "udp" (the default) or "tcp"
+	Address   string
+	TLSConfig *tls.Config // for the "tcp" only
+
+	Compression string // for the "udp" only (the TCP GELF is never compressed); gzip if empty
+	ChunkSize   int    // the max UDP datagram, 1420 if zero (8154 is fine on a LAN)
+
+	Severities      map[string]int // for the "level"; DefaultSyslogSeverities if nil
+	DefaultSeverity *int           // SyslogSeverity_Info if nil, see SyslogSeverity()
+
+	// Reads the lines back; must match the Entry.Encoder, JSONDecoder if nil
+	Decoder Decoder
+
+	DialTimeout  time.Duration // 5s if zero
+	WriteTimeout time.Duration // 5s if zero
+
+	BatchConfig
+}
+
+// GELFSink sends the lines to Graylog as the GELF messages: the "msg" is the short_message
+// (its first line; the whole one goes in the full_message then), the "host" the host, the
+// filtertags give the level (like in the SyslogSink) and the "_filtertags", and the other
+// fields become the "_" additional fields (the nested ones as JSON).
+type GELFSink struct {
+	*batcher
+	Config GELFSinkConfig
+
+	// used from the batcher's goroutine only
+	conn net.Conn
+	host string
+	buf  []byte
+}
+
+var errGELFTooBig = errors.New("the GELF message needs more than 128 chunks")
+
+const gelfMaxChunks = 128
+
+func MakeGELFSink(ctx context.Context, config GELFSinkConfig) *GELFSink {
+	if config.Network == "" {
+		config.Network = "udp"
+	}
+	if config.Compression == "" {
+		config.Compression = GELFCompression_Gzip
+	}
+	if config.ChunkSize <= 0 {
+		config.ChunkSize = 1420
+	}
+	if config.Severities == nil {
+		config.Severities = DefaultSyslogSeverities
+	}
+	if config.DefaultSeverity == nil {
+		config.DefaultSeverity = SyslogSeverity(SyslogSeverity_Info)
+	}
+	if config.Decoder == nil {
+		config.Decoder = &JSONDecoder{}
+	}
+	if config.DialTimeout <= 0 {
+		config.DialTimeout = 5 * time.Second
+	}
+	if config.WriteTimeout <= 0 {
+		config.WriteTimeout = 5 * time.Second
+	}
+
+	sink := &GELFSink{Config: config}
+	sink.host, _ = os.Hostname()
+	sink.batcher = makeBatcher(ctx, config.BatchConfig, sink.send)
+	return sink
+}
+
+func (sink *GELFSink) Close() error {
+	sink.batcher.Close()
+	if sink.conn != nil {
+		sink.conn.Close()
+		sink.conn = nil
+	}
+	return nil
+}
+
+func (sink *GELFSink) stream() bool {
+	return strings.HasPrefix(sink.Config.Network, "tcp")
+}
+
+func (sink *GELFSink) send(ctx context.Context, lines [][]byte) error {
+	if sink.conn == nil {
+		conn, err := dialSink(ctx, sink.Config.Network, sink.Config.Address, sink.Config.TLSConfig, sink.Config.DialTimeout)
+		if err != nil {
+			return err
+		}
+		sink.conn = conn
+	}
+	sink.conn.SetWriteDeadline(time.Now().Add(sink.Config.WriteTimeout))
+
+	if sink.stream() {
+		// the messages are delimited by the null bytes
+		buf := sink.buf[:0]
+		for _, line := range lines {
+			buf = sink.appendMessage(buf, line)
+			buf = append(buf, 0)
+		}
+		sink.buf = buf
+		if _, err := sink.conn.Write(buf); err != nil {
+			sink.disconnect()
+			return err
+		}
+		return nil
+	}
+
+	var tooBig [][]byte
+	for i, line := range lines {
+		sink.buf = sink.appendMessage(sink.buf[:0], line)
+		err := sink.writeDatagram(sink.buf)
+		if err == errGELFTooBig {
+			tooBig = append(tooBig, line)
+			continue
+		}
+		if err != nil {
+			sink.disconnect()
+			if i == 0 {
+				return err
+			}
+			return &partialError{failed: lines[i:], err: err}
+		}
+	}
+	if len(tooBig) > 0 {
+		return &partialError{failed: tooBig, err: &permanentError{errGELFTooBig}}
+	}
+	return nil
+}
+
+func (sink *GELFSink) disconnect() {
+	if sink.conn != nil {
+		sink.conn.Close()
+		sink.conn = nil
+	}
+}
+
+// Compresses the message, and sends it in one datagram if it fits, in the chunks otherwise
+func (sink *GELFSink) writeDatagram(msg []byte) error {
+	switch sink.Config.Compression {
+	case GELFCompression_Gzip:
+		msg = gzipBytes(msg)
+	case GELFCompression_Zlib:
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		zw.Write(msg)
+		zw.Close()
+		msg = buf.Bytes()
+	}
+
+	if len(msg) <= sink.Config.ChunkSize {
+		_, err := sink.conn.Write(msg)
+		return err
+	}
+
+	// 0x1e 0x0f, 8 bytes of the message id, the chunk's number, the number of the chunks
+	const header = 12
+	size := sink.Config.ChunkSize - header
+	count := (len(msg) + size - 1) / size
+	if count > gelfMaxChunks {
+		return errGELFTooBig
+	}
+	chunk := make([]byte, header, sink.Config.ChunkSize)
+	chunk[0], chunk[1] = 0x1e, 0x0f
+	binary.BigEndian.PutUint64(chunk[2:10], rand.Uint64())
+	chunk[11] = byte(count)
+	for i := 0; i < count; i++ {
+		chunk[10] = byte(i)
+		end := (i + 1) * size
+		if end > len(msg) {
+			end = len(msg)
+		}
+		if _, err := sink.conn.Write(append(chunk[:header], msg[i*size:end]...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sink *GELFSink) appendMessage(dst []byte, line []byte) []byte {
+	fields, err := sink.Config.Decoder.Decode(line)
+	if err != nil {
+		fields = map[string]interface{}{"msg": string(bytes.TrimRight(line, "\n"))}
+	}
+	tags := lineFiltertags(fields)
+
+	host := fieldString(fields, "host")
+	if host == "" {
+		host = sink.host
+	}
+	msg := strings.TrimRight(fieldString(fields, "msg"), "\n")
+	short := msg
+	if i := strings.IndexByte(msg, '\n'); i >= 0 {
+		short = msg[:i]
+	}
+	if short == "" {
+		// it's required, and can't be empty
+		short = "-"
+	}
+
+	dst = append(dst, `{"version":"1.1","host":`...)
+	dst = appendJSONString(dst, host)
+	dst = append(dst, `,"short_message":`...)
+	dst = appendJSONString(dst, short)
+	if short != msg {
+		dst = append(dst, `,"full_message":`...)
+		dst = appendJSONString(dst, msg)
+	}
+	dst = append(dst, `,"timestamp":`...)
+	dst = strconv.AppendFloat(dst, float64(lineTime(fields).UnixNano()/1e6)/1e3, 'f', 3, 64)
+	dst = append(dst, `,"level":`...)
+	dst = strconv.AppendInt(dst, int64(syslogSeverity(sink.Config.Severities, *sink.Config.DefaultSeverity, tags)), 10)
+	if len(tags) > 0 {
+		dst = append(dst, `,"_filtertags":`...)
+		dst = appendJSONString(dst, strings.Join(tags, ","))
+	}
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		switch k {
+		case "msg", "host", "timestamp", "filtertags":
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var value []byte
+		switch v := fields[k].(type) {
+		case nil:
+			continue
+		case string:
+			if v == "" {
+				continue
+			}
+			value = appendJSONString(nil, v)
+		case float64, json.Number, int64, int:
+			value, _ = json.Marshal(v)
+		default:
+			// the values are the strings or the numbers only
+			b, err := json.Marshal(v)
+			if err != nil {
+				continue
+			}
+			value = appendJSONString(nil, string(b))
+		}
+		dst = append(dst, ',')
+		dst = appendJSONString(dst, gelfFieldName(k))
+		dst = append(dst, ':')
+		dst = append(dst, value...)
+	}
+	return append(dst, '}')
+}
+
+// The additional fields are "_" + [\w.-]+, and the "_id" is reserved
+func gelfFieldName(key string) string {
+	b := []byte{'_'}
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if !(c == '_' || c == '.' || c == '-' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			c = '_'
+		}
+		b = append(b, c)
+	}
+	if string(b) == "_id" {
+		return "_id_"
+	}
+	return string(b)
+}
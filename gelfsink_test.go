@@ -0,0 +1,92 @@
+package filtertag
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGELFSinkUDPChunked(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	sink := MakeGELFSink(context.Background(), GELFSinkConfig{Address: pc.LocalAddr().String(), ChunkSize: 100,
+		BatchConfig: BatchConfig{MaxDelay: time.Millisecond}})
+	long := strings.Repeat("abcdefghij", 300)
+	sink.Write([]byte(`{"timestamp":"2024-01-02 03:04:05.678 UTC","host":"h1","id":7,"sub sys":"db","nested":{"a":1},"filtertags":{"logger":["ERROR"]},"msg":"first\n` + long + `"}`))
+	chunks := map[byte][]byte{}
+	var count byte
+	buf := make([]byte, 2000)
+	for {
+		pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf[0] != 0x1e || buf[1] != 0x0f || n > 100 {
+			t.Fatal("not a chunk")
+		}
+		count = buf[11]
+		chunks[buf[10]] = append([]byte(nil), buf[12:n]...)
+		if len(chunks) == int(count) {
+			break
+		}
+	}
+	var all []byte
+	for i := byte(0); i < count; i++ {
+		all = append(all, chunks[i]...)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(all))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, _ := io.ReadAll(zr)
+	var v map[string]interface{}
+	if err := json.Unmarshal(msg, &v); err != nil {
+		t.Fatal(err)
+	}
+	if v["short_message"] != "first" || v["level"] != 3.0 || v["timestamp"] != 1704164645.678 || v["_id_"] != 7.0 || v["_sub_sys"] != "db" || v["_nested"] != `{"a":1}` || v["_filtertags"] != "ERROR" || !strings.HasSuffix(v["full_message"].(string), long) {
+		t.Fatal(v)
+	}
+	sink.Close()
+}
+
+func TestGELFSinkTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	got := make(chan string, 10)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		r := bufio.NewReader(c)
+		for {
+			s, err := r.ReadString(0)
+			if err != nil {
+				return
+			}
+			got <- s
+		}
+	}()
+	sink := MakeGELFSink(context.Background(), GELFSinkConfig{Network: "tcp", Address: ln.Addr().String(), BatchConfig: BatchConfig{MaxDelay: time.Millisecond}})
+	sink.Write([]byte(`{"msg":"a"}`))
+	sink.Write([]byte(`{"msg":""}`))
+	a, b := <-got, <-got
+	if !strings.Contains(a, `"short_message":"a"`) || !strings.Contains(b, `"short_message":"-"`) || !strings.HasSuffix(a, "}\x00") {
+		t.Fatal(a, b)
+	}
+	sink.Close()
+}
@@ -0,0 +1,279 @@
+//go:build linux
+// +build linux
+
+package filtertag
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+type JournalSinkConfig struct {
+	Path             string // of the journald socket, "/run/systemd/journal/socket" if empty
+	SyslogIdentifier string // the basename of the executable if empty
+
+	Severities      map[string]int // for the PRIORITY; DefaultSyslogSeverities if nil
+	DefaultSeverity *int           // SyslogSeverity_Info if nil, see SyslogSeverity()
+
+	// Reads the lines back; must match the Entry.Encoder, JSONDecoder if nil
+	Decoder Decoder
+
+	BufferLines int         // DefaultBufferLines if zero
+	BufferBytes int         // DefaultBufferBytes if zero
+	Spill       *SpillQueue // see the NetSinkConfig
+}
+
+// JournalSink sends the lines to journald with its native protocol, every field as its own
+// journal field: the names uppercased ("subsystem" is SUBSYSTEM), the "msg" is the MESSAGE,
+// every filtertag is a FILTERTAGS value (so `journalctl FILTERTAGS=ERROR` works), and the
+// nested values are JSON. The lines too big for a datagram go in a sealed memfd.
+type JournalSink struct {
+	*NetSink
+	Config JournalSinkConfig
+}
+
+func MakeJournalSink(ctx context.Context, config JournalSinkConfig) *JournalSink {
+	if config.Path == "" {
+		config.Path = "/run/systemd/journal/socket"
+	}
+	if config.SyslogIdentifier == "" {
+		config.SyslogIdentifier = filepath.Base(os.Args[0])
+	}
+	if config.Severities == nil {
+		config.Severities = DefaultSyslogSeverities
+	}
+	if config.DefaultSeverity == nil {
+		config.DefaultSeverity = SyslogSeverity(SyslogSeverity_Info)
+	}
+	if config.Decoder == nil {
+		config.Decoder = &JSONDecoder{}
+	}
+
+	sink := &JournalSink{Config: config}
+	sink.NetSink = makeNetSink(ctx, NetSinkConfig{
+		Network:     "unixgram",
+		Address:     config.Path,
+		BufferLines: config.BufferLines,
+		BufferBytes: config.BufferBytes,
+		Spill:       config.Spill,
+	}, writeJournalDatagram)
+	return sink
+}
+
+func (sink *JournalSink) Write(p []byte) (int, error) {
+	fields, err := sink.Config.Decoder.Decode(p)
+	if err != nil {
+		fields = map[string]interface{}{"msg": string(p)}
+	}
+
+	buf := getLineBuffer()
+	defer putLineBuffer(buf)
+	buf.b = sink.appendEntry(buf.b[:0], fields)
+
+	if _, err := sink.NetSink.Write(buf.b); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Not the NetSink's one, that would skip the formatting
+func (sink *JournalSink) WriteLines(lines [][]byte) error {
+	return writeLinesEach(sink, lines)
+}
+
+func (sink *JournalSink) appendEntry(dst []byte, fields map[string]interface{}) []byte {
+	tags := lineFiltertags(fields)
+	sev := syslogSeverity(sink.Config.Severities, *sink.Config.DefaultSeverity, tags)
+
+	dst = appendJournalField(dst, "MESSAGE", fieldString(fields, "msg"))
+	dst = appendJournalField(dst, "PRIORITY", strconv.Itoa(sev))
+	dst = appendJournalField(dst, "SYSLOG_IDENTIFIER", sink.Config.SyslogIdentifier)
+	for _, tag := range tags {
+		dst = appendJournalField(dst, "FILTERTAGS", tag)
+	}
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		switch k {
+		case "msg", "filtertags":
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		name := journalFieldName(k)
+		if name == "" {
+			continue
+		}
+		var value string
+		switch v := fields[k].(type) {
+		case nil:
+			continue
+		case string:
+			value = v
+		case map[string]interface{}, []interface{}:
+			b, err := json.Marshal(v)
+			if err != nil {
+				continue
+			}
+			value = string(b)
+		default:
+			value = fmt.Sprint(v)
+		}
+		if value == "" {
+			continue
+		}
+		dst = appendJournalField(dst, name, value)
+	}
+	return dst
+}
+
+// NAME=value\n, or for the values with a newline NAME\n <8 bytes little-endian length> value\n
+func appendJournalField(dst []byte, name string, value string) []byte {
+	dst = append(dst, name...)
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\n' {
+			dst = append(dst, '\n')
+			var n [8]byte
+			binary.LittleEndian.PutUint64(n[:], uint64(len(value)))
+			dst = append(dst, n[:]...)
+			dst = append(dst, value...)
+			return append(dst, '\n')
+		}
+	}
+	dst = append(dst, '=')
+	dst = append(dst, value...)
+	return append(dst, '\n')
+}
+
+// The journal field names are [A-Z0-9_], up to 64, not starting with "_" (those are the
+// trusted fields, set by the journald itself) nor with a digit
+func journalFieldName(key string) string {
+	b := make([]byte, 0, len(key))
+	for i := 0; i < len(key) && len(b) < 64; i++ {
+		c := key[i]
+		switch {
+		case c >= 'a' && c <= 'z':
+			c -= 'a' - 'A'
+		case c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		default:
+			c = '_'
+		}
+		if len(b) == 0 && c == '_' {
+			continue
+		}
+		if len(b) == 0 && c >= '0' && c <= '9' {
+			b = append(b, 'F', '_')
+		}
+		b = append(b, c)
+	}
+	return string(b)
+}
+
+// Sends the entry as a datagram, or if it's too big for one, passes it in a memfd
+func writeJournalDatagram(conn net.Conn, entry []byte) error {
+	_, err := conn.Write(entry)
+	if err == nil || !(errors.Is(err, syscall.EMSGSIZE) || errors.Is(err, syscall.ENOBUFS)) {
+		return err
+	}
+
+	uconn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return err
+	}
+	fd, err := journalPayloadFd(entry)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	// the WriteMsgUnix() refuses the connected datagram sockets, hence the raw sendmsg
+	rc, err := uconn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sendErr error
+	err = rc.Write(func(sock uintptr) bool {
+		sendErr = syscall.Sendmsg(int(sock), nil, syscall.UnixRights(fd), nil, 0)
+		return sendErr != syscall.EAGAIN
+	})
+	if err != nil {
+		return err
+	}
+	return sendErr
+}
+
+// memfd_create isn't in the syscall package for most of the archs
+var memfdCreateTrap = map[string]uintptr{
+	"386":     356,
+	"amd64":   319,
+	"arm":     385,
+	"arm64":   279,
+	"ppc64":   360,
+	"ppc64le": 360,
+	"riscv64": 279,
+	"s390x":   350,
+}
+
+const (
+	mfdCloexec       = 0x1
+	mfdAllowSealing  = 0x2
+	fcntlAddSeals    = 1033
+	sealAllMemfdBits = 0x1 | 0x2 | 0x4 | 0x8 // F_SEAL_SEAL, SHRINK, GROW, WRITE
+)
+
+// A sealed memfd with the payload; on the kernels without memfd, an unlinked file in the
+// /dev/shm (the journald accepts either)
+func journalPayloadFd(payload []byte) (int, error) {
+	if trap, ok := memfdCreateTrap[runtime.GOARCH]; ok {
+		name, _ := syscall.BytePtrFromString("filtertag-journal")
+		r, _, errno := syscall.Syscall(trap, uintptr(unsafe.Pointer(name)), mfdCloexec|mfdAllowSealing, 0)
+		if errno == 0 {
+			fd := int(r)
+			if err := writeAll(fd, payload); err != nil {
+				syscall.Close(fd)
+				return -1, err
+			}
+			if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), fcntlAddSeals, sealAllMemfdBits); errno != 0 {
+				syscall.Close(fd)
+				return -1, errno
+			}
+			return fd, nil
+		}
+	}
+
+	f, err := os.CreateTemp("/dev/shm", "filtertag-journal-")
+	if err != nil {
+		return -1, err
+	}
+	defer f.Close()
+	os.Remove(f.Name())
+	if _, err := f.Write(payload); err != nil {
+		return -1, err
+	}
+	// a fd of our own, the f closes its one
+	return syscall.Dup(int(f.Fd()))
+}
+
+func writeAll(fd int, b []byte) error {
+	for len(b) > 0 {
+		n, err := syscall.Write(fd, b)
+		if err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
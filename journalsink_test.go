@@ -0,0 +1,71 @@
+//go:build linux
+// +build linux
+
+package filtertag
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestJournalSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.sock")
+	l, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	sink := MakeJournalSink(context.Background(), JournalSinkConfig{Path: path, SyslogIdentifier: "app"})
+	sink.Write([]byte(`{"host":"h1","subsystem":"db","_x":"1","9lives":2,"nested":{"a":[1]},"filtertags":{"logger":["ERROR","INFO"]},"msg":"two\nlines","err":""}` + "\n"))
+	buf := make([]byte, 1<<20)
+	n, err := l.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(buf[:n])
+	for _, want := range []string{"MESSAGE\n\x09\x00\x00\x00\x00\x00\x00\x00two\nlines\n", "PRIORITY=3\n", "SYSLOG_IDENTIFIER=app\n", "FILTERTAGS=ERROR\nFILTERTAGS=INFO\n", "F_9LIVES=2\n", "HOST=h1\n", "NESTED={\"a\":[1]}\n", "SUBSYSTEM=db\n", "X=1\n"} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("no %q in %q", want, got)
+		}
+	}
+	if strings.Contains(got, "ERR=") {
+		t.Fatal("empty err")
+	}
+
+	big := strings.Repeat("x", 4<<20)
+	sink.Write([]byte(`{"msg":"` + big + `"}`))
+	oob := make([]byte, 64)
+	n, oobn, _, _, err := l.ReadMsgUnix(buf, oob)
+	if err != nil || n != 0 {
+		t.Fatal(n, err)
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) != 1 {
+		t.Fatal("no fd passed", err)
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil || len(fds) != 1 {
+		t.Fatal("no fd passed", err)
+	}
+	f := os.NewFile(uintptr(fds[0]), "memfd")
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := make([]byte, 20)
+	f.ReadAt(p, 0)
+	if !strings.HasPrefix(string(p), "MESSAGE="+"xxxx") || st.Size() < 4<<20 {
+		t.Fatalf("got %v bytes: %q", st.Size(), p)
+	}
+	// sealed
+	if _, err := f.WriteAt([]byte("y"), 0); err == nil {
+		t.Fatal("not sealed")
+	}
+	sink.Close()
+}
@@ -0,0 +1,592 @@
+package filtertag
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Timestamp is what Logft() keeps in the "timestamp" field; it's a pointer, updated
+// in place on every line, so that storing it into the Fields doesn't allocate.
+// Encoders render it with the TimestampLayout.
+type Timestamp struct {
+	Time time.Time
+}
+
+func (ts *Timestamp) String() string {
+	return ts.Time.Format(TimestampLayout)
+}
+
+func (ts *Timestamp) MarshalJSON() ([]byte, error) {
+	return ts.AppendJSON(nil), nil
+}
+
+func (ts *Timestamp) AppendJSON(dst []byte) []byte {
+	dst = append(dst, '"')
+	dst = ts.Time.AppendFormat(dst, TimestampLayout)
+	return append(dst, '"')
+}
+
+// Line buffers are pooled: Logft() encodes into one, the logger goroutine puts it back
+// after the Output.Write(). Buffers grown too big by a huge line aren't kept.
+type lineBuffer struct {
+	b []byte
+}
+
+const maxPooledLineBuffer = 64 << 10
+
+var lineBufferPool = sync.Pool{
+	New: func() interface{} {
+		return &lineBuffer{b: make([]byte, 0, 1024)}
+	},
+}
+
+func getLineBuffer() *lineBuffer {
+	return lineBufferPool.Get().(*lineBuffer)
+}
+
+func putLineBuffer(buf *lineBuffer) {
+	if buf == nil || cap(buf.b) > maxPooledLineBuffer {
+		return
+	}
+	buf.b = buf.b[:0]
+	lineBufferPool.Put(buf)
+}
+
+type keyBuffer struct {
+	k []string
+}
+
+var keyBufferPool = sync.Pool{
+	New: func() interface{} {
+		return &keyBuffer{k: make([]string, 0, 16)}
+	},
+}
+
+// Collects the keys of m in the pooled buffer, sorted, except the "timestamp" which
+// always goes first (if present at the top level).
+func sortedKeys(kb *keyBuffer, m map[string]interface{}, timestampFirst bool, line *lineFields) []string {
+	kb.k = kb.k[:0]
+	for k := range m {
+		if line.has(k) {
+			continue
+		}
+		kb.k = append(kb.k, k)
+	}
+	if line.set {
+		kb.k = append(kb.k, "msg")
+		if line.seqKey != "" && line.seqKey != "msg" {
+			kb.k = append(kb.k, line.seqKey)
+		}
+	}
+	keys := kb.k
+	if len(keys) > 32 {
+		sort.Strings(keys)
+	} else {
+		// insertion sort, because sort.Strings() allocates, and there's only a dozen of keys anyway
+		for i := 1; i < len(keys); i++ {
+			for j := i; j > 0 && keys[j] < keys[j-1]; j-- {
+				keys[j], keys[j-1] = keys[j-1], keys[j]
+			}
+		}
+	}
+	if timestampFirst {
+		for i := range keys {
+			if keys[i] == "timestamp" {
+				copy(keys[1:i+1], keys[:i])
+				keys[0] = "timestamp"
+				break
+			}
+		}
+	}
+	return keys
+}
+
+// JSONEncoder is the default encoder. It doesn't use json.Marshal on the Fields, but
+// appends the known types directly, with the keys sorted, and the "timestamp" first.
+// Only the types it doesn't know (structs etc.) are left to encoding/json.
+//
+// In the Safe mode, nothing can fail the line: the values which can't be encoded (NaN and
+// infinities, channels, funcs, cycles, too deep nesting, panicking or failing MarshalJSON()
+// or Error()) are replaced with the placeholders like "!NaN", "!chan", "!cycle", and listed in
+// the "marshalerrors" field. Also, the over-long strings are truncated (MaxStringBytes), and
+// a line which is still too big (MaxBytes) is replaced with the one carrying only the
+// standard fields.
+type JSONEncoder struct {
+	Safe           bool
+	MaxDepth       int // 0 means DefaultMaxDepth, also outside of the Safe mode
+	MaxStringBytes int // 0 means unlimited; Safe mode only
+	MaxBytes       int // 0 means unlimited; Safe mode only
+}
+
+const DefaultMaxDepth = 32
+
+func (enc *JSONEncoder) Encode(dst []byte, fields map[string]interface{}) ([]byte, error) {
+	return enc.encodeLine(dst, fields, lineFields{})
+}
+
+// The fields of a line which Logft() gives the JSONEncoder apart from the Fields: they're
+// appended right into the line, instead of being boxed into the map (which allocates on
+// every line). They take the place of the same keys of the Fields.
+type lineFields struct {
+	set    bool
+	msg    string
+	seqKey string // none if empty
+	seq    uint64
+}
+
+var noLineFields lineFields
+
+func (line *lineFields) has(k string) bool {
+	return line.set && (k == "msg" || k == line.seqKey && k != "")
+}
+
+func (enc *JSONEncoder) encodeLine(dst []byte, fields map[string]interface{}, line lineFields) ([]byte, error) {
+	st := getJSONState(enc)
+	defer putJSONState(st)
+	st.line = line
+
+	start := len(dst)
+	dst, err := st.appendObject(dst, fields, true)
+	if err != nil {
+		return dst[:start], err
+	}
+	if len(st.errs) > 0 {
+		dst = st.appendMarshalErrors(dst[:len(dst)-1], len(fields) > 0 || line.set)
+		dst = append(dst, '}')
+	}
+	if enc.Safe && enc.MaxBytes > 0 && len(dst)-start+1 > enc.MaxBytes {
+		dst = st.appendOversized(dst[:start], fields, len(dst)-start+1)
+	}
+	return append(dst, '\n'), nil
+}
+
+func (st *jsonState) appendMarshalErrors(dst []byte, comma bool) []byte {
+	if comma {
+		dst = append(dst, ',')
+	}
+	dst = append(dst, `"marshalerrors":`...)
+	return appendJSONStrings(dst, st.errs)
+}
+
+// The standard fields that survive in a line over the MaxBytes
+var oversizedKeys = []string{"timestamp", "host", "service", "subsystem", "filtertag", "filtertags", "err", "msg"}
+
+func (st *jsonState) appendOversized(dst []byte, fields map[string]interface{}, size int) []byte {
+	maxBytes := st.enc.MaxBytes
+	maxString := maxBytes / (2 * len(oversizedKeys))
+	if st.enc.MaxStringBytes == 0 || st.enc.MaxStringBytes > maxString {
+		st.enc = &JSONEncoder{Safe: true, MaxDepth: st.enc.MaxDepth, MaxStringBytes: maxString}
+	}
+	st.errs = st.errs[:0]
+	st.key = ""
+
+	dst = append(dst, '{')
+	n := 0
+	for _, k := range oversizedKeys {
+		v, ok := fields[k]
+		if !ok && !st.line.has(k) {
+			continue
+		}
+		if n > 0 {
+			dst = append(dst, ',')
+		}
+		n++
+		dst = appendJSONString(dst, k)
+		dst = append(dst, ':')
+		st.key = k
+		if st.line.has(k) {
+			dst = st.appendLineField(dst, k)
+		} else {
+			dst, _ = st.appendTopValue(dst, v)
+		}
+	}
+	st.errs = append(st.errs, fmt.Sprintf("line of %v bytes exceeds MaxBytes %v, other fields dropped", size, maxBytes))
+	dst = st.appendMarshalErrors(dst, n > 0)
+	return append(dst, '}')
+}
+
+// jsonState is the per-line state of the JSONEncoder, pooled
+type jsonState struct {
+	enc   *JSONEncoder
+	depth int
+	path  []uintptr // maps, slices and pointers being encoded right now, for the cycle detection
+	errs  []string  // what went wrong, in the Safe mode
+	key   string    // the top-level key being encoded, for the errs
+	line  lineFields
+}
+
+var jsonStatePool = sync.Pool{
+	New: func() interface{} {
+		return &jsonState{}
+	},
+}
+
+func getJSONState(enc *JSONEncoder) *jsonState {
+	st := jsonStatePool.Get().(*jsonState)
+	st.enc = enc
+	return st
+}
+
+func putJSONState(st *jsonState) {
+	st.enc = nil
+	st.depth = 0
+	st.path = st.path[:0]
+	st.errs = st.errs[:0]
+	st.key = ""
+	st.line = lineFields{}
+	jsonStatePool.Put(st)
+}
+
+func (st *jsonState) maxDepth() int {
+	if st.enc.MaxDepth > 0 {
+		return st.enc.MaxDepth
+	}
+	return DefaultMaxDepth
+}
+
+// Outside of the Safe mode the err fails the line; in the Safe mode, the placeholder
+// is written instead of the value, and the err is remembered for the "marshalerrors".
+func (st *jsonState) fail(dst []byte, placeholder string, err error) ([]byte, error) {
+	if !st.enc.Safe {
+		return dst, err
+	}
+	if st.key != "" {
+		st.errs = append(st.errs, st.key+": "+err.Error())
+	} else {
+		st.errs = append(st.errs, err.Error())
+	}
+	dst = append(dst, '"', '!')
+	dst = append(dst, placeholder...)
+	return append(dst, '"'), nil
+}
+
+// Pushes the container onto the path; fails on a cycle, or if nested too deep
+func (st *jsonState) enter(ptr uintptr) error {
+	if st.depth >= st.maxDepth() {
+		return fmt.Errorf("nesting deeper than %v", st.maxDepth())
+	}
+	if ptr != 0 {
+		for _, p := range st.path {
+			if p == ptr {
+				return errCycle
+			}
+		}
+	}
+	st.depth++
+	st.path = append(st.path, ptr)
+	return nil
+}
+
+func (st *jsonState) leave() {
+	st.depth--
+	st.path = st.path[:len(st.path)-1]
+}
+
+var errCycle = fmt.Errorf("cycle detected")
+
+func (st *jsonState) enterFailed(dst []byte, err error) ([]byte, error) {
+	if err == errCycle {
+		return st.fail(dst, "cycle", err)
+	}
+	return st.fail(dst, "maxdepth", err)
+}
+
+func (st *jsonState) appendObject(dst []byte, m map[string]interface{}, top bool) ([]byte, error) {
+	if !top {
+		if err := st.enter(reflect.ValueOf(m).Pointer()); err != nil {
+			return st.enterFailed(dst, err)
+		}
+		defer st.leave()
+	}
+
+	kb := keyBufferPool.Get().(*keyBuffer)
+	defer keyBufferPool.Put(kb)
+
+	var err error
+	dst = append(dst, '{')
+	line := &st.line
+	if !top {
+		line = &noLineFields
+	}
+	for i, k := range sortedKeys(kb, m, top, line) {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = appendJSONString(dst, k)
+		dst = append(dst, ':')
+		if top {
+			st.key = k
+			if line.has(k) {
+				dst = st.appendLineField(dst, k)
+				continue
+			}
+			dst, err = st.appendTopValue(dst, m[k])
+		} else {
+			dst, err = st.appendValue(dst, m[k])
+		}
+		if err != nil {
+			return dst, err
+		}
+	}
+	return append(dst, '}'), nil
+}
+
+// The value of the line's own field k, see lineFields
+func (st *jsonState) appendLineField(dst []byte, k string) []byte {
+	if k == "msg" {
+		return st.appendString(dst, st.line.msg)
+	}
+	return strconv.AppendUint(dst, st.line.seq, 10)
+}
+
+// In the Safe mode, a panic while encoding the value (e.g. in the MarshalJSON() or Error()
+// of a nil pointer) is turned into a placeholder.
+func (st *jsonState) appendTopValue(dst []byte, v interface{}) (out []byte, err error) {
+	if !st.enc.Safe {
+		return st.appendValue(dst, v)
+	}
+	mark, depth, pathLen := len(dst), st.depth, len(st.path)
+	defer func() {
+		if errrec := recover(); errrec != nil {
+			st.depth, st.path = depth, st.path[:pathLen]
+			out, err = st.fail(dst[:mark], "panic", fmt.Errorf("panicked: %v", errrec))
+		}
+	}()
+	return st.appendValue(dst, v)
+}
+
+func (st *jsonState) appendValue(dst []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(dst, "null"...), nil
+	case string:
+		return st.appendString(dst, v), nil
+	case *Timestamp:
+		if v == nil {
+			return append(dst, "null"...), nil
+		}
+		return v.AppendJSON(dst), nil
+	case bool:
+		return strconv.AppendBool(dst, v), nil
+	case int:
+		return strconv.AppendInt(dst, int64(v), 10), nil
+	case int8:
+		return strconv.AppendInt(dst, int64(v), 10), nil
+	case int16:
+		return strconv.AppendInt(dst, int64(v), 10), nil
+	case int32:
+		return strconv.AppendInt(dst, int64(v), 10), nil
+	case int64:
+		return strconv.AppendInt(dst, v, 10), nil
+	case uint:
+		return strconv.AppendUint(dst, uint64(v), 10), nil
+	case uint8:
+		return strconv.AppendUint(dst, uint64(v), 10), nil
+	case uint16:
+		return strconv.AppendUint(dst, uint64(v), 10), nil
+	case uint32:
+		return strconv.AppendUint(dst, uint64(v), 10), nil
+	case uint64:
+		return strconv.AppendUint(dst, v, 10), nil
+	case float32:
+		return st.appendFloat(dst, float64(v), 32)
+	case float64:
+		return st.appendFloat(dst, v, 64)
+	case time.Duration:
+		// nanoseconds, same as json.Marshal does it
+		return strconv.AppendInt(dst, int64(v), 10), nil
+	case time.Time:
+		dst = append(dst, '"')
+		dst = v.AppendFormat(dst, time.RFC3339Nano)
+		return append(dst, '"'), nil
+	case LazyValue:
+		return st.appendValue(dst, v.Value())
+	case json.RawMessage:
+		return st.appendRaw(dst, v)
+	case *json.RawMessage:
+		if v == nil {
+			return append(dst, "null"...), nil
+		}
+		return st.appendRaw(dst, *v)
+	case error:
+		return st.appendString(dst, v.Error()), nil
+	case []string:
+		return appendJSONStrings(dst, v), nil
+	case map[string][]string:
+		if v == nil {
+			return append(dst, "null"...), nil
+		}
+		return appendJSONStringsMap(dst, v), nil
+	case map[string]interface{}:
+		if v == nil {
+			return append(dst, "null"...), nil
+		}
+		return st.appendObject(dst, v, false)
+	case []interface{}:
+		if v == nil {
+			return append(dst, "null"...), nil
+		}
+		if err := st.enter(reflect.ValueOf(v).Pointer()); err != nil {
+			return st.enterFailed(dst, err)
+		}
+		defer st.leave()
+		var err error
+		dst = append(dst, '[')
+		for i := range v {
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			dst, err = st.appendValue(dst, v[i])
+			if err != nil {
+				return dst, err
+			}
+		}
+		return append(dst, ']'), nil
+	}
+
+	// the rest (structs, json.Marshaler-s, typed maps and slices) is left to encoding/json,
+	// and if that fails in the Safe mode, it's walked by reflection, with the placeholders
+	b, err := json.Marshal(v)
+	if err == nil {
+		return append(dst, b...), nil
+	}
+	if !st.enc.Safe {
+		return dst, err
+	}
+	return st.appendReflect(dst, reflect.ValueOf(v))
+}
+
+func (st *jsonState) appendString(dst []byte, s string) []byte {
+	max := st.enc.MaxStringBytes
+	if !st.enc.Safe || max <= 0 || len(s) <= max {
+		return appendJSONString(dst, s)
+	}
+	cut := max
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	st.errs = append(st.errs, fmt.Sprintf("%v: string truncated from %v bytes", st.key, len(s)))
+	return appendJSONString(dst, s[:cut]+"...")
+}
+
+func (st *jsonState) appendFloat(dst []byte, f float64, bits int) ([]byte, error) {
+	switch {
+	case math.IsNaN(f):
+		return st.fail(dst, "NaN", fmt.Errorf("unsupported value: NaN"))
+	case math.IsInf(f, 1):
+		return st.fail(dst, "+Inf", fmt.Errorf("unsupported value: +Inf"))
+	case math.IsInf(f, -1):
+		return st.fail(dst, "-Inf", fmt.Errorf("unsupported value: -Inf"))
+	}
+	return appendJSONFloat(dst, f, bits), nil
+}
+
+func (st *jsonState) appendRaw(dst []byte, raw []byte) ([]byte, error) {
+	if len(raw) > 0 && !json.Valid(raw) {
+		return st.fail(dst, "invalidjson", fmt.Errorf("invalid json.RawMessage"))
+	}
+	return appendCompactJSON(dst, raw), nil
+}
+
+func appendJSONStringsMap(dst []byte, m map[string][]string) []byte {
+	// the filtertags map has usually a single key, no need to sort that
+	if len(m) == 1 {
+		for k, v := range m {
+			dst = append(dst, '{')
+			dst = appendJSONString(dst, k)
+			dst = append(dst, ':')
+			dst = appendJSONStrings(dst, v)
+			return append(dst, '}')
+		}
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	dst = append(dst, '{')
+	for i, k := range keys {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = appendJSONString(dst, k)
+		dst = append(dst, ':')
+		dst = appendJSONStrings(dst, m[k])
+	}
+	return append(dst, '}')
+}
+
+func appendJSONStrings(dst []byte, a []string) []byte {
+	if a == nil {
+		return append(dst, "null"...)
+	}
+	dst = append(dst, '[')
+	for i := range a {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = appendJSONString(dst, a[i])
+	}
+	return append(dst, ']')
+}
+
+// Floats are formatted the same way as encoding/json does it; NaN and infinities
+// must be sorted out by the caller.
+func appendJSONFloat(dst []byte, f float64, bits int) []byte {
+	abs := math.Abs(f)
+	format := byte('f')
+	if abs != 0 {
+		if bits == 64 && (abs < 1e-6 || abs >= 1e21) || bits == 32 && (float32(abs) < 1e-6 || float32(abs) >= 1e21) {
+			format = 'e'
+		}
+	}
+	dst = strconv.AppendFloat(dst, f, format, -1, bits)
+	if format == 'e' {
+		// clean up e-09 to e-9
+		n := len(dst)
+		if n >= 4 && dst[n-4] == 'e' && dst[n-3] == '-' && dst[n-2] == '0' {
+			dst[n-2] = dst[n-1]
+			dst = dst[:n-1]
+		}
+	}
+	return dst
+}
+
+// Appends the (already validated) raw JSON without the insignificant whitespace,
+// because a newline inside would break the line framing.
+func appendCompactJSON(dst []byte, raw []byte) []byte {
+	if len(raw) == 0 {
+		return append(dst, "null"...)
+	}
+	inString := false
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		if inString {
+			dst = append(dst, c)
+			switch c {
+			case '\\':
+				i++
+				dst = append(dst, raw[i])
+			case '"':
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case ' ', '\t', '\n', '\r':
+		case '"':
+			inString = true
+			dst = append(dst, c)
+		default:
+			dst = append(dst, c)
+		}
+	}
+	return dst
+}
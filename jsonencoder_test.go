@@ -0,0 +1,88 @@
+package filtertag
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONEncoderMatchesMarshal(t *testing.T) {
+	fields := map[string]interface{}{
+		"timestamp":  "2021-01-01",
+		"host":       "h",
+		"filtertag":  nil,
+		"msg":        "hello world",
+		"filtertags": map[string][]string{"logger": {"INFO", "L3"}},
+		"neg":        -100000,
+		"big":        uint64(1) << 63,
+		"f":          1.5,
+		"small":      1e-9,
+		"e":          errors.New("boom"),
+		"t":          time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC),
+		"ctl":        "a\x01b <>&\xff",
+		"st":         struct{ A int }{3},
+	}
+	got, err := (&JSONEncoder{}).Encode(nil, fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(got, []byte(`{"timestamp":`)) || !bytes.HasSuffix(got, []byte("}\n")) {
+		t.Fatalf("got %s", got)
+	}
+
+	fields["e"] = "boom"
+	want, _ := json.Marshal(fields)
+	var a, b interface{}
+	if err := json.Unmarshal(got, &a); err != nil {
+		t.Fatalf("bad line %s: %v", got, err)
+	}
+	json.Unmarshal(want, &b)
+	aj, _ := json.Marshal(a)
+	bj, _ := json.Marshal(b)
+	if !bytes.Equal(aj, bj) {
+		t.Fatalf("got\n%s\nwant\n%s", aj, bj)
+	}
+}
+
+// The msg and the sequence number go right into the line, not into the Fields
+func TestJSONEncoderLineFields(t *testing.T) {
+	fields := map[string]interface{}{"timestamp": "t", "msg": "", "seq": "stale", "a": 1, "z": 2}
+	got, err := (&JSONEncoder{}).encodeLine(nil, fields, lineFields{set: true, msg: "hello", seqKey: "seq", seq: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"timestamp":"t","a":1,"msg":"hello","seq":7,"z":2}` + "\n"; string(got) != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	// a line over the MaxBytes keeps the msg
+	fields["long"] = strings.Repeat("x", 1000)
+	got, _ = (&JSONEncoder{Safe: true, MaxBytes: 200}).encodeLine(nil, fields, lineFields{set: true, msg: "hello"})
+	var line map[string]interface{}
+	if err := json.Unmarshal(got, &line); err != nil || line["msg"] != "hello" || line["long"] != nil {
+		t.Errorf("got %s (%v)", got, err)
+	}
+}
+
+var raceEnabled bool
+
+func TestLogftAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the sync.Pool allocates under the race detector")
+	}
+	entry := testEntry()
+	tags := []string{"INFO"}
+	allocs := testing.AllocsPerRun(100, func() {
+		entry.Logft(tags, "hello")
+		(<-entry.LoggerCh).release()
+	})
+	if allocs != 0 {
+		t.Errorf("Logft() allocates %v times per line", allocs)
+	}
+	if entry.Fields["msg"] != "" {
+		t.Errorf("the msg was left in the Fields: %q", entry.Fields["msg"])
+	}
+}
@@ -0,0 +1,224 @@
+package filtertag
+
+import (
+	"sync/atomic"
+)
+
+// The priority of a line, by its filtertags; see LanesConfig
+const (
+	Priority_Low    int = iota - 1 // drained only when the other lanes are empty
+	Priority_Normal                // the lines with none of their tags in the Priorities map
+	Priority_High                  // drained first, and never spilled (see the Logger.Spill)
+)
+
+// What a logging call does when its lane is full
+const (
+	LaneOverflow_Block      int = iota // the caller waits; the OverflowFunc is called when the lane gets full
+	LaneOverflow_DropNewest            // the new line is dropped
+	LaneOverflow_DropOldest            // the oldest line of the lane is dropped, for the new one
+)
+
+type LaneConfig struct {
+	Size     int // in lines, 500 if zero
+	Overflow int // one of the LaneOverflow_...
+}
+
+type LanesConfig struct {
+	// The priority of a line is the highest one of its filtertags (uppercase) which are here;
+	// Priority_Normal if there are none
+	Priorities map[string]int
+
+	High   LaneConfig
+	Normal LaneConfig
+	Low    LaneConfig
+}
+
+// DefaultLanesConfig puts the lines which must get through (WAKEMEINTHEMIDDLEOFTHENIGHT,
+// EXITFUNC, the FATAL and the like) in the High lane, and the TRACE and DEBUG ones in the
+// Low lane, which drops its oldest lines when full.
+func DefaultLanesConfig() LanesConfig {
+	return LanesConfig{
+		Priorities: map[string]int{
+			"WAKEMEINTHEMIDDLEOFTHENIGHT": Priority_High,
+			"EXITFUNC":                    Priority_High,
+			"FATAL":                       Priority_High,
+			"PANIC":                       Priority_High,
+			"EMERGENCY":                   Priority_High,
+			"ALERT":                       Priority_High,
+			"CRITICAL":                    Priority_High,
+			"TRACE":                       Priority_Low,
+			"DEBUG":                       Priority_Low,
+		},
+		Low: LaneConfig{Overflow: LaneOverflow_DropOldest},
+	}
+}
+
+// LaneStats counts the lines dropped by the lanes' overflow policies (the OverflowFunc
+// isn't called for these)
+type LaneStats struct {
+	DroppedHigh   uint64
+	DroppedNormal uint64
+	DroppedLow    uint64
+}
+
+type lanes struct {
+	priorities map[string]int
+	high       *lane
+	normal     *lane
+	low        *lane
+}
+
+type lane struct {
+	dropped  uint64 // atomic, first for the 64-bit alignment
+	blocked  uint32 // atomic, see sendMsg
+	ch       chan *LoggerChType
+	size     int
+	overflow int
+}
+
+func makeLanes(config LanesConfig) *lanes {
+	priorities := make(map[string]int, len(config.Priorities))
+	for tag, p := range config.Priorities {
+		priorities[tag] = p
+	}
+	return &lanes{
+		priorities: priorities,
+		high:       makeLane(config.High),
+		normal:     makeLane(config.Normal),
+		low:        makeLane(config.Low),
+	}
+}
+
+func makeLane(config LaneConfig) *lane {
+	if config.Size <= 0 {
+		config.Size = 500
+	}
+	return &lane{
+		ch:       make(chan *LoggerChType, config.Size+2),
+		size:     config.Size,
+		overflow: config.Overflow,
+	}
+}
+
+// The highest priority of the tags which are in the priorities; the tags which aren't there
+// count for nothing, not for the Priority_Normal. So with the DefaultLanesConfig a line
+// tagged DEBUG and ERROR goes to the Low lane (the ERROR isn't in it), and may be dropped
+// with the TRACE flood; put such tags in the Priorities to keep them out of the Low lane.
+func (l *lanes) pick(filtertags []string) *lane {
+	priority, found := Priority_Normal, false
+	for _, tag := range filtertags {
+		if p, ok := l.priorities[tag]; ok && (!found || p > priority) {
+			priority, found = p, true
+		}
+	}
+	switch {
+	case priority >= Priority_High:
+		return l.high
+	case priority <= Priority_Low:
+		return l.low
+	default:
+		return l.normal
+	}
+}
+
+// The lines the overflow policy drops are counted by the lane, they're not the caller's
+// dropped calls; so it's false only for the LaneOverflow_Block, see sendMsg
+func (l *lane) send(msg *LoggerChType, done <-chan struct{}) bool {
+	switch l.overflow {
+	case LaneOverflow_DropNewest:
+		select {
+		case l.ch <- msg:
+		default:
+			atomic.AddUint64(&l.dropped, 1)
+			msg.release()
+		}
+	case LaneOverflow_DropOldest:
+		for {
+			select {
+			case l.ch <- msg:
+				return true
+			default:
+			}
+			// the lanes carry just the lines, the commands go by the LoggerCh
+			select {
+			case old := <-l.ch:
+				atomic.AddUint64(&l.dropped, 1)
+				old.release()
+			default:
+			}
+		}
+	default:
+		return sendMsg(l.ch, msg, done, &l.blocked)
+	}
+	return true
+}
+
+// A nil lane (there are no lanes set) has a nil channel, which the select never picks
+func (l *lane) channel() chan *LoggerChType {
+	if l == nil {
+		return nil
+	}
+	return l.ch
+}
+
+// SetLanes splits the lines of the entry (and of its Copy()s made after this) into the
+// lanes by their priority: the logger goroutine writes the High lane's lines first, then
+// the Normal ones (and the LoggerCh, which still carries the commands and the lines of the
+// entries without the lanes), and the Low ones only when there's nothing else; each lane
+// has an overflow policy of its own. So a flood of TRACE lines can't hold up, or get the
+// process killed before, a WAKEMEINTHEMIDDLEOFTHENIGHT one.
+//
+// Call it once, right after the MakePrimordialEntryWithLogger(), before the logging starts.
+func (entry *Entry) SetLanes(config LanesConfig) {
+	entry.lanes = makeLanes(config)
+	entry.LoggerCh <- &LoggerChType{Command: Cmd_SetLanes, lanes: entry.lanes}
+}
+
+// LaneStats returns the counts of the lines dropped by the lanes; zero if there are no lanes
+func (entry *Entry) LaneStats() LaneStats {
+	if entry.lanes == nil {
+		return LaneStats{}
+	}
+	return LaneStats{
+		DroppedHigh:   atomic.LoadUint64(&entry.lanes.high.dropped),
+		DroppedNormal: atomic.LoadUint64(&entry.lanes.normal.dropped),
+		DroppedLow:    atomic.LoadUint64(&entry.lanes.low.dropped),
+	}
+}
+
+// Sends the line to the pipeline, if there's one, or to its lane, or to the LoggerCh when
+// there are no lanes; see sendMsg for the done
+func (entry *Entry) sendLine(msg *LoggerChType, filtertags []string, done <-chan struct{}) bool {
+	if entry.pipeline != nil {
+		return entry.pipeline.push(entry.shard, msg, done)
+	}
+	if entry.lanes == nil {
+		return sendMsg(entry.LoggerCh, msg, done, entry.blockedCalls)
+	}
+	return entry.lanes.pick(filtertags).send(msg, done)
+}
+
+// Sends the msg, waiting for the room in the ch until the done is closed (a nil done waits
+// for as long as it takes, the closedChan doesn't wait at all); the msg not sent is released,
+// and false returned. A wait for as long as it takes is counted in the blocked (if not nil),
+// the logger goroutine calls the OverflowFunc only when somebody was held so; the TryLogft
+// and LogftCtx callers which give up on the full channel aren't, see the DroppedCalls.
+func sendMsg(ch chan *LoggerChType, msg *LoggerChType, done <-chan struct{}, blocked *uint32) bool {
+	select {
+	case ch <- msg:
+		return true
+	default:
+	}
+	if done == nil && blocked != nil {
+		atomic.AddUint32(blocked, 1)
+	}
+	if done != closedChan {
+		select {
+		case ch <- msg:
+			return true
+		case <-done:
+		}
+	}
+	msg.release()
+	return false
+}
@@ -0,0 +1,141 @@
+package filtertag
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The High lines go ahead of the Normal ones, and the Low flood only gets what's left of
+// its lane, the oldest lines dropped
+func TestLanesPriority(t *testing.T) {
+	cfg := DefaultLanesConfig()
+	cfg.Low.Size = 5
+	tl := makeTestLogger(t, &cfg)
+	entry := tl.entry
+	tl.holdOutput()
+
+	for i := 0; i < 20; i++ {
+		entry.Copy().Trace("trace")
+	}
+	entry.Info("info1")
+	entry.WakeMeInTheMiddleOfTheNight("wake")
+	entry.Info("info2")
+	close(tl.w.gate)
+
+	want := "first,wake,info1,info2,trace,trace,trace,trace,trace,trace,trace"
+	waitFor(t, "lines", func() bool { return len(tl.w.lines()) >= 11 })
+	if got := strings.Join(tl.w.lines(), ","); got != want {
+		t.Fatalf("got %v", got)
+	}
+	if st := entry.LaneStats(); st != (LaneStats{DroppedLow: 13}) {
+		t.Fatalf("got %+v", st)
+	}
+	if entry.DroppedCalls() != 0 || atomic.LoadInt32(&tl.overflows) != 0 {
+		t.Fatalf("%v dropped calls, %v overflows", entry.DroppedCalls(), atomic.LoadInt32(&tl.overflows))
+	}
+	// the tags not in the Priorities don't count, see the pick
+	if entry.lanes.pick([]string{"DEBUG", "ERROR"}) != entry.lanes.low || entry.lanes.pick([]string{"DEBUG", "FATAL"}) != entry.lanes.high {
+		t.Fatal("wrong lane")
+	}
+}
+
+// A DropNewest lane keeps the lines it has, and counts the new ones dropped
+func TestLanesDropNewest(t *testing.T) {
+	cfg := DefaultLanesConfig()
+	cfg.Normal = LaneConfig{Size: 3, Overflow: LaneOverflow_DropNewest}
+	tl := makeTestLogger(t, &cfg)
+	entry := tl.entry
+	tl.holdOutput()
+
+	for _, msg := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		if !entry.TryLogft([]string{"INFO"}, msg) {
+			t.Fatal("the lane drops by its policy")
+		}
+	}
+	close(tl.w.gate)
+	waitFor(t, "lines", func() bool { return len(tl.w.lines()) >= 6 })
+	time.Sleep(20 * time.Millisecond)
+	if got := strings.Join(tl.w.lines(), ","); got != "first,a,b,c,d,e" {
+		t.Fatalf("got %v", got)
+	}
+	if st := entry.LaneStats(); st != (LaneStats{DroppedNormal: 3}) {
+		t.Fatalf("got %+v", st)
+	}
+	if entry.DroppedCalls() != 0 || atomic.LoadInt32(&tl.overflows) != 0 {
+		t.Fatalf("%v dropped calls, %v overflows", entry.DroppedCalls(), atomic.LoadInt32(&tl.overflows))
+	}
+}
+
+// A Block lane holds the caller when full, and that's the overflow
+func TestLanesBlockOverflow(t *testing.T) {
+	cfg := DefaultLanesConfig()
+	cfg.High.Size = 3
+	tl := makeTestLogger(t, &cfg)
+	entry := tl.entry
+	tl.holdOutput()
+
+	for entry.TryLogft([]string{"ALERT"}, "fill") {
+	}
+	done := make(chan struct{})
+	go func() {
+		entry.Copy().WakeMeInTheMiddleOfTheNight("blocked")
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("not held by the full lane")
+	default:
+	}
+	close(tl.w.gate)
+	<-done
+	waitFor(t, "OverflowFunc", func() bool { return atomic.LoadInt32(&tl.overflows) > 0 })
+	waitFor(t, "the held line", func() bool {
+		lines := tl.w.lines()
+		return lines[len(lines)-1] == "blocked"
+	})
+	if st := entry.LaneStats(); st != (LaneStats{}) {
+		t.Fatalf("got %+v", st)
+	}
+}
+
+// The lines still in the lanes are written before the new lanes are set
+func TestLanesSetLanesDrain(t *testing.T) {
+	cfg := DefaultLanesConfig()
+	tl := makeTestLogger(t, &cfg)
+	entry := tl.entry
+	tl.holdOutput()
+
+	entry.Trace("t1")
+	entry.Debug("t2")
+	entry.SetLanes(DefaultLanesConfig())
+	entry.Info("after")
+	close(tl.w.gate)
+
+	waitFor(t, "lines", func() bool { return len(tl.w.lines()) >= 4 })
+	if got := strings.Join(tl.w.lines(), ","); got != "first,t1,t2,after" {
+		t.Fatalf("got %v", got)
+	}
+}
+
+// The EXITFUNC line goes by the High lane, the ExitFunc command by the LoggerCh; the line is
+// written before the ExitFunc is called, every time
+func TestLanesExitDrain(t *testing.T) {
+	cfg := DefaultLanesConfig()
+	tl := makeTestLogger(t, &cfg)
+	exited := make(chan int, 1)
+	logger := tl.entry.GetLogger()
+	logger.ExitFunc = func(code int) { exited <- code }
+	tl.entry.SetLogger(logger)
+	close(tl.w.gate)
+
+	for i := 0; i < 50; i++ {
+		tl.entry.ExitFunc("bye")
+		<-exited
+		if n := len(tl.w.lines()); n != i+1 {
+			t.Fatalf("%v: %v lines", i, n)
+		}
+	}
+}
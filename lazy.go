@@ -0,0 +1,61 @@
+package filtertag
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// LazyValue is a field value which is costly to compute (dumping a request body, summarizing
+// a cache etc.). It can go into the Entry.Fields, or via Lazy() into the Event/LogFields, and
+// it's only called by the encoder, i.e. once the line has passed the Filter, and for every
+// line anew. A panic inside is recovered, and the field shows it as an error instead.
+type LazyValue func() interface{}
+
+func Lazy(key string, val func() interface{}) Field {
+	return Any(key, LazyValue(val))
+}
+
+func (ev *Event) Lazy(key string, val func() interface{}) *Event {
+	return ev.Fields(Lazy(key, val))
+}
+
+// How many LazyValues in a row a Value resolves, when one returns another; a longer chain
+// (a loop, likely) gives an error value
+const maxLazyDepth = 4
+
+var errLazyTooDeep = fmt.Errorf("lazy value returned the LazyValues more than %v deep", maxLazyDepth)
+
+// Value calls the function, recovering a panic into an error value
+func (lv LazyValue) Value() (v interface{}) {
+	if lv == nil {
+		return nil
+	}
+	defer func() {
+		if errrec := recover(); errrec != nil {
+			v = fmt.Errorf("lazy value panicked: %v", errrec)
+		}
+	}()
+	v = lv()
+	for depth := 1; ; depth++ {
+		next, ok := v.(LazyValue)
+		if !ok {
+			return v
+		}
+		if depth >= maxLazyDepth {
+			return errLazyTooDeep
+		}
+		if next == nil {
+			return nil
+		}
+		v = next()
+	}
+}
+
+// For the encoders which go through encoding/json
+func (lv LazyValue) MarshalJSON() ([]byte, error) {
+	v := lv.Value()
+	if err, ok := v.(error); ok {
+		return json.Marshal(err.Error())
+	}
+	return json.Marshal(v)
+}
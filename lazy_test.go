@@ -0,0 +1,45 @@
+package filtertag
+
+import (
+	"strings"
+	"testing"
+)
+
+// The LazyValue is called only for the lines which pass the Filter, a panic inside is the
+// field's error
+func TestLazy(t *testing.T) {
+	entry := testEntry()
+	entry.Filter = AnyOf("INFO")
+	calls := 0
+	entry.Event("TRACE").Lazy("x", func() interface{} { calls++; return 1 }).Msg("no")
+	entry.Event("INFO").Lazy("n", func() interface{} { calls += 10; return calls }).Lazy("bad", func() interface{} { panic("boom") }).Msg("yes")
+	fields := readLine(t, entry)
+	if calls != 10 || fields["n"] != 10.0 || fields["msg"] != "yes" || !strings.Contains(fields["bad"].(string), "boom") {
+		t.Fatalf("got %v calls, the line %v", calls, fields)
+	}
+}
+
+// A LazyValue returning another one is resolved, a loop of them isn't followed forever
+func TestLazyDepth(t *testing.T) {
+	var loop LazyValue
+	loop = func() interface{} { return loop }
+	chain := LazyValue(func() interface{} {
+		return LazyValue(func() interface{} { return "x" })
+	})
+	if v := chain.Value(); v != "x" {
+		t.Fatalf("got %v", v)
+	}
+	if v := loop.Value(); v != errLazyTooDeep {
+		t.Fatalf("got %v", v)
+	}
+	fields := map[string]interface{}{"loop": loop, "chain": chain}
+	for _, enc := range []Encoder{&JSONEncoder{}, &LogfmtEncoder{}, &CBOREncoder{}, &MsgpackEncoder{}} {
+		line, err := enc.Encode(nil, fields)
+		if err != nil {
+			t.Fatalf("%T: %v", enc, err)
+		}
+		if !strings.Contains(string(line), errLazyTooDeep.Error()) {
+			t.Fatalf("%T: no error in %q", enc, line)
+		}
+	}
+}
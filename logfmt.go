@@ -0,0 +1,323 @@
+package filtertag
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// LogfmtEncoder renders the Fields as logfmt (key=value pairs, sorted by key).
+// Arrays of scalars become comma-joined values (that's how the filtertags end up as
+// filtertags.logger=INFO,L3), and nested maps/structs/JSON are flattened with dotted keys.
+// The values are quoted when needed; the keys can't be, so a space, '=', '"' or a control
+// character in a key is replaced with '_'.
+type LogfmtEncoder struct{}
+
+func (enc *LogfmtEncoder) Encode(dst []byte, fields map[string]interface{}) ([]byte, error) {
+	start := len(dst)
+	var err error
+	dst, err = appendLogfmtMap(dst, "", fields, start, 0)
+	if err != nil {
+		return dst[:start], err
+	}
+	dst = append(dst, '\n')
+	return dst, nil
+}
+
+func appendLogfmtMap(dst []byte, prefix string, m map[string]interface{}, start int, depth int) ([]byte, error) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var err error
+	for _, k := range keys {
+		dst, err = appendLogfmtValue(dst, prefix+k, m[k], start, depth+1)
+		if err != nil {
+			return dst, err
+		}
+	}
+	return dst, nil
+}
+
+func appendLogfmtValue(dst []byte, key string, v interface{}, start int, depth int) ([]byte, error) {
+	if depth > DefaultMaxDepth {
+		return dst, errTooDeep
+	}
+	switch v := v.(type) {
+	case nil:
+		return appendLogfmtPair(dst, key, "", start), nil
+	case string:
+		return appendLogfmtPair(dst, key, v, start), nil
+	case LazyValue:
+		return appendLogfmtValue(dst, key, v.Value(), start, depth)
+	case json.RawMessage:
+		return appendLogfmtJSON(dst, key, v, start, depth)
+	case *json.RawMessage:
+		if v == nil {
+			return appendLogfmtPair(dst, key, "", start), nil
+		}
+		return appendLogfmtJSON(dst, key, *v, start, depth)
+	case []byte:
+		return appendLogfmtPair(dst, key, string(v), start), nil
+	case bool:
+		return appendLogfmtPair(dst, key, strconv.FormatBool(v), start), nil
+	case int:
+		return appendLogfmtPair(dst, key, strconv.Itoa(v), start), nil
+	case int64:
+		return appendLogfmtPair(dst, key, strconv.FormatInt(v, 10), start), nil
+	case float64:
+		return appendLogfmtPair(dst, key, strconv.FormatFloat(v, 'g', -1, 64), start), nil
+	case error:
+		return appendLogfmtPair(dst, key, v.Error(), start), nil
+	case fmt.Stringer:
+		return appendLogfmtPair(dst, key, v.String(), start), nil
+	case []string:
+		return appendLogfmtPair(dst, key, strings.Join(v, ","), start), nil
+	case map[string][]string:
+		m := make(map[string]interface{}, len(v))
+		for k, vv := range v {
+			m[k] = vv
+		}
+		return appendLogfmtMap(dst, key+".", m, start, depth)
+	case map[string]interface{}:
+		return appendLogfmtMap(dst, key+".", v, start, depth)
+	case []interface{}:
+		if isScalarSlice(v) {
+			parts := make([]string, len(v))
+			for i := range v {
+				parts[i] = fmt.Sprint(v[i])
+			}
+			return appendLogfmtPair(dst, key, strings.Join(parts, ","), start), nil
+		}
+		var err error
+		for i := range v {
+			dst, err = appendLogfmtValue(dst, key+"."+strconv.Itoa(i), v[i], start, depth+1)
+			if err != nil {
+				return dst, err
+			}
+		}
+		return dst, nil
+	}
+
+	// anything else (structs, typed maps and slices) goes through its JSON form
+	b, err := json.Marshal(v)
+	if err != nil {
+		return dst, err
+	}
+	return appendLogfmtJSON(dst, key, b, start, depth)
+}
+
+func appendLogfmtJSON(dst []byte, key string, raw []byte, start int, depth int) ([]byte, error) {
+	var v interface{}
+	if err := unmarshalUseNumber(raw, &v); err != nil {
+		return dst, err
+	}
+	if n, ok := v.(json.Number); ok {
+		return appendLogfmtPair(dst, key, n.String(), start), nil
+	}
+	return appendLogfmtValue(dst, key, v, start, depth)
+}
+
+func isScalarSlice(v []interface{}) bool {
+	for i := range v {
+		switch v[i].(type) {
+		case string, bool, float64, json.Number, nil:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func appendLogfmtPair(dst []byte, key, value string, start int) []byte {
+	if len(dst) > start {
+		dst = append(dst, ' ')
+	}
+	dst = appendLogfmtKey(dst, key)
+	dst = append(dst, '=')
+	if !logfmtNeedsQuote(value) {
+		return append(dst, value...)
+	}
+	return strconv.AppendQuote(dst, value)
+}
+
+// The key as it is when it parses back as one, otherwise with the bad characters
+// replaced with '_'
+func appendLogfmtKey(dst []byte, key string) []byte {
+	if !logfmtBadKey(key) {
+		return append(dst, key...)
+	}
+	for i := 0; i < len(key); {
+		r, size := utf8.DecodeRuneInString(key[i:])
+		if r == utf8.RuneError || r <= ' ' || r == '=' || r == '"' || r == 0x7f {
+			dst = append(dst, '_')
+		} else {
+			dst = append(dst, key[i:i+size]...)
+		}
+		i += size
+	}
+	return dst
+}
+
+func logfmtBadKey(s string) bool {
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError || r <= ' ' || r == '=' || r == '"' || r == 0x7f {
+			return true
+		}
+		i += size
+	}
+	return false
+}
+
+func logfmtNeedsQuote(s string) bool {
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError || r <= ' ' || r == '=' || r == '"' || r == '\\' || r == 0x7f {
+			return true
+		}
+		i += size
+	}
+	return false
+}
+
+// LogfmtDecoder parses logfmt lines back into Fields. Dotted keys are folded back into
+// nested maps (unless that clashes with an existing plain key), and the filtertags are
+// split back into string arrays. All the other values stay strings, since logfmt is untyped.
+type LogfmtDecoder struct{}
+
+func (dec *LogfmtDecoder) Decode(line []byte) (fields map[string]interface{}, err error) {
+	pairs, err := ParseLogfmt(line)
+	if err != nil {
+		return nil, err
+	}
+
+	fields = make(map[string]interface{}, len(pairs))
+	var dotted []string
+	for i := range pairs {
+		if strings.Contains(pairs[i].Key, ".") {
+			dotted = append(dotted, pairs[i].Key)
+			continue
+		}
+		fields[pairs[i].Key] = pairs[i].Value
+	}
+	values := make(map[string]string, len(pairs))
+	for i := range pairs {
+		values[pairs[i].Key] = pairs[i].Value
+	}
+
+	for _, key := range dotted {
+		path := strings.Split(key, ".")
+		if path[0] == "filtertags" && len(path) == 2 {
+			ft, _ := fields["filtertags"].(map[string][]string)
+			if ft == nil {
+				if _, clash := fields["filtertags"]; clash {
+					fields[key] = values[key]
+					continue
+				}
+				ft = map[string][]string{}
+				fields["filtertags"] = ft
+			}
+			if values[key] == "" {
+				ft[path[1]] = []string{}
+			} else {
+				ft[path[1]] = strings.Split(values[key], ",")
+			}
+			continue
+		}
+		if !unflattenInto(fields, path, values[key]) {
+			fields[key] = values[key]
+		}
+	}
+	return fields, nil
+}
+
+func unflattenInto(m map[string]interface{}, path []string, value string) bool {
+	for _, p := range path[:len(path)-1] {
+		switch next := m[p].(type) {
+		case nil:
+			if _, exists := m[p]; exists {
+				return false
+			}
+			child := map[string]interface{}{}
+			m[p] = child
+			m = child
+		case map[string]interface{}:
+			m = next
+		default:
+			return false
+		}
+	}
+	last := path[len(path)-1]
+	if _, exists := m[last]; exists {
+		return false
+	}
+	m[last] = value
+	return true
+}
+
+type LogfmtPair struct {
+	Key   string
+	Value string
+}
+
+// ParseLogfmt splits one logfmt line into key/value pairs, in their original order.
+// A bare key (without "=") gets the value "true".
+func ParseLogfmt(line []byte) (pairs []LogfmtPair, err error) {
+	s := strings.TrimRight(string(line), "\r\n")
+	i := 0
+	for {
+		for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+			i++
+		}
+		if i >= len(s) {
+			return pairs, nil
+		}
+
+		keyStart := i
+		for i < len(s) && s[i] != '=' && s[i] != ' ' && s[i] != '\t' {
+			if s[i] == '"' {
+				return nil, fmt.Errorf("logfmt: unexpected quote in key at offset %v", i)
+			}
+			i++
+		}
+		key := s[keyStart:i]
+
+		if i >= len(s) || s[i] != '=' {
+			pairs = append(pairs, LogfmtPair{Key: key, Value: "true"})
+			continue
+		}
+		i++ // '='
+
+		if i < len(s) && s[i] == '"' {
+			end := i + 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return nil, fmt.Errorf("logfmt: unterminated quoted value for key %q", key)
+			}
+			value, err := strconv.Unquote(s[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("logfmt: bad quoted value for key %q: %v", key, err)
+			}
+			pairs = append(pairs, LogfmtPair{Key: key, Value: value})
+			i = end + 1
+			continue
+		}
+
+		valueStart := i
+		for i < len(s) && s[i] != ' ' && s[i] != '\t' {
+			i++
+		}
+		pairs = append(pairs, LogfmtPair{Key: key, Value: s[valueStart:i]})
+	}
+}
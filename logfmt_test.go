@@ -0,0 +1,92 @@
+package filtertag
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// What the LogfmtDecoder gets back from the LogfmtEncoder's line: the strings as they were,
+// the nested values by their dotted keys, the filtertags as the arrays
+func TestLogfmtRoundTrip(t *testing.T) {
+	raw := json.RawMessage(`{"a":{"b":1,"c":"x y"},"arr":[1,2]}`)
+	fields := map[string]interface{}{
+		"msg":        "hello \"world\"\n\tC:\\tmp é",
+		"host":       "h",
+		"err":        "",
+		"nil":        nil,
+		"eq":         "a=b",
+		"n":          42,
+		"ok":         true,
+		"filtertags": map[string][]string{"logger": {"INFO", "L3"}, "none": {}},
+		"nested":     &raw,
+	}
+	line, err := (&LogfmtEncoder{}).Encode(nil, fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `eq="a=b" err= filtertags.logger=INFO,L3 filtertags.none= host=h msg="hello \"world\"\n\tC:\\tmp é" ` +
+		`n=42 nested.a.b=1 nested.a.c="x y" nested.arr=1,2 nil= ok=true` + "\n"
+	if string(line) != want {
+		t.Fatalf("got  %s\nwant %s", line, want)
+	}
+
+	got, err := (&LogfmtDecoder{}).Decode(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	back := map[string]interface{}{
+		"msg":        fields["msg"],
+		"host":       "h",
+		"err":        "",
+		"nil":        "",
+		"eq":         "a=b",
+		"n":          "42",
+		"ok":         "true",
+		"filtertags": map[string][]string{"logger": {"INFO", "L3"}, "none": {}},
+		"nested":     map[string]interface{}{"a": map[string]interface{}{"b": "1", "c": "x y"}, "arr": "1,2"},
+	}
+	if !reflect.DeepEqual(got, back) {
+		t.Fatalf("got  %#v\nwant %#v", got, back)
+	}
+}
+
+// The keys can't be quoted, the characters which would break the line are replaced
+func TestLogfmtKeys(t *testing.T) {
+	fields := map[string]interface{}{
+		"user name":  "a",
+		"k=v":        "b",
+		`say"hi"`:    "c",
+		"multi\nkey": "d",
+		"ключ":       "e",
+	}
+	line, err := (&LogfmtEncoder{}).Encode(nil, fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "k_v=b multi_key=d say_hi_=c user_name=a ключ=e\n"
+	if string(line) != want {
+		t.Fatalf("got %q", line)
+	}
+	pairs, err := ParseLogfmt(line)
+	if err != nil || len(pairs) != len(fields) {
+		t.Fatalf("got %v, %v", pairs, err)
+	}
+}
+
+func TestParseLogfmt(t *testing.T) {
+	pairs, err := ParseLogfmt([]byte("a=1  bare b=\"x \\\"y\\\" \\\\ \\u00e9\" empty= last\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []LogfmtPair{{"a", "1"}, {"bare", "true"}, {"b", `x "y" \ é`}, {"empty", ""}, {"last", "true"}}
+	if !reflect.DeepEqual(pairs, want) {
+		t.Fatalf("got %q", pairs)
+	}
+
+	for _, bad := range []string{`a="x`, `a="x\"`, `a"b=1`, `a="\q"`} {
+		if pairs, err := ParseLogfmt([]byte(bad)); err == nil {
+			t.Errorf("%s: got %q", bad, pairs)
+		}
+	}
+}
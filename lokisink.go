@@ -0,0 +1,222 @@
+package filtertag
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	LokiCompression_None   = ""
+	LokiCompression_Gzip   = "gzip"   // the JSON push, gzipped
+	LokiCompression_Snappy = "snappy" // the protobuf push, snappy-compressed
+)
+
+type LokiSinkConfig struct {
+	URL string // e.g. "http://loki:3100/loki/api/v1/push"
+
+	// The fields of the line which become the stream labels (the empty ones are skipped);
+	// "service", "host", "subsystem" if nil. Keep them low-cardinality.
+	Labels []string
+	// Adds the "filtertags" label, all the filtertags of the line sorted and comma-joined;
+	// every distinct combination becomes its own stream, so mind the cardinality.
+	FiltertagsLabel bool
+	StaticLabels    map[string]string
+
+	Compression string      // one of the LokiCompression_...
+	Header      http.Header // auth, X-Scope-OrgID etc.
+	Client      *http.Client
+
+	// Reads the lines back for the labels and the timestamp; must match the Entry.Encoder,
+	// JSONDecoder if nil. The lines go to Loki as they are, so the Encoder must be a text one.
+	Decoder Decoder
+
+	BatchConfig
+}
+
+// LokiSink pushes the lines to Loki, batched, grouped into the streams by their labels
+type LokiSink struct {
+	*batcher
+	Config LokiSinkConfig
+}
+
+func MakeLokiSink(ctx context.Context, config LokiSinkConfig) *LokiSink {
+	if config.Labels == nil {
+		config.Labels = []string{"service", "host", "subsystem"}
+	}
+	if config.Decoder == nil {
+		config.Decoder = &JSONDecoder{}
+	}
+	sink := &LokiSink{Config: config}
+	sink.batcher = makeBatcher(ctx, config.BatchConfig, sink.send)
+	return sink
+}
+
+type lokiStream struct {
+	labels  string // in the Prometheus notation, {a="1", b="2"}
+	pairs   [][2]string
+	entries []lokiEntry
+}
+
+type lokiEntry struct {
+	unixNano int64
+	line     []byte
+}
+
+func (sink *LokiSink) send(ctx context.Context, lines [][]byte) error {
+	streams := sink.streams(lines)
+
+	var body []byte
+	contentType, contentEncoding := "application/json", ""
+	switch sink.Config.Compression {
+	case LokiCompression_Snappy:
+		body = appendSnappy(nil, appendLokiProto(nil, streams))
+		contentType = "application/x-protobuf"
+	case LokiCompression_Gzip:
+		body = gzipBytes(appendLokiJSON(nil, streams))
+		contentEncoding = "gzip"
+	default:
+		body = appendLokiJSON(nil, streams)
+	}
+
+	_, err := postHTTP(ctx, sink.Config.Client, sink.Config.URL, sink.Config.Header, contentType, contentEncoding, body)
+	return err
+}
+
+// Groups the lines by their labels, keeping the order of the lines within a stream
+func (sink *LokiSink) streams(lines [][]byte) []*lokiStream {
+	var streams []*lokiStream
+	byLabels := map[string]*lokiStream{}
+	labels := map[string]string{}
+
+	for _, line := range lines {
+		fields, err := sink.Config.Decoder.Decode(line)
+		if err != nil {
+			// still goes out, with the static labels only
+			fields = map[string]interface{}{}
+		}
+
+		for k := range labels {
+			delete(labels, k)
+		}
+		for k, v := range sink.Config.StaticLabels {
+			labels[k] = v
+		}
+		for _, k := range sink.Config.Labels {
+			if v := fieldString(fields, k); v != "" {
+				labels[k] = v
+			}
+		}
+		if sink.Config.FiltertagsLabel {
+			if tags := lineFiltertags(fields); len(tags) > 0 {
+				labels["filtertags"] = strings.Join(tags, ",")
+			}
+		}
+		if len(labels) == 0 {
+			// Loki refuses a stream without labels
+			labels["service"] = "unknown"
+		}
+
+		key, pairs := lokiLabels(labels)
+		stream := byLabels[key]
+		if stream == nil {
+			stream = &lokiStream{labels: key, pairs: pairs}
+			byLabels[key] = stream
+			streams = append(streams, stream)
+		}
+		stream.entries = append(stream.entries, lokiEntry{
+			unixNano: lineTime(fields).UnixNano(),
+			line:     bytes.TrimRight(line, "\n"),
+		})
+	}
+	return streams
+}
+
+// The labels in the Prometheus notation (for the protobuf push), and as the sorted pairs
+// (for the JSON one)
+func lokiLabels(labels map[string]string) (string, [][2]string) {
+	pairs := make([][2]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, [2]string{lokiLabelName(k), v})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i][0] < pairs[j][0] })
+
+	b := []byte{'{'}
+	for i, pair := range pairs {
+		if i > 0 {
+			b = append(b, ", "...)
+		}
+		b = append(b, pair[0]...)
+		b = append(b, '=')
+		b = strconv.AppendQuote(b, pair[1])
+	}
+	return string(append(b, '}')), pairs
+}
+
+// The label names are [a-zA-Z_][a-zA-Z0-9_]*, anything else becomes "_"
+func lokiLabelName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' && i > 0) {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// {"streams":[{"stream":{"host":"a"},"values":[["<unix ns>","<line>"]]}]}
+func appendLokiJSON(dst []byte, streams []*lokiStream) []byte {
+	dst = append(dst, `{"streams":[`...)
+	for i, stream := range streams {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = append(dst, `{"stream":{`...)
+		for j, pair := range stream.pairs {
+			if j > 0 {
+				dst = append(dst, ',')
+			}
+			dst = appendJSONString(dst, pair[0])
+			dst = append(dst, ':')
+			dst = appendJSONString(dst, pair[1])
+		}
+		dst = append(dst, `},"values":[`...)
+		for j, e := range stream.entries {
+			if j > 0 {
+				dst = append(dst, ',')
+			}
+			dst = append(dst, `["`...)
+			dst = strconv.AppendInt(dst, e.unixNano, 10)
+			dst = append(dst, `",`...)
+			dst = appendJSONString(dst, string(e.line))
+			dst = append(dst, ']')
+		}
+		dst = append(dst, "]}"...)
+	}
+	return append(dst, "]}"...)
+}
+
+// The logproto.PushRequest:
+//
+//	PushRequest { repeated Stream streams = 1; }
+//	Stream { string labels = 1; repeated Entry entries = 2; }
+//	Entry { google.protobuf.Timestamp timestamp = 1; string line = 2; }
+//	Timestamp { int64 seconds = 1; int32 nanos = 2; }
+func appendLokiProto(dst []byte, streams []*lokiStream) []byte {
+	var stream, entry, ts []byte
+	for _, s := range streams {
+		stream = appendProtoString(stream[:0], 1, s.labels)
+		for _, e := range s.entries {
+			ts = appendProtoUint(ts[:0], 1, uint64(e.unixNano/1e9))
+			ts = appendProtoUint(ts, 2, uint64(e.unixNano%1e9))
+			entry = appendProtoBytes(entry[:0], 1, ts)
+			entry = appendProtoBytes(entry, 2, e.line)
+			stream = appendProtoBytes(stream, 2, entry)
+		}
+		dst = appendProtoBytes(dst, 1, stream)
+	}
+	return dst
+}
@@ -0,0 +1,137 @@
+package filtertag
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func unsnappy(t *testing.T, src []byte) []byte {
+	n, k := binary.Uvarint(src)
+	src = src[k:]
+	var out []byte
+	for len(src) > 0 {
+		tag := src[0]
+		switch tag & 3 {
+		case 0:
+			l := int(tag >> 2)
+			src = src[1:]
+			if l >= 60 {
+				nb := l - 59
+				l = 0
+				for i := 0; i < nb; i++ {
+					l |= int(src[i]) << (8 * i)
+				}
+				src = src[nb:]
+			}
+			l++
+			out = append(out, src[:l]...)
+			src = src[l:]
+		case 1:
+			l := int(tag>>2&7) + 4
+			off := int(tag>>5)<<8 | int(src[1])
+			src = src[2:]
+			for i := 0; i < l; i++ {
+				out = append(out, out[len(out)-off])
+			}
+		case 2:
+			l := int(tag>>2) + 1
+			off := int(src[1]) | int(src[2])<<8
+			src = src[3:]
+			if off == 0 || off > len(out) {
+				t.Fatal("bad offset")
+			}
+			for i := 0; i < l; i++ {
+				out = append(out, out[len(out)-off])
+			}
+		default:
+			t.Fatal("copy4")
+		}
+	}
+	if uint64(len(out)) != n {
+		t.Fatalf("len %v != %v", len(out), n)
+	}
+	return out
+}
+
+func TestSnappyRoundtrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, n := range []int{0, 1, 7, 8, 100, 5000, 200000} {
+		src := make([]byte, n)
+		for i := range src {
+			if r.Intn(3) == 0 {
+				src[i] = byte(r.Intn(256))
+			} else {
+				src[i] = "abcabcabdd"[i%10]
+			}
+		}
+		if got := unsnappy(t, appendSnappy(nil, src)); !bytes.Equal(got, src) {
+			t.Fatal(n)
+		}
+	}
+	src := bytes.Repeat([]byte("x"), 1000)
+	c := appendSnappy(nil, src)
+	if len(c) > 100 || !bytes.Equal(unsnappy(t, c), src) {
+		t.Fatal(len(c))
+	}
+}
+
+func TestLokiSink(t *testing.T) {
+	var calls int32
+	bodies := make(chan []byte, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(429)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		switch r.Header.Get("Content-Encoding") {
+		case "gzip":
+			zr, _ := gzip.NewReader(bytes.NewReader(b))
+			b, _ = io.ReadAll(zr)
+		}
+		if r.Header.Get("Content-Type") == "application/x-protobuf" {
+			b = unsnappy(t, b)
+		}
+		bodies <- b
+		w.WriteHeader(204)
+	}))
+	defer srv.Close()
+
+	for _, comp := range []string{"", "gzip", "snappy"} {
+		atomic.StoreInt32(&calls, 0)
+		sink := MakeLokiSink(context.Background(), LokiSinkConfig{
+			URL: srv.URL, Compression: comp, FiltertagsLabel: true,
+			BatchConfig: BatchConfig{MaxDelay: 10 * time.Millisecond, Backoff: Backoff{Min: time.Millisecond, Max: time.Millisecond, Factor: 1}},
+		})
+		sink.Write([]byte(`{"timestamp":"2024-01-02 03:04:05.678 UTC","host":"h1","service":"svc","filtertags":{"logger":["INFO","DEBUG"]},"msg":"one"}` + "\n"))
+		sink.Write([]byte(`{"host":"h2","service":"svc","msg":"two"}` + "\n"))
+		sink.Write([]byte(`not json` + "\n"))
+		b := <-bodies
+		sink.Close()
+		if comp != "snappy" {
+			var v map[string]interface{}
+			if err := json.Unmarshal(b, &v); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(b), `"filtertags":"DEBUG,INFO"`) || !strings.Contains(string(b), `["1704164645678000000",`) {
+				t.Fatal(string(b))
+			}
+		} else if !bytes.Contains(b, []byte(`{filtertags="DEBUG,INFO", host="h1", service="svc"}`)) || !bytes.Contains(b, []byte(`"msg":"one"`)) || !bytes.Contains(b, []byte("not json")) {
+			t.Fatalf("%q", b)
+		}
+		if st := sink.Stats(); st.Written != 3 || st.Errors != 1 || st.Lost != 0 {
+			t.Fatalf("%+v", st)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package filtertag
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// MsgpackEncoder renders the Fields as a MessagePack map, length-prefixed on the stream.
+type MsgpackEncoder struct{}
+
+func (enc *MsgpackEncoder) Encode(dst []byte, fields map[string]interface{}) ([]byte, error) {
+	return encodeBinaryLine(msgpackFormat{}, dst, fields)
+}
+
+type MsgpackDecoder struct{}
+
+func (dec *MsgpackDecoder) Decode(line []byte) (fields map[string]interface{}, err error) {
+	return decodeBinaryLine(line, decodeMsgpackValue)
+}
+
+type msgpackFormat struct{}
+
+func (msgpackFormat) appendNil(dst []byte) []byte {
+	return append(dst, 0xc0)
+}
+
+func (msgpackFormat) appendBool(dst []byte, b bool) []byte {
+	if b {
+		return append(dst, 0xc3)
+	}
+	return append(dst, 0xc2)
+}
+
+func (f msgpackFormat) appendInt(dst []byte, i int64) []byte {
+	switch {
+	case i >= 0:
+		return f.appendUint(dst, uint64(i))
+	case i >= -32:
+		return append(dst, byte(i))
+	case i >= math.MinInt8:
+		return append(dst, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		return append(dst, 0xd1, byte(i>>8), byte(i))
+	case i >= math.MinInt32:
+		return append(dst, 0xd2, byte(i>>24), byte(i>>16), byte(i>>8), byte(i))
+	}
+	dst = append(dst, 0xd3)
+	return appendUint64(dst, uint64(i))
+}
+
+func (msgpackFormat) appendUint(dst []byte, u uint64) []byte {
+	switch {
+	case u <= 0x7f:
+		return append(dst, byte(u))
+	case u <= math.MaxUint8:
+		return append(dst, 0xcc, byte(u))
+	case u <= math.MaxUint16:
+		return append(dst, 0xcd, byte(u>>8), byte(u))
+	case u <= math.MaxUint32:
+		return append(dst, 0xce, byte(u>>24), byte(u>>16), byte(u>>8), byte(u))
+	}
+	dst = append(dst, 0xcf)
+	return appendUint64(dst, u)
+}
+
+func (msgpackFormat) appendFloat(dst []byte, fl float64) []byte {
+	dst = append(dst, 0xcb)
+	return appendUint64(dst, math.Float64bits(fl))
+}
+
+func (msgpackFormat) appendString(dst []byte, s string) []byte {
+	n := len(s)
+	switch {
+	case n < 32:
+		dst = append(dst, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		dst = append(dst, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		dst = append(dst, 0xda, byte(n>>8), byte(n))
+	default:
+		dst = append(dst, 0xdb, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(dst, s...)
+}
+
+func (msgpackFormat) appendBytes(dst []byte, b []byte) []byte {
+	n := len(b)
+	switch {
+	case n <= math.MaxUint8:
+		dst = append(dst, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		dst = append(dst, 0xc5, byte(n>>8), byte(n))
+	default:
+		dst = append(dst, 0xc6, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(dst, b...)
+}
+
+func (msgpackFormat) appendArrayHeader(dst []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(dst, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return append(dst, 0xdc, byte(n>>8), byte(n))
+	}
+	return append(dst, 0xdd, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func (msgpackFormat) appendMapHeader(dst []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(dst, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return append(dst, 0xde, byte(n>>8), byte(n))
+	}
+	return append(dst, 0xdf, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func decodeMsgpackValue(r *binaryReader) (interface{}, error) {
+	c, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return decodeMsgpackMap(r, uint64(c&0x0f))
+	case c&0xf0 == 0x90:
+		return decodeMsgpackArray(r, uint64(c&0x0f))
+	case c&0xe0 == 0xa0:
+		p, err := r.next(uint64(c & 0x1f))
+		if err != nil {
+			return nil, err
+		}
+		return string(p), nil
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := r.uint(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		p, err := r.next(n)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), p...), nil
+	case 0xc7, 0xc8, 0xc9:
+		n, err := r.uint(1 << (c - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return decodeMsgpackExt(r, n)
+	case 0xca:
+		p, err := r.next(4)
+		if err != nil {
+			return nil, err
+		}
+		return r.float32(p), nil
+	case 0xcb:
+		p, err := r.next(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(p)), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := r.uint(1 << (c - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		if u <= math.MaxInt64 {
+			return int64(u), nil
+		}
+		return u, nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		u, err := r.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		// sign-extend from the encoded width
+		shift := uint(64 - 8*size)
+		return int64(u<<shift) >> shift, nil
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return decodeMsgpackExt(r, 1<<(c-0xd4))
+	case 0xd9, 0xda, 0xdb:
+		n, err := r.uint(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		p, err := r.next(n)
+		if err != nil {
+			return nil, err
+		}
+		return string(p), nil
+	case 0xdc, 0xdd:
+		n, err := r.uint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return decodeMsgpackArray(r, n)
+	case 0xde, 0xdf:
+		n, err := r.uint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return decodeMsgpackMap(r, n)
+	}
+	return nil, fmt.Errorf("msgpack: unsupported type byte 0x%02x", c)
+}
+
+func decodeMsgpackNested(r *binaryReader) (interface{}, error) {
+	r.depth++
+	defer func() { r.depth-- }()
+	if r.depth > maxDecodeDepth {
+		return nil, fmt.Errorf("msgpack: nesting deeper than %v", maxDecodeDepth)
+	}
+	return decodeMsgpackValue(r)
+}
+
+func decodeMsgpackArray(r *binaryReader, n uint64) (interface{}, error) {
+	if err := r.checkCount(n); err != nil {
+		return nil, err
+	}
+	var err error
+	a := make([]interface{}, n)
+	for i := range a {
+		if a[i], err = decodeMsgpackNested(r); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func decodeMsgpackMap(r *binaryReader, n uint64) (interface{}, error) {
+	if err := r.checkCount(n); err != nil {
+		return nil, err
+	}
+	m := make(map[string]interface{}, n)
+	for i := uint64(0); i < n; i++ {
+		k, err := decodeMsgpackNested(r)
+		if err != nil {
+			return nil, err
+		}
+		if m[mapKey(k)], err = decodeMsgpackNested(r); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// The timestamp extension (type -1) is decoded as time.Time, any other extension
+// as its raw data bytes.
+func decodeMsgpackExt(r *binaryReader, n uint64) (interface{}, error) {
+	t, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	p, err := r.next(n)
+	if err != nil {
+		return nil, err
+	}
+	if int8(t) != -1 {
+		return append([]byte(nil), p...), nil
+	}
+	switch n {
+	case 4:
+		return time.Unix(int64(binary.BigEndian.Uint32(p)), 0).UTC(), nil
+	case 8:
+		v := binary.BigEndian.Uint64(p)
+		return time.Unix(int64(v&0x3ffffffff), int64(v>>34)).UTC(), nil
+	case 12:
+		return time.Unix(int64(binary.BigEndian.Uint64(p[4:])), int64(binary.BigEndian.Uint32(p))).UTC(), nil
+	}
+	return nil, fmt.Errorf("msgpack: bad timestamp extension length %v", n)
+}
@@ -0,0 +1,268 @@
+package filtertag
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type NetSinkConfig struct {
+	Network   string // "tcp", "udp", "unix", "unixgram" etc., whatever net.Dial takes
+	Address   string
+	Framing   int         // Framing_Newline or Framing_LengthPrefix; ignored for a datagram, it's always one line as it is
+	TLSConfig *tls.Config // for "tcp" only; nil means a plain connection
+
+	// The bounded buffer for the lines waiting to be sent (while disconnected, above all);
+	// DefaultBufferLines and DefaultBufferBytes if zero.
+	BufferLines int
+	BufferBytes int
+	// When the buffer is full, the lines go to the disk instead of pushing out the oldest
+	// ones, see SpillQueue; the sink doesn't close it
+	Spill *SpillQueue
+
+	Backoff      Backoff       // between the reconnects, DefaultBackoff if zero
+	DialTimeout  time.Duration // 5s if zero
+	WriteTimeout time.Duration // 5s if zero
+}
+
+// NetSink sends the lines over a socket, reconnecting when the connection breaks. The line
+// that failed to be written is sent again on the new connection, so a line may arrive twice;
+// the lines are lost when pushed out of the full buffer, or after maxLineWrites failed
+// writes of the same line (it's the line then, like a too big datagram), see the Stats().
+type NetSink struct {
+	sinkCounters // first, for the 64-bit alignment of the atomics
+	sinkHealth   // down while it can't connect, or write
+
+	Config NetSinkConfig
+
+	queue     *lineQueue
+	writeLine func(conn net.Conn, line []byte) error // instead of the framing and Write, if set
+	closing   chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+const maxLineWrites = 3
+
+func MakeNetSink(ctx context.Context, config NetSinkConfig) *NetSink {
+	return makeNetSink(ctx, config, nil)
+}
+
+func makeNetSink(
+	ctx context.Context,
+	config NetSinkConfig,
+	writeLine func(conn net.Conn, line []byte) error,
+) *NetSink {
+	if config.Backoff.Min <= 0 {
+		config.Backoff = DefaultBackoff
+	}
+	if isPacketNetwork(config.Network) {
+		config.Framing = Framing_Newline
+	}
+	if config.DialTimeout <= 0 {
+		config.DialTimeout = 5 * time.Second
+	}
+	if config.WriteTimeout <= 0 {
+		config.WriteTimeout = 5 * time.Second
+	}
+
+	sink := &NetSink{
+		Config:    config,
+		writeLine: writeLine,
+		closing:   make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	sink.queue = makeLineQueue(config.BufferLines, config.BufferBytes, config.Spill, &sink.sinkCounters)
+
+	go sink.run(ctx)
+	if config.Spill != nil {
+		go sink.queue.refill(ctx, sink.closing)
+	}
+	return sink
+}
+
+// Write never blocks, the line is only queued; after the Close, or once the ctx is done,
+// it's lost
+func (sink *NetSink) Write(p []byte) (int, error) {
+	select {
+	case <-sink.closing:
+		atomic.AddUint64(&sink.lost, 1)
+		return 0, ErrSinkClosed
+	case <-sink.done:
+		atomic.AddUint64(&sink.lost, 1)
+		return 0, ErrSinkClosed
+	default:
+	}
+	sink.queue.push(p)
+	return len(p), nil
+}
+
+func (sink *NetSink) WriteLines(lines [][]byte) error {
+	return writeLinesEach(sink, lines)
+}
+
+// Close sends what's still in the buffer (if connected), and closes the connection;
+// the lines written after Close are lost.
+func (sink *NetSink) Close() error {
+	sink.closeOnce.Do(func() {
+		close(sink.closing)
+	})
+	<-sink.done
+	return nil
+}
+
+// The datagrams have their boundaries, they need no framing
+func isPacketNetwork(network string) bool {
+	switch network {
+	case "udp", "udp4", "udp6", "unixgram", "unixpacket":
+		return true
+	}
+	return false
+}
+
+func (sink *NetSink) dial(ctx context.Context) (net.Conn, error) {
+	return dialSink(ctx, sink.Config.Network, sink.Config.Address, sink.Config.TLSConfig, sink.Config.DialTimeout)
+}
+
+func dialSink(
+	ctx context.Context,
+	network string,
+	address string,
+	tlsConfig *tls.Config,
+	timeout time.Duration,
+) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	dialer := &net.Dialer{}
+	if tlsConfig != nil {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: tlsConfig}
+		return tlsDialer.DialContext(ctx, network, address)
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+func (sink *NetSink) run(ctx context.Context) {
+	var conn net.Conn
+	var pending []byte // taken from the queue, not written yet
+	var buf []byte
+	failures := 0 // of the pending
+	closing := false
+	attempt := 0
+	connected := false
+	down := false
+
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+		if pending != nil {
+			atomic.AddUint64(&sink.lost, 1)
+		}
+		sink.dropQueued()
+		close(sink.done)
+	}()
+
+	for {
+		if pending == nil {
+			if closing {
+				select {
+				case pending = <-sink.queue.ch:
+					sink.queue.taken(pending)
+				default:
+					return
+				}
+			} else {
+				select {
+				case <-ctx.Done():
+					return
+				case <-sink.closing:
+					closing = true
+					continue
+				case pending = <-sink.queue.ch:
+					sink.queue.taken(pending)
+				}
+			}
+		}
+
+		if conn == nil {
+			c, err := sink.dial(ctx)
+			if err != nil {
+				sink.setDown(err)
+				down = true
+				atomic.AddUint64(&sink.errors, 1)
+				if closing || !sink.backoff(ctx, attempt) {
+					return
+				}
+				attempt++
+				continue
+			}
+			if connected {
+				atomic.AddUint64(&sink.reconnects, 1)
+			}
+			conn, connected = c, true
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(sink.Config.WriteTimeout))
+		var err error
+		if sink.writeLine != nil {
+			err = sink.writeLine(conn, pending)
+		} else {
+			buf = appendFramed(buf[:0], pending, sink.Config.Framing)
+			_, err = conn.Write(buf)
+		}
+		if err != nil {
+			sink.setDown(err)
+			down = true
+			atomic.AddUint64(&sink.errors, 1)
+			conn.Close()
+			conn = nil
+			if failures++; failures >= maxLineWrites {
+				atomic.AddUint64(&sink.lost, 1)
+				pending, failures = nil, 0
+			}
+			// a server which takes the connection and drops it right away isn't redialled
+			// in a busy loop
+			if closing || !sink.backoff(ctx, attempt) {
+				return
+			}
+			attempt++
+			continue
+		}
+		if down {
+			sink.setDown(nil)
+			down = false
+		}
+		atomic.AddUint64(&sink.written, 1)
+		pending, failures, attempt = nil, 0, 0
+	}
+}
+
+// Waits the backoff of the attempt; false if the sink is closed or the ctx done meanwhile
+func (sink *NetSink) backoff(ctx context.Context, attempt int) bool {
+	timer := time.NewTimer(sink.Config.Backoff.Delay(attempt))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-sink.closing:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (sink *NetSink) dropQueued() {
+	for {
+		select {
+		case line := <-sink.queue.ch:
+			sink.queue.taken(line)
+			atomic.AddUint64(&sink.lost, 1)
+		default:
+			return
+		}
+	}
+}
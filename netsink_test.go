@@ -0,0 +1,195 @@
+package filtertag
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNetSinkTCPReconnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	got := make(chan string, 100)
+	serve := func(ln net.Listener, n int) {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		sc := bufio.NewScanner(c)
+		for i := 0; i < n && sc.Scan(); i++ {
+			got <- sc.Text()
+		}
+		c.Close()
+		ln.Close()
+	}
+	go serve(ln, 2)
+	sink := MakeNetSink(context.Background(), NetSinkConfig{Network: "tcp", Address: addr, Backoff: Backoff{Min: 10 * time.Millisecond, Max: 50 * time.Millisecond, Factor: 2}})
+	sink.Write([]byte("a\n"))
+	sink.Write([]byte("b\n"))
+	for i := 0; i < 2; i++ {
+		<-got
+	}
+	time.Sleep(50 * time.Millisecond)
+	ln2, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serve(ln2, 2)
+	for i := 0; i < 5; i++ {
+		sink.Write([]byte("c\n"))
+		time.Sleep(20 * time.Millisecond)
+	}
+	timeout := time.After(3 * time.Second)
+	for i := 0; i < 2; i++ {
+		select {
+		case s := <-got:
+			if s != "c" {
+				t.Fatal(s)
+			}
+		case <-timeout:
+			t.Fatalf("timeout %+v", sink.Stats())
+		}
+	}
+	sink.Close()
+}
+
+func TestNetSinkUnixLengthPrefix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "s.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan string, 10)
+	go func() {
+		c, _ := ln.Accept()
+		var buf []byte
+		for {
+			var err error
+			buf, err = ReadFrame(c, buf[:0])
+			if err != nil {
+				close(got)
+				return
+			}
+			got <- string(buf[FrameHeaderSize:])
+		}
+	}()
+	sink := MakeNetSink(context.Background(), NetSinkConfig{Network: "unix", Address: path, Framing: Framing_LengthPrefix})
+	sink.Write([]byte("x\ny"))
+	sink.Write([]byte("z"))
+	sink.Close()
+	if a, b := <-got, <-got; a != "x\ny" || b != "z" {
+		t.Fatal(a, b)
+	}
+	st := sink.Stats()
+	if st.Written != 2 || st.Lost != 0 {
+		t.Fatalf("%+v", st)
+	}
+}
+
+func TestNetSinkBufferLoss(t *testing.T) {
+	sink := MakeNetSink(context.Background(), NetSinkConfig{Network: "tcp", Address: "127.0.0.1:1", BufferLines: 3})
+	for i := 0; i < 10; i++ {
+		sink.Write([]byte("line\n"))
+	}
+	sink.Close()
+	st := sink.Stats()
+	if st.Lines != 10 || st.Lost != 10 || st.Written != 0 {
+		t.Fatalf("%+v", st)
+	}
+}
+
+// No length prefix on the datagrams, they're one line each anyway
+func TestNetSinkUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	sink := MakeNetSink(context.Background(), NetSinkConfig{Network: "udp", Address: pc.LocalAddr().String(), Framing: Framing_LengthPrefix})
+	defer sink.Close()
+	for i := 0; i < 3; i++ {
+		sink.Write([]byte("line" + strconv.Itoa(i) + "\n"))
+	}
+	buf := make([]byte, 2000)
+	for i := 0; i < 3; i++ {
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:n]); got != "line"+strconv.Itoa(i)+"\n" {
+			t.Fatalf("got %q", got)
+		}
+	}
+}
+
+// A server which takes the connection and drops it right away gets the backoff, the attempt
+// isn't reset by the dial, only by a line written
+func TestNetSinkWriteFailBackoff(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	var writes, fail int32 = 0, 1
+	writeLine := func(conn net.Conn, line []byte) error {
+		atomic.AddInt32(&writes, 1)
+		if atomic.LoadInt32(&fail) != 0 {
+			return errors.New("reset")
+		}
+		return nil
+	}
+	config := NetSinkConfig{Network: "tcp", Address: ln.Addr().String(), Backoff: Backoff{Min: 20 * time.Millisecond, Max: time.Second, Factor: 2}}
+	sink := makeNetSink(context.Background(), config, writeLine)
+	defer sink.Close()
+	for i := 0; i < 10; i++ {
+		sink.Write([]byte("line\n"))
+	}
+	time.Sleep(300 * time.Millisecond)
+	// 20, 40, 80, 160ms (+-20%) apart
+	if n := atomic.LoadInt32(&writes); n < 3 || n > 6 {
+		t.Fatalf("%v writes in 300ms", n)
+	}
+	atomic.StoreInt32(&fail, 0)
+	// a line is lost after the maxLineWrites failures, the rest go out
+	waitFor(t, "lines written", func() bool { st := sink.Stats(); return st.Written+st.Lost == 10 })
+	if st := sink.Stats(); st.Lost < 1 || st.Lost > 2 {
+		t.Fatalf("%+v", st)
+	}
+}
+
+// Once the ctx is done, the lines are lost, not queued for nobody
+func TestNetSinkCtxDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sink := MakeNetSink(ctx, NetSinkConfig{Network: "tcp", Address: "127.0.0.1:1"})
+	cancel()
+	<-sink.done
+	if _, err := sink.Write([]byte("line\n")); err != ErrSinkClosed {
+		t.Fatalf("got %v", err)
+	}
+	if err := sink.WriteLines([][]byte{[]byte("a\n"), []byte("b\n")}); err != ErrSinkClosed {
+		t.Fatalf("got %v", err)
+	}
+	if st := sink.Stats(); st.Lost != 3 || st.Written != 0 {
+		t.Fatalf("%+v", st)
+	}
+	sink.Close()
+}
@@ -0,0 +1,281 @@
+package filtertag
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type NSQSinkConfig struct {
+	Address string // of the nsqd TCP port, e.g. "127.0.0.1:4150"
+
+	// The topic, with the holes filled from the fields of every line, like "logs.{service}"
+	// (see LogTemplate() for the holes); the characters a topic can't have become "_".
+	Topic string
+	// The ROUTE actions: checked in order, the first route whose Filter the line's filtertags
+	// pass decides its topic (the To, a template like the Topic); then the TopicFunc, then
+	// the Topic.
+	Routes []Route
+	// If set, decides the topic instead of the Topic; "" means the Topic.
+	TopicFunc func(fields map[string]interface{}) string
+	// Only used for the Routes, the Topic with holes, or the TopicFunc; must match the
+	// Entry.Encoder, JSONDecoder if nil.
+	Decoder Decoder
+
+	ClientID     string        // the hostname if empty
+	DialTimeout  time.Duration // 5s if zero
+	WriteTimeout time.Duration // and the read timeout of the responses, 5s if zero
+
+	BatchConfig
+}
+
+// NSQSink publishes the lines (as they are, one line per message) to nsqd with MPUB, batched;
+// when the connection breaks, it reconnects with the backoff of the retries. A batch can be
+// published twice (if the connection breaks after the nsqd had it, but before it said OK).
+type NSQSink struct {
+	*batcher
+	Config NSQSinkConfig
+
+	// used from the batcher's goroutine only
+	conn      net.Conn
+	r         *bufio.Reader
+	buf       []byte
+	topicFor  func(line []byte) string
+	connected bool // ever
+}
+
+var nsqMagic = []byte("  V2")
+
+const nsqEphemeral = "#ephemeral"
+
+const nsqFrameTypeResponse, nsqFrameTypeError = 0, 1
+
+func MakeNSQSink(ctx context.Context, config NSQSinkConfig) *NSQSink {
+	if config.Decoder == nil {
+		config.Decoder = &JSONDecoder{}
+	}
+	if config.ClientID == "" {
+		config.ClientID, _ = os.Hostname()
+	}
+	if config.DialTimeout <= 0 {
+		config.DialTimeout = 5 * time.Second
+	}
+	if config.WriteTimeout <= 0 {
+		config.WriteTimeout = 5 * time.Second
+	}
+
+	sink := &NSQSink{Config: config}
+	sink.topicFor = sink.makeTopicFunc()
+	sink.batcher = makeBatcher(ctx, config.BatchConfig, sink.send)
+	return sink
+}
+
+// Close publishes what's buffered, and closes the connection
+func (sink *NSQSink) Close() error {
+	sink.batcher.Close()
+	if sink.conn != nil {
+		sink.conn.Close()
+		sink.conn = nil
+	}
+	return nil
+}
+
+func (sink *NSQSink) makeTopicFunc() func(line []byte) string {
+	topicTemplate := parseFieldTemplate(sink.Config.Topic)
+	routeTemplates := make([]fieldTemplate, len(sink.Config.Routes))
+	for i, route := range sink.Config.Routes {
+		routeTemplates[i] = parseFieldTemplate(route.To)
+	}
+	if len(sink.Config.Routes) == 0 && sink.Config.TopicFunc == nil && topicTemplate.constant() {
+		// a constant, no need to decode the lines
+		topic := nsqTopicName(sink.Config.Topic)
+		return func(line []byte) string {
+			return topic
+		}
+	}
+
+	return func(line []byte) string {
+		fields, err := sink.Config.Decoder.Decode(line)
+		if err != nil {
+			fields = map[string]interface{}{}
+		}
+		if len(sink.Config.Routes) > 0 {
+			filtertags := lineFiltertags(fields)
+			for i, route := range sink.Config.Routes {
+				if route.Filter == nil || route.Filter(filtertags) {
+					return nsqTopicName(routeTemplates[i].render(fields))
+				}
+			}
+		}
+		if sink.Config.TopicFunc != nil {
+			if topic := sink.Config.TopicFunc(fields); topic != "" {
+				return nsqTopicName(topic)
+			}
+		}
+		return nsqTopicName(topicTemplate.render(fields))
+	}
+}
+
+// The topic names are [.a-zA-Z0-9_-]+ optionally followed by "#ephemeral", 64 bytes at
+// most (nsqd rejects the others with E_BAD_TOPIC); the characters a name can't have become "_"
+func nsqTopicName(topic string) string {
+	suffix := ""
+	if strings.HasSuffix(topic, nsqEphemeral) {
+		topic, suffix = topic[:len(topic)-len(nsqEphemeral)], nsqEphemeral
+	}
+	b := []byte(topic)
+	for i, c := range b {
+		if !(c == '.' || c == '_' || c == '-' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			b[i] = '_'
+		}
+	}
+	if len(b)+len(suffix) > 64 {
+		b = b[:64-len(suffix)]
+	}
+	if len(b) == 0 {
+		b = append(b, '_')
+	}
+	return string(b) + suffix
+}
+
+func (sink *NSQSink) send(ctx context.Context, lines [][]byte) error {
+	topicOf := func(i int) string {
+		return sink.topicFor(lines[i])
+	}
+	return sendGrouped(lines, topicOf, func(topic string, group []int) error {
+		msgs := make([][]byte, len(group))
+		for j, i := range group {
+			msgs[j] = lines[i]
+		}
+		return sink.mpub(ctx, topic, msgs)
+	})
+}
+
+func (sink *NSQSink) mpub(ctx context.Context, topic string, msgs [][]byte) error {
+	if sink.conn == nil {
+		if err := sink.connect(ctx); err != nil {
+			return err
+		}
+	}
+
+	// MPUB <topic>\n [4-byte body size] [4-byte num messages] ([4-byte message size] [message])...
+	size := 4
+	for _, m := range msgs {
+		size += 4 + len(m)
+	}
+	buf := append(sink.buf[:0], "MPUB "...)
+	buf = append(buf, topic...)
+	buf = append(buf, '\n')
+	buf = appendUint32(buf, uint32(size))
+	buf = appendUint32(buf, uint32(len(msgs)))
+	for _, m := range msgs {
+		buf = appendUint32(buf, uint32(len(m)))
+		buf = append(buf, m...)
+	}
+	sink.buf = buf
+
+	err := sink.command(buf)
+	if err != nil {
+		// nsqd closes the connection after the E_BAD_... errors anyway
+		sink.disconnect()
+	}
+	return err
+}
+
+func appendUint32(dst []byte, v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return append(dst, b[:]...)
+}
+
+func (sink *NSQSink) connect(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, sink.Config.DialTimeout)
+	defer cancel()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", sink.Config.Address)
+	if err != nil {
+		return err
+	}
+	if sink.connected {
+		atomic.AddUint64(&sink.reconnects, 1)
+	}
+	sink.connected = true
+	sink.conn, sink.r = conn, bufio.NewReader(conn)
+
+	identify, _ := json.Marshal(map[string]interface{}{
+		"client_id":           sink.Config.ClientID,
+		"hostname":            sink.Config.ClientID,
+		"user_agent":          "filtertag",
+		"feature_negotiation": false,
+		// we only read after our own commands, so the heartbeats are better off
+		"heartbeat_interval": -1,
+	})
+	buf := append([]byte(nil), nsqMagic...)
+	buf = append(buf, "IDENTIFY\n"...)
+	buf = appendUint32(buf, uint32(len(identify)))
+	buf = append(buf, identify...)
+	if err := sink.command(buf); err != nil {
+		sink.disconnect()
+		return err
+	}
+	return nil
+}
+
+func (sink *NSQSink) disconnect() {
+	if sink.conn != nil {
+		sink.conn.Close()
+		sink.conn, sink.r = nil, nil
+	}
+}
+
+// Writes the command, and reads its response: nil for OK, an error for the error frame
+func (sink *NSQSink) command(cmd []byte) error {
+	sink.conn.SetDeadline(time.Now().Add(sink.Config.WriteTimeout))
+	if _, err := sink.conn.Write(cmd); err != nil {
+		return err
+	}
+
+	for {
+		// [4-byte size] [4-byte frame type] [data]
+		var hdr [8]byte
+		if _, err := io.ReadFull(sink.r, hdr[:]); err != nil {
+			return err
+		}
+		size := int(binary.BigEndian.Uint32(hdr[:4]))
+		if size < 4 || size > MaxFrameSize {
+			return fmt.Errorf("nsqd sent a bad frame size %v", size)
+		}
+		data := make([]byte, size-4)
+		if _, err := io.ReadFull(sink.r, data); err != nil {
+			return err
+		}
+
+		switch binary.BigEndian.Uint32(hdr[4:]) {
+		case nsqFrameTypeResponse:
+			if bytes.Equal(data, []byte("_heartbeat_")) {
+				if _, err := sink.conn.Write([]byte("NOP\n")); err != nil {
+					return err
+				}
+				continue
+			}
+			return nil
+		case nsqFrameTypeError:
+			err := errors.New("nsqd: " + string(data))
+			if bytes.HasPrefix(data, []byte("E_BAD_TOPIC")) || bytes.HasPrefix(data, []byte("E_BAD_MESSAGE")) || bytes.HasPrefix(data, []byte("E_BAD_BODY")) {
+				return &permanentError{err}
+			}
+			return err
+		default:
+			return fmt.Errorf("nsqd sent an unexpected frame type %v", binary.BigEndian.Uint32(hdr[4:]))
+		}
+	}
+}
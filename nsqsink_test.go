@@ -0,0 +1,210 @@
+package filtertag
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// An in-process nsqd, just enough of it for the NSQSink: IDENTIFY, MPUB and NOP, with the
+// nsqd's checks of the topic names and the message sizes
+type fakeNSQD struct {
+	ln net.Listener
+
+	mu     sync.Mutex
+	msgs   map[string][]string
+	mpubs  int
+	dropAt int // the MPUB number on which the connection is just closed
+}
+
+var fakeNSQDTopicRe = regexp.MustCompile(`^[\.a-zA-Z0-9_-]+(#ephemeral)?$`)
+
+const fakeNSQDMaxMsgSize = 1024
+
+func startFakeNSQD(t *testing.T) *fakeNSQD {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeNSQD{ln: ln, msgs: map[string][]string{}}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(c)
+		}
+	}()
+	return f
+}
+
+func nsqFrame(frameType uint32, data string) []byte {
+	b := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint32(b, uint32(4+len(data)))
+	binary.BigEndian.PutUint32(b[4:], frameType)
+	return append(b, data...)
+}
+
+func (f *fakeNSQD) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != "  V2" {
+		return
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.Fields(line)
+		if len(cmd) == 0 || cmd[0] == "NOP" {
+			continue
+		}
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return
+		}
+		body := make([]byte, size)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+
+		switch cmd[0] {
+		case "IDENTIFY":
+			c.Write(nsqFrame(nsqFrameTypeResponse, "OK"))
+		case "MPUB":
+			topic := cmd[1]
+			f.mu.Lock()
+			f.mpubs++
+			if f.mpubs == f.dropAt {
+				f.mu.Unlock()
+				return
+			}
+			f.mu.Unlock()
+			if len(topic) > 64 || !fakeNSQDTopicRe.MatchString(topic) {
+				c.Write(nsqFrame(nsqFrameTypeError, "E_BAD_TOPIC MPUB topic name "+topic+" is not valid"))
+				return
+			}
+			var msgs []string
+			n := binary.BigEndian.Uint32(body)
+			body = body[4:]
+			for i := uint32(0); i < n; i++ {
+				l := binary.BigEndian.Uint32(body)
+				if l > fakeNSQDMaxMsgSize {
+					c.Write(nsqFrame(nsqFrameTypeError, "E_BAD_MESSAGE MPUB message too big"))
+					return
+				}
+				msgs = append(msgs, string(body[4:4+l]))
+				body = body[4+l:]
+			}
+			f.mu.Lock()
+			f.msgs[topic] = append(f.msgs[topic], msgs...)
+			f.mu.Unlock()
+			// a heartbeat before the response, as the nsqd may send one any time
+			c.Write(nsqFrame(nsqFrameTypeResponse, "_heartbeat_"))
+			c.Write(nsqFrame(nsqFrameTypeResponse, "OK"))
+		}
+	}
+}
+
+func (f *fakeNSQD) topic(topic string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.msgs[topic]...)
+}
+
+// With the maxDelay of an hour, the Close sends all the lines written, as one batch
+func testNSQSink(f *fakeNSQD, config NSQSinkConfig, maxDelay time.Duration) *NSQSink {
+	config.Address = f.ln.Addr().String()
+	config.BatchConfig = BatchConfig{
+		MaxDelay: maxDelay,
+		Backoff:  Backoff{Min: time.Millisecond, Max: 5 * time.Millisecond, Factor: 2},
+	}
+	return MakeNSQSink(context.Background(), config)
+}
+
+func TestNSQSinkTopics(t *testing.T) {
+	f := startFakeNSQD(t)
+	sink := testNSQSink(f, NSQSinkConfig{
+		Topic: "logs.{service}",
+		Routes: []Route{
+			{Filter: AnyOf("WAKEMEINTHEMIDDLEOFTHENIGHT"), To: "pager"},
+		},
+	}, time.Hour)
+	sink.Write([]byte(`{"service":"/usr/bin/app","msg":"1"}` + "\n"))
+	sink.Write([]byte(`{"service":"a#b","msg":"2"}` + "\n"))
+	sink.Write([]byte(`{"service":"x#ephemeral","msg":"3"}` + "\n"))
+	sink.Write([]byte(`{"service":"app","filtertags":{"logger":["WAKEMEINTHEMIDDLEOFTHENIGHT"]},"msg":"4"}` + "\n"))
+	sink.Close()
+
+	for topic, n := range map[string]int{"logs._usr_bin_app": 1, "logs.a_b": 1, "logs.x#ephemeral": 1, "pager": 1} {
+		if got := f.topic(topic); len(got) != n {
+			t.Errorf("topic %v: %q", topic, got)
+		}
+	}
+	if st := sink.Stats(); st.Written != 4 || st.Lost != 0 {
+		t.Errorf("%+v", st)
+	}
+}
+
+func TestNSQSinkTopicName(t *testing.T) {
+	long := strings.Repeat("x", 70)
+	for topic, want := range map[string]string{
+		"":                  "_",
+		"a b/c":             "a_b_c",
+		"a#b":               "a_b",
+		"a#ephemeral":       "a#ephemeral",
+		long:                long[:64],
+		long + "#ephemeral": long[:54] + "#ephemeral",
+	} {
+		if got := nsqTopicName(topic); got != want || !fakeNSQDTopicRe.MatchString(got) {
+			t.Errorf("%q: %q", topic, got)
+		}
+	}
+}
+
+// The E_BAD_MESSAGE of one topic's group loses just that group, the other topics go on
+func TestNSQSinkPermanentErrorPerTopic(t *testing.T) {
+	f := startFakeNSQD(t)
+	sink := testNSQSink(f, NSQSinkConfig{Topic: "{service}"}, time.Hour)
+	sink.Write([]byte(`{"service":"a","msg":"1"}` + "\n"))
+	sink.Write([]byte(`{"service":"b","msg":"` + strings.Repeat("x", 2*fakeNSQDMaxMsgSize) + `"}` + "\n"))
+	sink.Write([]byte(`{"service":"b","msg":"2"}` + "\n"))
+	sink.Write([]byte(`{"service":"c","msg":"3"}` + "\n"))
+	sink.Close()
+
+	if len(f.topic("a")) != 1 || len(f.topic("b")) != 0 || len(f.topic("c")) != 1 {
+		t.Errorf("a %v, b %v, c %v", len(f.topic("a")), len(f.topic("b")), len(f.topic("c")))
+	}
+	if st := sink.Stats(); st.Written != 2 || st.Lost != 2 {
+		t.Errorf("%+v", st)
+	}
+}
+
+func TestNSQSinkReconnect(t *testing.T) {
+	f := startFakeNSQD(t)
+	f.dropAt = 2
+	sink := testNSQSink(f, NSQSinkConfig{Topic: "logs"}, time.Millisecond)
+	sink.Write([]byte(`{"msg":"1"}` + "\n"))
+	time.Sleep(50 * time.Millisecond)
+	sink.Write([]byte(`{"msg":"2"}` + "\n"))
+	time.Sleep(50 * time.Millisecond)
+	sink.Close()
+
+	if got := f.topic("logs"); len(got) != 2 {
+		t.Errorf("%q", got)
+	}
+	if st := sink.Stats(); st.Written != 2 || st.Reconnects != 1 {
+		t.Errorf("%+v", st)
+	}
+}
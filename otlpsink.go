@@ -0,0 +1,450 @@
+package filtertag
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type OTLPSinkConfig struct {
+	URL      string // e.g. "http://collector:4318/v1/logs"
+	Protobuf bool   // send the application/x-protobuf, otherwise the OTLP/JSON
+	Gzip     bool
+	Header   http.Header
+	Client   *http.Client
+
+	// The syslog severities of the filtertags (translated into the OTel SeverityNumber);
+	// DefaultSyslogSeverities if nil
+	Severities      map[string]int
+	DefaultSeverity *int // SyslogSeverity_Info if nil, see SyslogSeverity()
+
+	// The fields with the trace and span IDs (hex) for the record's trace_id and span_id;
+	// "trace_id", "traceId" and "span_id", "spanId" if nil. The line is encoded long before
+	// it gets here, so the IDs of the context must go into the fields at the logging call:
+	// see ContextWithTraceIDs(), LogftCtx() and the Event's Ctx().
+	TraceIDFields []string
+	SpanIDFields  []string
+
+	ScopeName string // of the InstrumentationScope, "filtertag" if empty
+
+	// Reads the lines back; must match the Entry.Encoder, JSONDecoder if nil
+	Decoder Decoder
+
+	BatchConfig
+}
+
+// OTLPSink exports the lines as the OpenTelemetry LogRecords over OTLP/HTTP: the "msg" is
+// the body, the "service" and the "host" are the resource's service.name and host.name, the
+// filtertags are the "filtertags" array attribute (and give the severity), and the rest of
+// the fields are the attributes.
+type OTLPSink struct {
+	*batcher
+	Config OTLPSinkConfig
+}
+
+func MakeOTLPSink(ctx context.Context, config OTLPSinkConfig) *OTLPSink {
+	if config.Severities == nil {
+		config.Severities = DefaultSyslogSeverities
+	}
+	if config.DefaultSeverity == nil {
+		config.DefaultSeverity = SyslogSeverity(SyslogSeverity_Info)
+	}
+	if config.TraceIDFields == nil {
+		config.TraceIDFields = []string{"trace_id", "traceId"}
+	}
+	if config.SpanIDFields == nil {
+		config.SpanIDFields = []string{"span_id", "spanId"}
+	}
+	if config.ScopeName == "" {
+		config.ScopeName = "filtertag"
+	}
+	if config.Decoder == nil {
+		config.Decoder = &JSONDecoder{}
+	}
+	sink := &OTLPSink{Config: config}
+	sink.batcher = makeBatcher(ctx, config.BatchConfig, sink.send)
+	return sink
+}
+
+// The OTel SeverityNumber and SeverityText of the syslog severity, see otlpSeverity
+var otlpSeverities = [...]struct {
+	number int
+	text   string
+}{
+	SyslogSeverity_Emerg:   {24, "FATAL4"},
+	SyslogSeverity_Alert:   {23, "FATAL3"},
+	SyslogSeverity_Crit:    {21, "FATAL"},
+	SyslogSeverity_Err:     {17, "ERROR"},
+	SyslogSeverity_Warning: {13, "WARN"},
+	SyslogSeverity_Notice:  {10, "INFO2"},
+	SyslogSeverity_Info:    {9, "INFO"},
+	SyslogSeverity_Debug:   {5, "DEBUG"},
+}
+
+// The severities out of the syslog range (from the user's Severities) are clamped to it
+func otlpSeverity(severity int) (number int, text string) {
+	if severity < SyslogSeverity_Emerg {
+		severity = SyslogSeverity_Emerg
+	}
+	if severity > SyslogSeverity_Debug {
+		severity = SyslogSeverity_Debug
+	}
+	sev := otlpSeverities[severity]
+	return sev.number, sev.text
+}
+
+type otlpResource struct {
+	service string
+	host    string
+	records []otlpRecord
+}
+
+type otlpRecord struct {
+	timeUnixNano     uint64
+	observedUnixNano uint64
+	severity         int // the syslog one
+	body             string
+	attrs            []otlpAttr
+	traceID          []byte
+	spanID           []byte
+}
+
+type otlpAttr struct {
+	key   string
+	value interface{}
+}
+
+func (sink *OTLPSink) send(ctx context.Context, lines [][]byte) error {
+	resources := sink.resources(lines)
+
+	var body []byte
+	contentType, contentEncoding := "application/json", ""
+	if sink.Config.Protobuf {
+		body = sink.appendProto(nil, resources)
+		contentType = "application/x-protobuf"
+	} else {
+		body = sink.appendJSON(nil, resources)
+	}
+	if sink.Config.Gzip {
+		body = gzipBytes(body)
+		contentEncoding = "gzip"
+	}
+
+	_, err := postHTTP(ctx, sink.Config.Client, sink.Config.URL, sink.Config.Header, contentType, contentEncoding, body)
+	return err
+}
+
+// The records grouped by their resource (the service and the host)
+func (sink *OTLPSink) resources(lines [][]byte) []*otlpResource {
+	var resources []*otlpResource
+	byKey := map[[2]string]*otlpResource{}
+	observed := uint64(time.Now().UnixNano())
+
+	for _, line := range lines {
+		fields, err := sink.Config.Decoder.Decode(line)
+		if err != nil {
+			fields = map[string]interface{}{"msg": string(line)}
+		}
+		tags := lineFiltertags(fields)
+
+		rec := otlpRecord{
+			timeUnixNano:     uint64(lineTime(fields).UnixNano()),
+			observedUnixNano: observed,
+			severity:         syslogSeverity(sink.Config.Severities, *sink.Config.DefaultSeverity, tags),
+			body:             fieldString(fields, "msg"),
+		}
+		skip := map[string]bool{"msg": true, "timestamp": true, "service": true, "host": true, "filtertags": true}
+		rec.traceID = otlpID(fields, sink.Config.TraceIDFields, 16, skip)
+		rec.spanID = otlpID(fields, sink.Config.SpanIDFields, 8, skip)
+
+		if len(tags) > 0 {
+			values := make([]interface{}, len(tags))
+			for i, tag := range tags {
+				values[i] = tag
+			}
+			rec.attrs = append(rec.attrs, otlpAttr{key: "filtertags", value: values})
+		}
+		for k, v := range fields {
+			if skip[k] || v == nil || v == "" {
+				continue
+			}
+			rec.attrs = append(rec.attrs, otlpAttr{key: k, value: v})
+		}
+		sort.Slice(rec.attrs, func(i, j int) bool { return rec.attrs[i].key < rec.attrs[j].key })
+
+		key := [2]string{fieldString(fields, "service"), fieldString(fields, "host")}
+		res := byKey[key]
+		if res == nil {
+			res = &otlpResource{service: key[0], host: key[1]}
+			byKey[key] = res
+			resources = append(resources, res)
+		}
+		res.records = append(res.records, rec)
+	}
+	return resources
+}
+
+// The first of the fields which is a valid hex ID of the size (in bytes); it's then
+// marked to skip, not to be an attribute too
+func otlpID(fields map[string]interface{}, keys []string, size int, skip map[string]bool) []byte {
+	for _, k := range keys {
+		s, ok := fields[k].(string)
+		if !ok || len(s) != 2*size {
+			continue
+		}
+		id, err := hex.DecodeString(s)
+		if err != nil {
+			continue
+		}
+		skip[k] = true
+		return id
+	}
+	return nil
+}
+
+func (sink *OTLPSink) resourceAttrs(res *otlpResource) []otlpAttr {
+	var attrs []otlpAttr
+	if res.service != "" {
+		attrs = append(attrs, otlpAttr{key: "service.name", value: res.service})
+	}
+	if res.host != "" {
+		attrs = append(attrs, otlpAttr{key: "host.name", value: res.host})
+	}
+	return attrs
+}
+
+// The OTLP/JSON: the proto3 JSON mapping, with the lowerCamelCase names, the 64-bit
+// integers as strings, and the trace and span IDs in hex
+func (sink *OTLPSink) appendJSON(dst []byte, resources []*otlpResource) []byte {
+	dst = append(dst, `{"resourceLogs":[`...)
+	for i, res := range resources {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = append(dst, `{"resource":{"attributes":`...)
+		dst = appendOTLPAttrsJSON(dst, sink.resourceAttrs(res), 0)
+		dst = append(dst, `},"scopeLogs":[{"scope":{"name":`...)
+		dst = appendJSONString(dst, sink.Config.ScopeName)
+		dst = append(dst, `},"logRecords":[`...)
+		for j, rec := range res.records {
+			if j > 0 {
+				dst = append(dst, ',')
+			}
+			number, text := otlpSeverity(rec.severity)
+			dst = append(dst, `{"timeUnixNano":"`...)
+			dst = strconv.AppendUint(dst, rec.timeUnixNano, 10)
+			dst = append(dst, `","observedTimeUnixNano":"`...)
+			dst = strconv.AppendUint(dst, rec.observedUnixNano, 10)
+			dst = append(dst, `","severityNumber":`...)
+			dst = strconv.AppendInt(dst, int64(number), 10)
+			dst = append(dst, `,"severityText":`...)
+			dst = appendJSONString(dst, text)
+			dst = append(dst, `,"body":{"stringValue":`...)
+			dst = appendJSONString(dst, rec.body)
+			dst = append(dst, `},"attributes":`...)
+			dst = appendOTLPAttrsJSON(dst, rec.attrs, 0)
+			if rec.traceID != nil {
+				dst = append(dst, `,"traceId":"`...)
+				dst = append(dst, hex.EncodeToString(rec.traceID)...)
+				dst = append(dst, '"')
+			}
+			if rec.spanID != nil {
+				dst = append(dst, `,"spanId":"`...)
+				dst = append(dst, hex.EncodeToString(rec.spanID)...)
+				dst = append(dst, '"')
+			}
+			dst = append(dst, '}')
+		}
+		dst = append(dst, "]}]}"...)
+	}
+	return append(dst, "]}"...)
+}
+
+func appendOTLPAttrsJSON(dst []byte, attrs []otlpAttr, depth int) []byte {
+	dst = append(dst, '[')
+	for i, a := range attrs {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = append(dst, `{"key":`...)
+		dst = appendJSONString(dst, a.key)
+		dst = append(dst, `,"value":`...)
+		dst = appendOTLPValueJSON(dst, a.value, depth)
+		dst = append(dst, '}')
+	}
+	return append(dst, ']')
+}
+
+// The AnyValue
+func appendOTLPValueJSON(dst []byte, v interface{}, depth int) []byte {
+	if depth > DefaultMaxDepth {
+		return append(dst, `{}`...)
+	}
+	switch v := v.(type) {
+	case nil:
+		return append(dst, `{}`...)
+	case string:
+		dst = append(dst, `{"stringValue":`...)
+		dst = appendJSONString(dst, v)
+	case bool:
+		dst = append(dst, `{"boolValue":`...)
+		dst = strconv.AppendBool(dst, v)
+	case float64:
+		if i, ok := otlpInt(v); ok {
+			dst = append(dst, `{"intValue":"`...)
+			dst = strconv.AppendInt(dst, i, 10)
+			dst = append(dst, '"')
+		} else {
+			dst = append(dst, `{"doubleValue":`...)
+			dst = appendJSONFloat(dst, v, 64)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			dst = append(dst, `{"intValue":"`...)
+			dst = strconv.AppendInt(dst, i, 10)
+			dst = append(dst, '"')
+		} else {
+			f, _ := v.Float64()
+			dst = append(dst, `{"doubleValue":`...)
+			dst = appendJSONFloat(dst, f, 64)
+		}
+	case []interface{}:
+		dst = append(dst, `{"arrayValue":{"values":[`...)
+		for i, e := range v {
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			dst = appendOTLPValueJSON(dst, e, depth+1)
+		}
+		dst = append(dst, "]}"...)
+	case map[string]interface{}:
+		dst = append(dst, `{"kvlistValue":{"values":`...)
+		dst = appendOTLPAttrsJSON(dst, otlpMapAttrs(v), depth+1)
+		dst = append(dst, '}')
+	default:
+		dst = append(dst, `{"stringValue":`...)
+		dst = appendJSONString(dst, fmt.Sprint(v))
+	}
+	return append(dst, '}')
+}
+
+// The whole float64 within the int64 range is an int
+func otlpInt(f float64) (int64, bool) {
+	if f != math.Trunc(f) || f < -(1<<63) || f >= 1<<63 {
+		return 0, false
+	}
+	return int64(f), true
+}
+
+func otlpMapAttrs(m map[string]interface{}) []otlpAttr {
+	attrs := make([]otlpAttr, 0, len(m))
+	for k, v := range m {
+		attrs = append(attrs, otlpAttr{key: k, value: v})
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].key < attrs[j].key })
+	return attrs
+}
+
+// The ExportLogsServiceRequest:
+//
+//	ExportLogsServiceRequest { repeated ResourceLogs resource_logs = 1; }
+//	ResourceLogs { Resource resource = 1; repeated ScopeLogs scope_logs = 2; }
+//	Resource { repeated KeyValue attributes = 1; }
+//	ScopeLogs { InstrumentationScope scope = 1; repeated LogRecord log_records = 2; }
+//	InstrumentationScope { string name = 1; }
+//	LogRecord { fixed64 time_unix_nano = 1; SeverityNumber severity_number = 2;
+//		string severity_text = 3; AnyValue body = 5; repeated KeyValue attributes = 6;
+//		bytes trace_id = 9; bytes span_id = 10; fixed64 observed_time_unix_nano = 11; }
+func (sink *OTLPSink) appendProto(dst []byte, resources []*otlpResource) []byte {
+	var resLogs, resource, scopeLogs, scope, rec, body []byte
+	for _, res := range resources {
+		resource = appendOTLPAttrsProto(resource[:0], 1, sink.resourceAttrs(res), 0)
+		resLogs = appendProtoBytes(resLogs[:0], 1, resource)
+
+		scope = appendProtoString(scope[:0], 1, sink.Config.ScopeName)
+		scopeLogs = appendProtoBytes(scopeLogs[:0], 1, scope)
+		for _, r := range res.records {
+			number, text := otlpSeverity(r.severity)
+			rec = appendProtoFixed64(rec[:0], 1, r.timeUnixNano)
+			rec = appendProtoUint(rec, 2, uint64(number))
+			rec = appendProtoString(rec, 3, text)
+			body = appendProtoString(body[:0], 1, r.body)
+			rec = appendProtoBytes(rec, 5, body)
+			rec = appendOTLPAttrsProto(rec, 6, r.attrs, 0)
+			if r.traceID != nil {
+				rec = appendProtoBytes(rec, 9, r.traceID)
+			}
+			if r.spanID != nil {
+				rec = appendProtoBytes(rec, 10, r.spanID)
+			}
+			rec = appendProtoFixed64(rec, 11, r.observedUnixNano)
+			scopeLogs = appendProtoBytes(scopeLogs, 2, rec)
+		}
+		resLogs = appendProtoBytes(resLogs, 2, scopeLogs)
+		dst = appendProtoBytes(dst, 1, resLogs)
+	}
+	return dst
+}
+
+// The repeated KeyValue { string key = 1; AnyValue value = 2; } as the field
+func appendOTLPAttrsProto(dst []byte, field int, attrs []otlpAttr, depth int) []byte {
+	for _, a := range attrs {
+		kv := appendProtoString(nil, 1, a.key)
+		kv = appendProtoBytes(kv, 2, appendOTLPValueProto(nil, a.value, depth))
+		dst = appendProtoBytes(dst, field, kv)
+	}
+	return dst
+}
+
+// AnyValue { oneof { string string_value = 1; bool bool_value = 2; int64 int_value = 3;
+// double double_value = 4; ArrayValue array_value = 5; KeyValueList kvlist_value = 6; } };
+// the oneof members are written even when zero, that's how the set one is known
+func appendOTLPValueProto(dst []byte, v interface{}, depth int) []byte {
+	if depth > DefaultMaxDepth {
+		return dst
+	}
+	switch v := v.(type) {
+	case nil:
+		return dst
+	case string:
+		return appendProtoBytes(dst, 1, []byte(v))
+	case bool:
+		dst = appendProtoKey(dst, 2, protoWireVarint)
+		if v {
+			return append(dst, 1)
+		}
+		return append(dst, 0)
+	case float64:
+		if i, ok := otlpInt(v); ok {
+			dst = appendProtoKey(dst, 3, protoWireVarint)
+			return appendProtoVarint(dst, uint64(i))
+		}
+		dst = appendProtoKey(dst, 4, protoWireFixed64)
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+		return append(dst, b[:]...)
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			dst = appendProtoKey(dst, 3, protoWireVarint)
+			return appendProtoVarint(dst, uint64(i))
+		}
+		f, _ := v.Float64()
+		return appendOTLPValueProto(dst, f, depth)
+	case []interface{}:
+		var arr []byte
+		for _, e := range v {
+			arr = appendProtoBytes(arr, 1, appendOTLPValueProto(nil, e, depth+1))
+		}
+		return appendProtoBytes(dst, 5, arr)
+	case map[string]interface{}:
+		return appendProtoBytes(dst, 6, appendOTLPAttrsProto(nil, 1, otlpMapAttrs(v), depth+1))
+	}
+	return appendProtoBytes(dst, 1, []byte(fmt.Sprint(v)))
+}
@@ -0,0 +1,232 @@
+package filtertag
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// The protobuf message as its fields' values (the raw bytes of each), by the field numbers
+type pbMsg map[int][][]byte
+
+func pbParse(t *testing.T, b []byte) pbMsg {
+	t.Helper()
+	m := pbMsg{}
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		b = b[n:]
+		f, wt := int(key>>3), key&7
+		switch wt {
+		case 0:
+			_, n := binary.Uvarint(b)
+			m[f] = append(m[f], b[:n])
+			b = b[n:]
+		case 1:
+			m[f] = append(m[f], b[:8])
+			b = b[8:]
+		case 5:
+			m[f] = append(m[f], b[:4])
+			b = b[4:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			b = b[n:]
+			m[f] = append(m[f], b[:l])
+			b = b[l:]
+		default:
+			t.Fatalf("unexpected wire type %v", wt)
+		}
+	}
+	return m
+}
+
+// The collector stub, passing the requests and their bodies on
+func otlpCollector(t *testing.T) (*httptest.Server, chan *http.Request, chan []byte) {
+	reqs := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		reqs <- r
+		bodies <- b
+		w.WriteHeader(200)
+	}))
+	return srv, reqs, bodies
+}
+
+const otlpLine1 = `{"timestamp":"2021-01-02T03:04:05.123456Z","service":"svc","host":"h1","msg":"hello","filtertags":{"logger":["ERROR","INFO"]},"trace_id":"0102030405060708090a0b0c0d0e0f10","span_id":"a1a2a3a4a5a6a7a8","n":5,"f":1.5,"ok":true,"nest":{"a":[1,"x"]}}` + "\n"
+const otlpLine2 = `{"timestamp":"2021-01-02T03:04:06Z","service":"svc2","host":"h1","msg":"bye","trace_id":"zz"}` + "\n"
+
+func TestOTLPSinkJSON(t *testing.T) {
+	srv, reqs, bodies := otlpCollector(t)
+	defer srv.Close()
+	sink := MakeOTLPSink(context.Background(), OTLPSinkConfig{URL: srv.URL + "/v1/logs", BatchConfig: BatchConfig{MaxDelay: 10 * time.Millisecond}})
+	sink.Write([]byte(otlpLine1))
+	sink.Write([]byte(otlpLine2))
+	var body []byte
+	select {
+	case r := <-reqs:
+		body = <-bodies
+		if r.Header.Get("Content-Type") != "application/json" || r.URL.Path != "/v1/logs" {
+			t.Fatalf("got the request %v %v", r.URL, r.Header)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no request")
+	}
+	sink.Close()
+	var req struct {
+		ResourceLogs []struct {
+			Resource struct {
+				Attributes []map[string]interface{}
+			}
+			ScopeLogs []struct {
+				Scope      map[string]interface{}
+				LogRecords []map[string]interface{}
+			}
+		}
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal(err)
+	}
+	if len(req.ResourceLogs) != 2 {
+		t.Fatal(len(req.ResourceLogs))
+	}
+	r := req.ResourceLogs[0].ScopeLogs[0].LogRecords[0]
+	if r["timeUnixNano"] != "1609556645123456000" || r["severityNumber"] != 17.0 || r["traceId"] != "0102030405060708090a0b0c0d0e0f10" || r["spanId"] != "a1a2a3a4a5a6a7a8" {
+		t.Fatal(r)
+	}
+	r2 := req.ResourceLogs[1].ScopeLogs[0].LogRecords[0]
+	if r2["traceId"] != nil || r2["severityNumber"] != 9.0 {
+		t.Fatal(r2)
+	}
+}
+
+func TestOTLPSinkProto(t *testing.T) {
+	srv, reqs, bodies := otlpCollector(t)
+	defer srv.Close()
+	sink := MakeOTLPSink(context.Background(), OTLPSinkConfig{URL: srv.URL, Protobuf: true, BatchConfig: BatchConfig{MaxDelay: 10 * time.Millisecond}})
+	sink.Write([]byte(otlpLine1))
+	var body []byte
+	select {
+	case <-reqs:
+		body = <-bodies
+	case <-time.After(5 * time.Second):
+		t.Fatal("no request")
+	}
+	sink.Close()
+	rl := pbParse(t, pbParse(t, body)[1][0])
+	res := pbParse(t, rl[1][0])
+	if len(res[1]) != 2 {
+		t.Fatal("resource attrs", len(res[1]))
+	}
+	sl := pbParse(t, rl[2][0])
+	if string(pbParse(t, sl[1][0])[1][0]) != "filtertag" {
+		t.Fatal("scope")
+	}
+	rec := pbParse(t, sl[2][0])
+	if binary.LittleEndian.Uint64(rec[1][0]) != 1609556645123456000 || rec[2][0][0] != 17 || string(rec[3][0]) != "ERROR" {
+		t.Fatal(rec)
+	}
+	if len(rec[9][0]) != 16 || len(rec[10][0]) != 8 || rec[9][0][15] != 0x10 {
+		t.Fatal("ids")
+	}
+	if string(pbParse(t, rec[5][0])[1][0]) != "hello" {
+		t.Fatal("body")
+	}
+	attrs := map[string]pbMsg{}
+	for _, kv := range rec[6] {
+		m := pbParse(t, kv)
+		attrs[string(m[1][0])] = pbParse(t, m[2][0])
+	}
+	if len(attrs) != 5 {
+		t.Fatal(len(attrs))
+	}
+	if v, _ := binary.Uvarint(attrs["n"][3][0]); v != 5 {
+		t.Fatal("n")
+	}
+	if len(attrs["f"][4]) != 1 || attrs["ok"][2][0][0] != 1 || len(pbParse(t, attrs["filtertags"][5][0])[1]) != 2 {
+		t.Fatal(attrs)
+	}
+	if len(attrs["nest"][6]) != 1 {
+		t.Fatal("nest")
+	}
+}
+
+// The severities beyond the syslog ones are clamped, not out of range
+func TestOTLPSinkSeverityClamp(t *testing.T) {
+	srv, _, bodies := otlpCollector(t)
+	defer srv.Close()
+	sink := MakeOTLPSink(context.Background(), OTLPSinkConfig{
+		URL:         srv.URL,
+		Severities:  map[string]int{"TRACE": 8, "WEIRD": 100},
+		BatchConfig: BatchConfig{MaxDelay: 10 * time.Millisecond},
+	})
+	sink.Write([]byte(`{"msg":"a","filtertags":{"logger":["TRACE"]}}` + "\n"))
+	sink.Write([]byte(`{"msg":"b","filtertags":{"logger":["WEIRD"]}}` + "\n"))
+	var body []byte
+	select {
+	case body = <-bodies:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no request")
+	}
+	sink.Close()
+	var req struct {
+		ResourceLogs []struct {
+			ScopeLogs []struct {
+				LogRecords []struct {
+					SeverityNumber int
+					SeverityText   string
+				}
+			}
+		}
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal(err)
+	}
+	recs := req.ResourceLogs[0].ScopeLogs[0].LogRecords
+	if len(recs) != 2 || recs[0].SeverityNumber != 5 || recs[1].SeverityNumber != 5 {
+		t.Fatalf("got %s", body)
+	}
+}
+
+// The IDs of the ctx get into the line, and then into the LogRecord's trace_id and span_id
+func TestOTLPSinkContextTraceIDs(t *testing.T) {
+	entry := testEntry()
+	ctx := ContextWithTraceIDs(context.Background(), "0102030405060708090a0b0c0d0e0f10", "a1a2a3a4a5a6a7a8")
+	entry.LogftCtx(ctx, []string{"INFO"}, "hello")
+	entry.Event("INFO").Ctx(ctx).Msg("event")
+	if _, ok := entry.Fields["trace_id"]; ok {
+		t.Fatal("the trace_id was left in the Fields")
+	}
+
+	srv, _, bodies := otlpCollector(t)
+	defer srv.Close()
+	sink := MakeOTLPSink(context.Background(), OTLPSinkConfig{URL: srv.URL, Protobuf: true, BatchConfig: BatchConfig{MaxDelay: 10 * time.Millisecond}})
+	for i := 0; i < 2; i++ {
+		msg := <-entry.LoggerCh
+		sink.Write(msg.RawLine)
+		msg.release()
+	}
+	var body []byte
+	select {
+	case body = <-bodies:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no request")
+	}
+	sink.Close()
+
+	rl := pbParse(t, pbParse(t, body)[1][0])
+	sl := pbParse(t, rl[2][0])
+	if len(sl[2]) != 2 {
+		t.Fatalf("got %v records", len(sl[2]))
+	}
+	for _, r := range sl[2] {
+		rec := pbParse(t, r)
+		if len(rec[9]) != 1 || len(rec[9][0]) != 16 || rec[9][0][0] != 0x01 || len(rec[10]) != 1 || len(rec[10][0]) != 8 || rec[10][0][0] != 0xa1 {
+			t.Fatalf("got the trace_id %x, the span_id %x", rec[9], rec[10])
+		}
+	}
+}
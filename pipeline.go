@@ -0,0 +1,295 @@
+package filtertag
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type PipelineConfig struct {
+	Sinks []io.Writer // every line goes to all of them
+
+	Shards      int // GOMAXPROCS if zero
+	ShardLines  int // the buffer of a shard, in lines, 1024 if zero
+	BatchLines  int // a shard's worker hands its lines to the sinks in batches of up to these, 256 if zero
+	SinkBatches int // the buffer of a sink's writer, in batches, 16 if zero
+
+	// When set, every line (but the Fastforward ones) gets a global sequence number under
+	// this key, like "seq"; the shards keep the order of an entry's lines, not the global one,
+	// so it's for the consumers to restore that
+	SequenceKey string
+
+	// Called when a sink's Write (or WriteLines) fails, with the sink's index in the Sinks
+	ErrorFunc func(sink int, err error)
+}
+
+// Pipeline takes the lines of the entries (see SetPipeline) past the LoggerCh and the
+// single logger goroutine, for the services logging like 100k lines a second:
+//
+//   - every entry (a Copy() of it, usually one per goroutine) pushes its lines into its own
+//     shard of the several ones, so the callers don't contend on a single channel; the lines
+//     are encoded right in the logging calls, by the callers themselves, as before;
+//   - a worker per shard collects the shard's lines in batches, and hands them to the sinks;
+//   - every sink has one writer goroutine, which writes the batches in the order it gets
+//     them (with a WriteLines, if the sink has it, see LinesWriter).
+//
+// The Logger's Output, Spill, lanes and ErrorFunc are not used for these lines; the commands
+// (GetLogger, ExitFunc etc.) still go by the LoggerCh.
+type Pipeline struct {
+	sinkCounters // first, for the 64-bit alignment of the atomics
+
+	seq     uint64 // atomic, the last sequence number
+	pending int64  // atomic, the lines pushed and not yet written by all of the sinks
+	next    uint32 // atomic, the shard for the next entry
+	closed  int32  // atomic
+	stopped int32  // atomic, a worker is gone (by the Close, or the ctx)
+
+	Config PipelineConfig
+
+	shards     []chan *LoggerChType
+	writers    []chan *pipelineBatch
+	done       chan struct{}
+	collectors sync.WaitGroup
+	wg         sync.WaitGroup
+}
+
+type pipelineBatch struct {
+	refs  int32 // atomic, the sinks which haven't written it yet
+	msgs  []*LoggerChType
+	lines [][]byte
+}
+
+var pipelineBatchPool = sync.Pool{
+	New: func() interface{} {
+		return &pipelineBatch{}
+	},
+}
+
+func MakePipeline(ctx context.Context, config PipelineConfig) *Pipeline {
+	if config.Shards <= 0 {
+		config.Shards = runtime.GOMAXPROCS(0)
+	}
+	if config.ShardLines <= 0 {
+		config.ShardLines = 1024
+	}
+	if config.BatchLines <= 0 {
+		config.BatchLines = 256
+	}
+	if config.SinkBatches <= 0 {
+		config.SinkBatches = 16
+	}
+
+	p := &Pipeline{
+		Config:  config,
+		shards:  make([]chan *LoggerChType, config.Shards),
+		writers: make([]chan *pipelineBatch, len(config.Sinks)),
+		done:    make(chan struct{}),
+	}
+	for i := range p.writers {
+		p.writers[i] = make(chan *pipelineBatch, config.SinkBatches)
+		p.wg.Add(1)
+		go p.write(ctx, i)
+	}
+	for i := range p.shards {
+		p.shards[i] = make(chan *LoggerChType, config.ShardLines)
+		p.collectors.Add(1)
+		go p.collect(ctx, p.shards[i])
+	}
+	// the writers go on until the collectors are all done, so no batch is left behind
+	go func() {
+		p.collectors.Wait()
+		for _, w := range p.writers {
+			close(w)
+		}
+	}()
+	return p
+}
+
+// SetPipeline makes the lines of the entry, and of its Copy()s made after this, go by the
+// pipeline; every Copy() gets a shard of its own (round robin, when there are more of them
+// than the shards). Nil sets the LoggerCh back.
+func (entry *Entry) SetPipeline(p *Pipeline) {
+	entry.pipeline = p
+	if p != nil {
+		entry.shard = p.nextShard()
+	}
+}
+
+func (p *Pipeline) nextShard() int {
+	return int(atomic.AddUint32(&p.next, 1) % uint32(len(p.shards)))
+}
+
+func (p *Pipeline) nextSeq() uint64 {
+	return atomic.AddUint64(&p.seq, 1)
+}
+
+// False when the done is closed before the msg could be pushed (see sendMsg), or the
+// pipeline is closed (or its ctx is done)
+func (p *Pipeline) push(shard int, msg *LoggerChType, done <-chan struct{}) bool {
+	if atomic.LoadInt32(&p.closed) != 0 || atomic.LoadInt32(&p.stopped) != 0 {
+		atomic.AddUint64(&p.lines, 1)
+		atomic.AddUint64(&p.lost, 1)
+		msg.release()
+		return false
+	}
+	// counted before, so the Written is never above the Lines
+	atomic.AddUint64(&p.lines, 1)
+	atomic.AddInt64(&p.pending, 1)
+	if !sendMsg(p.shards[shard], msg, done, nil) {
+		atomic.AddUint64(&p.lines, ^uint64(0))
+		atomic.AddInt64(&p.pending, -1)
+		return false
+	}
+	return true
+}
+
+// The shard's worker; when stopped, the lines left in the shard are lost
+func (p *Pipeline) collect(ctx context.Context, shard chan *LoggerChType) {
+	defer p.collectors.Done()
+	defer p.drain(shard)
+	for {
+		var msg *LoggerChType
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.done:
+			return
+		case msg = <-shard:
+		}
+
+		batch := pipelineBatchPool.Get().(*pipelineBatch)
+		batch.msgs = append(batch.msgs[:0], msg)
+	collect:
+		for len(batch.msgs) < p.Config.BatchLines {
+			select {
+			case msg = <-shard:
+				batch.msgs = append(batch.msgs, msg)
+			default:
+				break collect
+			}
+		}
+		batch.lines = batch.lines[:0]
+		for _, msg := range batch.msgs {
+			batch.lines = append(batch.lines, msg.RawLine)
+		}
+
+		if len(p.writers) == 0 {
+			atomic.AddUint64(&p.lost, uint64(len(batch.msgs)))
+			p.release(batch)
+			continue
+		}
+		batch.refs = int32(len(p.writers))
+		for j, w := range p.writers {
+			select {
+			case w <- batch:
+				continue
+			case <-ctx.Done():
+			case <-p.done:
+			}
+			// the writers which have it still write it, the batch is lost for the rest
+			if atomic.AddInt32(&batch.refs, -int32(len(p.writers)-j)) == 0 {
+				atomic.AddUint64(&p.lost, uint64(len(batch.msgs)))
+				p.release(batch)
+			}
+			return
+		}
+	}
+}
+
+// The lines pushed after the worker is gone are lost; the pushes are refused from now on
+func (p *Pipeline) drain(shard chan *LoggerChType) {
+	atomic.StoreInt32(&p.stopped, 1)
+	for {
+		select {
+		case msg := <-shard:
+			atomic.AddUint64(&p.lost, 1)
+			atomic.AddInt64(&p.pending, -1)
+			msg.release()
+		default:
+			return
+		}
+	}
+}
+
+// The sink's writer, until the collectors are all done; after the ctx is done, the batches
+// aren't written, but lost
+func (p *Pipeline) write(ctx context.Context, i int) {
+	defer p.wg.Done()
+	sink := p.Config.Sinks[i]
+	for batch := range p.writers[i] {
+		if ctx.Err() != nil {
+			if atomic.AddInt32(&batch.refs, -1) == 0 {
+				atomic.AddUint64(&p.lost, uint64(len(batch.msgs)))
+				p.release(batch)
+			}
+			continue
+		}
+		if err := writeBatch(sink, batch.lines); err != nil {
+			atomic.AddUint64(&p.errors, 1)
+			if p.Config.ErrorFunc != nil {
+				p.Config.ErrorFunc(i, err)
+			}
+		}
+		if atomic.AddInt32(&batch.refs, -1) == 0 {
+			atomic.AddUint64(&p.written, uint64(len(batch.msgs)))
+			p.release(batch)
+		}
+	}
+}
+
+// Returns the lines' buffers, and the batch itself, for reuse
+func (p *Pipeline) release(batch *pipelineBatch) {
+	n := len(batch.msgs)
+	for i, msg := range batch.msgs {
+		batch.msgs[i] = nil
+		batch.lines[i] = nil
+		msg.release()
+	}
+	batch.msgs = batch.msgs[:0]
+	batch.lines = batch.lines[:0]
+	pipelineBatchPool.Put(batch)
+	atomic.AddInt64(&p.pending, -int64(n))
+}
+
+// A panicking sink is an error too, the writer goes on
+func writeBatch(sink io.Writer, lines [][]byte) (err error) {
+	defer func() {
+		if errrec := recover(); errrec != nil {
+			err = fmt.Errorf("sink write panicked: %v", errrec)
+		}
+	}()
+	if lw, ok := sink.(LinesWriter); ok {
+		return lw.WriteLines(lines)
+	}
+	return writeLinesEach(sink, lines)
+}
+
+// Flush waits until the lines pushed so far are written by all of the sinks, for up to 5s
+// (the ExitFunc calls it)
+func (p *Pipeline) Flush() error {
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&p.pending) > 0 {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("filtertag: pipeline flush timed out, %v lines are still pending", atomic.LoadInt64(&p.pending))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
+
+// Close flushes, and stops the workers and the writers; the lines logged after it are lost.
+// The sinks are left open.
+func (p *Pipeline) Close() error {
+	if !atomic.CompareAndSwapInt32(&p.closed, 0, 1) {
+		return nil
+	}
+	err := p.Flush()
+	close(p.done)
+	p.collectors.Wait()
+	p.wg.Wait()
+	return err
+}
@@ -0,0 +1,194 @@
+package filtertag
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type collectSink struct {
+	mu    sync.Mutex
+	lines [][]byte
+}
+
+func (s *collectSink) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lines = append(s.lines, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func TestPipeline(t *testing.T) {
+	entry := testEntry()
+	a, b := &collectSink{}, &collectSink{}
+	p := MakePipeline(context.Background(), PipelineConfig{Sinks: []io.Writer{a, b}, Shards: 4, SequenceKey: "seq"})
+	entry.SetPipeline(p)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		e := entry.Copy()
+		e.Fields["g"] = g
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				e.Fields["i"] = i
+				e.Logft([]string{"INFO"}, "x")
+			}
+		}()
+	}
+	wg.Wait()
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []*collectSink{a, b} {
+		if len(s.lines) != 8000 {
+			t.Fatalf("got %v lines", len(s.lines))
+		}
+		last := map[float64]float64{}
+		var seqs []float64
+		for _, line := range s.lines {
+			var m map[string]interface{}
+			if err := json.Unmarshal(line, &m); err != nil {
+				t.Fatalf("bad line %q: %v", line, err)
+			}
+			g, i := m["g"].(float64), m["i"].(float64)
+			if prev, ok := last[g]; ok && i != prev+1 {
+				t.Fatalf("the order of the entry %v is broken: %v after %v", g, i, prev)
+			}
+			last[g] = i
+			seqs = append(seqs, m["seq"].(float64))
+		}
+		sort.Float64s(seqs)
+		for i, seq := range seqs {
+			if seq != float64(i+1) {
+				t.Fatalf("got the seq %v at %v", seq, i)
+			}
+		}
+	}
+	if _, ok := entry.Fields["seq"]; ok {
+		t.Error("the seq was left in the Fields")
+	}
+	if st := p.Stats(); st.Lines != 8000 || st.Written != 8000 {
+		t.Fatalf("got %+v", st)
+	}
+
+	p.Close()
+	if entry.TryLogft([]string{"INFO"}, "after") {
+		t.Error("a line was taken after the Close")
+	}
+	if st := p.Stats(); st.Lost != 1 {
+		t.Fatalf("got %+v", st)
+	}
+}
+
+type blockedSink struct {
+	gate chan struct{}
+}
+
+func (s *blockedSink) Write(p []byte) (int, error) {
+	<-s.gate
+	return len(p), nil
+}
+
+// The lines in the shards and the batches on their way when the ctx is done are lost,
+// not left pending
+func TestPipelineCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sink := &blockedSink{gate: make(chan struct{})}
+	p := MakePipeline(ctx, PipelineConfig{Sinks: []io.Writer{sink}, Shards: 2, ShardLines: 16, BatchLines: 4, SinkBatches: 1})
+	entry := testEntry()
+	entry.SetPipeline(p)
+	for i := 0; i < 30; i++ {
+		entry.TryLogft([]string{"INFO"}, "x")
+	}
+	cancel()
+	close(sink.gate)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&p.pending) != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := atomic.LoadInt64(&p.pending); n != 0 {
+		t.Fatalf("%v lines left pending", n)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if st := p.Stats(); st.Written+st.Lost != st.Lines {
+		t.Fatalf("got %+v", st)
+	}
+	if entry.TryLogft([]string{"INFO"}, "after") {
+		t.Error("a line was taken after the ctx is done")
+	}
+}
+
+// The TryLogft calls which find the shard full are dropped, the pipeline doesn't count them
+func TestTryLogftPipeline(t *testing.T) {
+	entry := MakePrimordialEntryWithLogger(context.Background())
+	logger := entry.GetLogger()
+	logger.DroppedFunc = nil
+	entry.SetLogger(logger)
+	bs := &blockWriter{block: make(chan struct{})}
+	p := MakePipeline(context.Background(), PipelineConfig{Sinks: []io.Writer{bs}, Shards: 1, ShardLines: 4, BatchLines: 1, SinkBatches: 1})
+	entry.SetPipeline(p)
+	n := 0
+	for i := 0; i < 20; i++ {
+		if entry.TryLogft([]string{"INFO"}, "x") {
+			n++
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n >= 20 || entry.DroppedCalls() != uint64(20-n) {
+		t.Fatal(n, entry.DroppedCalls())
+	}
+	close(bs.block)
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if st := p.Stats(); st.Lines != uint64(n) || st.Written != uint64(n) {
+		t.Fatalf("%+v %v", st, n)
+	}
+}
+
+// Compare with BenchmarkPipelineParallel: every line goes by the one LoggerCh and the one
+// goroutine reading it
+func BenchmarkLoggerChParallel(b *testing.B) {
+	entry := testEntry()
+	entry.LoggerCh = make(chan *LoggerChType, 500)
+	go func() {
+		for msg := range entry.LoggerCh {
+			io.Discard.Write(msg.RawLine)
+			msg.release()
+		}
+	}()
+	defer close(entry.LoggerCh)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		e := entry.Copy()
+		for pb.Next() {
+			e.Logft([]string{"INFO"}, "hello")
+		}
+	})
+}
+
+func BenchmarkPipelineParallel(b *testing.B) {
+	entry := testEntry()
+	p := MakePipeline(context.Background(), PipelineConfig{Sinks: []io.Writer{io.Discard}})
+	defer p.Close()
+	entry.SetPipeline(p)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		e := entry.Copy()
+		for pb.Next() {
+			e.Logft([]string{"INFO"}, "hello")
+		}
+	})
+	p.Flush()
+}
@@ -0,0 +1,65 @@
+package filtertag
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Just enough of the protobuf wire format to write the few messages the sinks need, by hand
+
+const (
+	protoWireVarint  = 0
+	protoWireFixed64 = 1
+	protoWireBytes   = 2
+	protoWireFixed32 = 5
+)
+
+func appendProtoVarint(dst []byte, v uint64) []byte {
+	for v >= 0x80 {
+		dst = append(dst, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(dst, byte(v))
+}
+
+func appendProtoKey(dst []byte, field int, wireType int) []byte {
+	return appendProtoVarint(dst, uint64(field)<<3|uint64(wireType))
+}
+
+// The zero values are skipped, like proto3 does it
+func appendProtoUint(dst []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return dst
+	}
+	dst = appendProtoKey(dst, field, protoWireVarint)
+	return appendProtoVarint(dst, v)
+}
+
+func appendProtoFixed64(dst []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return dst
+	}
+	dst = appendProtoKey(dst, field, protoWireFixed64)
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	return append(dst, b[:]...)
+}
+
+func appendProtoDouble(dst []byte, field int, v float64) []byte {
+	return appendProtoFixed64(dst, field, math.Float64bits(v))
+}
+
+func appendProtoBytes(dst []byte, field int, b []byte) []byte {
+	dst = appendProtoKey(dst, field, protoWireBytes)
+	dst = appendProtoVarint(dst, uint64(len(b)))
+	return append(dst, b...)
+}
+
+func appendProtoString(dst []byte, field int, s string) []byte {
+	if s == "" {
+		return dst
+	}
+	dst = appendProtoKey(dst, field, protoWireBytes)
+	dst = appendProtoVarint(dst, uint64(len(s)))
+	return append(dst, s...)
+}
@@ -0,0 +1,9 @@
+//go:build race
+// +build race
+
+package filtertag
+
+func init() {
+	// the sync.Pool drops some of the items under the race detector
+	raceEnabled = true
+}
@@ -0,0 +1,458 @@
+package filtertag
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Redactor masks the secrets before the line is encoded, see the Entry.Redactor.
+//
+// The struct fields are handled by their tags:
+//
+//	Password string `filtertag:"redact"` // replaced with the Mask
+//	Email    string `filtertag:"hash"`   // replaced with a (keyed) hash, so still can be correlated
+//	Raw      []byte `filtertag:"omit"`   // dropped from the line altogether
+//
+// and any key (of the Fields, of a nested map, of a struct field, or inside a nested
+// json.RawMessage) containing one of the KeyPatterns (case-insensitive) is masked too.
+// The values which need no redaction are encoded as they are, without copying.
+type Redactor struct {
+	KeyPatterns []string
+	Mask        string // "[REDACTED]" if empty
+	HashKey     []byte // if set, the "hash" is the HMAC-SHA256 with this key, otherwise a plain SHA-256
+
+	types sync.Map // reflect.Type -> bool, whether the values of the type may need redaction
+}
+
+var DefaultKeyPatterns = []string{"password", "passwd", "secret", "token", "authorization", "apikey", "api_key", "cookie"}
+
+func MakeDefaultRedactor() *Redactor {
+	return &Redactor{KeyPatterns: DefaultKeyPatterns}
+}
+
+const (
+	redactActionNone = iota
+	redactActionRedact
+	redactActionHash
+	redactActionOmit
+)
+
+func (r *Redactor) mask() string {
+	if r.Mask == "" {
+		return "[REDACTED]"
+	}
+	return r.Mask
+}
+
+// RedactFields returns the fields itself if there's nothing to redact, otherwise a shallow
+// copy with the redacted values.
+func (r *Redactor) RedactFields(fields map[string]interface{}) map[string]interface{} {
+	var out map[string]interface{}
+	for k, v := range fields {
+		var nv interface{}
+		var changed bool
+		if r.KeyMatches(k) {
+			nv, changed = r.mask(), true
+		} else {
+			nv, changed = r.redact(v, 0)
+		}
+		if !changed {
+			continue
+		}
+		if out == nil {
+			out = make(map[string]interface{}, len(fields))
+			for k2, v2 := range fields {
+				out[k2] = v2
+			}
+		}
+		out[k] = nv
+	}
+	if out == nil {
+		return fields
+	}
+	return out
+}
+
+// Redact returns the value with the secrets masked; the v itself is never modified.
+func (r *Redactor) Redact(v interface{}) interface{} {
+	out, changed := r.redact(v, 0)
+	if !changed {
+		return v
+	}
+	return out
+}
+
+func (r *Redactor) KeyMatches(key string) bool {
+	for _, p := range r.KeyPatterns {
+		if containsFold(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// strings.Contains(strings.ToLower(s), strings.ToLower(substr)), without the allocations
+func containsFold(s, substr string) bool {
+	if len(substr) == 0 {
+		return true
+	}
+	for i := 0; i+len(substr) <= len(s); i++ {
+		if strings.EqualFold(s[i:i+len(substr)], substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Redactor) redact(v interface{}, depth int) (interface{}, bool) {
+	if depth > DefaultMaxDepth {
+		// too deep (or a cycle), better safe than sorry
+		return r.mask(), true
+	}
+
+	switch v := v.(type) {
+	case nil, string, bool, int, int64, float64, *Timestamp, error, []byte, []string:
+		return v, false
+	case LazyValue:
+		return LazyValue(func() interface{} {
+			out, _ := r.redact(v.Value(), depth)
+			return out
+		}), true
+	case map[string]interface{}:
+		var out map[string]interface{}
+		for k, vv := range v {
+			var nv interface{}
+			var changed bool
+			if r.KeyMatches(k) {
+				nv, changed = r.mask(), true
+			} else {
+				nv, changed = r.redact(vv, depth+1)
+			}
+			if !changed {
+				continue
+			}
+			if out == nil {
+				out = make(map[string]interface{}, len(v))
+				for k2, v2 := range v {
+					out[k2] = v2
+				}
+			}
+			out[k] = nv
+		}
+		if out == nil {
+			return v, false
+		}
+		return out, true
+	case map[string][]string:
+		var out map[string][]string
+		for k := range v {
+			if !r.KeyMatches(k) {
+				continue
+			}
+			if out == nil {
+				out = make(map[string][]string, len(v))
+				for k2, v2 := range v {
+					out[k2] = v2
+				}
+			}
+			out[k] = []string{r.mask()}
+		}
+		if out == nil {
+			return v, false
+		}
+		return out, true
+	case []interface{}:
+		var out []interface{}
+		for i := range v {
+			nv, changed := r.redact(v[i], depth+1)
+			if !changed {
+				continue
+			}
+			if out == nil {
+				out = append([]interface{}(nil), v...)
+			}
+			out[i] = nv
+		}
+		if out == nil {
+			return v, false
+		}
+		return out, true
+	case json.RawMessage:
+		return r.redactJSON(v, depth)
+	case *json.RawMessage:
+		if v == nil {
+			return v, false
+		}
+		return r.redactJSON(*v, depth)
+	}
+
+	return r.redactReflect(reflect.ValueOf(v), depth)
+}
+
+// Only decodes the JSON if any of the patterns is there at all
+func (r *Redactor) redactJSON(raw json.RawMessage, depth int) (interface{}, bool) {
+	found := false
+	for _, p := range r.KeyPatterns {
+		if bytesContainsFold(raw, p) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return raw, false
+	}
+
+	var v interface{}
+	if err := unmarshalUseNumber(raw, &v); err != nil {
+		return raw, false
+	}
+	out, changed := r.redact(v, depth)
+	if !changed {
+		return raw, false
+	}
+	b, err := json.Marshal(out)
+	if err != nil {
+		return r.mask(), true
+	}
+	return json.RawMessage(b), true
+}
+
+func bytesContainsFold(b []byte, substr string) bool {
+	for i := 0; i+len(substr) <= len(b); i++ {
+		if bytes.EqualFold(b[i:i+len(substr)], []byte(substr)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Redactor) redactReflect(rv reflect.Value, depth int) (interface{}, bool) {
+	if !rv.IsValid() || !r.mayNeed(rv.Type()) {
+		return nil, false
+	}
+
+	switch rv.Kind() {
+	case reflect.Interface:
+		if rv.IsNil() {
+			return nil, false
+		}
+		return r.redact(rv.Elem().Interface(), depth+1)
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return nil, false
+		}
+		out, changed := r.redactReflect(rv.Elem(), depth+1)
+		if !changed {
+			return rv.Interface(), false
+		}
+		return out, true
+	case reflect.Struct:
+		m := make(map[string]interface{}, rv.NumField())
+		r.redactStructInto(m, rv, depth)
+		return m, true
+	case reflect.Map:
+		if rv.IsNil() {
+			return nil, false
+		}
+		m := make(map[string]interface{}, rv.Len())
+		changed := false
+		iter := rv.MapRange()
+		for iter.Next() {
+			k := reflectMapKey(iter.Key())
+			if r.KeyMatches(k) {
+				m[k] = r.mask()
+				changed = true
+				continue
+			}
+			nv, c := r.redactReflect(iter.Value(), depth+1)
+			if c {
+				m[k] = nv
+				changed = true
+			} else {
+				m[k] = iter.Value().Interface()
+			}
+		}
+		if !changed {
+			return rv.Interface(), false
+		}
+		return m, true
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			return nil, false
+		}
+		a := make([]interface{}, rv.Len())
+		changed := false
+		for i := range a {
+			nv, c := r.redactReflect(rv.Index(i), depth+1)
+			if c {
+				a[i] = nv
+				changed = true
+			} else {
+				a[i] = rv.Index(i).Interface()
+			}
+		}
+		if !changed {
+			return rv.Interface(), false
+		}
+		return a, true
+	}
+	return rv.Interface(), false
+}
+
+// The struct becomes a map, with the same keys the encoding/json would use
+func (r *Redactor) redactStructInto(m map[string]interface{}, rv reflect.Value, depth int) {
+	t := rv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		fv := rv.Field(i)
+
+		name, omitempty := jsonFieldName(sf)
+		if name == "-" {
+			continue
+		}
+		if sf.Anonymous && !strings.Contains(string(sf.Tag), `json:"`) {
+			ft := sf.Type
+			if ft.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					continue
+				}
+				ft, fv = ft.Elem(), fv.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				r.redactStructInto(m, fv, depth)
+				continue
+			}
+		}
+		if sf.PkgPath != "" {
+			continue
+		}
+		if omitempty && isEmptyValue(fv) {
+			continue
+		}
+
+		switch redactTagAction(sf) {
+		case redactActionOmit:
+			continue
+		case redactActionRedact:
+			m[name] = r.mask()
+			continue
+		case redactActionHash:
+			m[name] = r.hash(fv.Interface())
+			continue
+		}
+		if r.KeyMatches(name) {
+			m[name] = r.mask()
+			continue
+		}
+		if nv, changed := r.redact(fv.Interface(), depth+1); changed {
+			m[name] = nv
+		} else {
+			m[name] = fv.Interface()
+		}
+	}
+}
+
+func jsonFieldName(sf reflect.StructField) (name string, omitempty bool) {
+	name = sf.Name
+	tag, ok := sf.Tag.Lookup("json")
+	if !ok {
+		return name, false
+	}
+	if tag == "-" {
+		return "-", false
+	}
+	opts := ""
+	if j := strings.IndexByte(tag, ','); j >= 0 {
+		tag, opts = tag[:j], tag[j:]
+	}
+	if tag != "" {
+		name = tag
+	}
+	return name, strings.Contains(opts, ",omitempty")
+}
+
+func redactTagAction(sf reflect.StructField) int {
+	switch sf.Tag.Get("filtertag") {
+	case "redact":
+		return redactActionRedact
+	case "hash":
+		return redactActionHash
+	case "omit":
+		return redactActionOmit
+	}
+	return redactActionNone
+}
+
+func (r *Redactor) hash(v interface{}) string {
+	var b []byte
+	switch v := v.(type) {
+	case string:
+		b = []byte(v)
+	case []byte:
+		b = v
+	default:
+		b = []byte(fmt.Sprint(v))
+	}
+	var sum []byte
+	if len(r.HashKey) > 0 {
+		mac := hmac.New(sha256.New, r.HashKey)
+		mac.Write(b)
+		sum = mac.Sum(nil)
+	} else {
+		s := sha256.Sum256(b)
+		sum = s[:]
+	}
+	return "sha256:" + hex.EncodeToString(sum[:16])
+}
+
+// Whether a value of the type can contain anything to redact: a tagged struct field,
+// a struct field with a sensitive name, or a map (its keys are only known at run time).
+func (r *Redactor) mayNeed(t reflect.Type) bool {
+	if v, ok := r.types.Load(t); ok {
+		return v.(bool)
+	}
+	need := r.mayNeedUncached(t, map[reflect.Type]bool{})
+	r.types.Store(t, need)
+	return need
+}
+
+func (r *Redactor) mayNeedUncached(t reflect.Type, seen map[reflect.Type]bool) bool {
+	if seen[t] {
+		// recursive type; whatever it contains is decided at the first visit
+		return false
+	}
+	seen[t] = true
+
+	if t.Implements(jsonMarshalerType) || reflect.PtrTo(t).Implements(jsonMarshalerType) && t.Kind() == reflect.Struct {
+		// it has its own idea of how to look in JSON, which we can't redact field by field
+		return false
+	}
+
+	switch t.Kind() {
+	case reflect.Map, reflect.Interface:
+		return true
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return r.mayNeedUncached(t.Elem(), seen)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			if redactTagAction(sf) != redactActionNone {
+				return true
+			}
+			if name, _ := jsonFieldName(sf); sf.PkgPath == "" && r.KeyMatches(name) {
+				return true
+			}
+			if r.mayNeedUncached(sf.Type, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,194 @@
+package filtertag
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type redactCreds struct {
+	Password string `json:"pw" filtertag:"redact"`
+	PIN      string `json:"pin" filtertag:"redact"`
+}
+
+type redactMeta struct {
+	Note string `json:"note" filtertag:"redact"`
+}
+
+type redactUser struct {
+	redactCreds
+	*redactMeta
+	Name     string                 `json:"name"`
+	Email    string                 `json:"email" filtertag:"hash"`
+	Avatar   []byte                 `json:"avatar" filtertag:"omit"`
+	Boss     *redactUser            `json:"boss,omitempty"`
+	APIToken string                 // masked by its name
+	Extra    map[string]interface{} `json:"extra,omitempty"`
+}
+
+// The secrets below, none of them may show up in a line
+var redactSecrets = []string{
+	"pw-4711", "pin-4711", "note-4711", "mail@4711", "avatar-4711", "tok-4711",
+	"boss-pw-4711", "db-pw-4711", "hdr-4711", "cookie-4711", "raw-pw-4711", "raw-key-4711",
+	"field-4711",
+}
+
+func makeRedactUser() redactUser {
+	return redactUser{
+		redactCreds: redactCreds{Password: "pw-4711", PIN: "pin-4711"},
+		redactMeta:  &redactMeta{Note: "note-4711"},
+		Name:        "bob",
+		Email:       "mail@4711",
+		Avatar:      []byte("avatar-4711"),
+		Boss:        &redactUser{redactCreds: redactCreds{Password: "boss-pw-4711"}, Name: "alice"},
+		APIToken:    "tok-4711",
+		Extra:       map[string]interface{}{"db": map[string]interface{}{"db_password": "db-pw-4711", "host": "db1"}},
+	}
+}
+
+// The tagged fields of the nested and the embedded (also by a pointer) structs are redacted,
+// hashed or omitted; the struct given by a pointer the same as by value
+func TestRedactStruct(t *testing.T) {
+	r := MakeDefaultRedactor()
+	user := makeRedactUser()
+	for _, v := range []interface{}{user, &user} {
+		m, ok := r.Redact(v).(map[string]interface{})
+		if !ok {
+			t.Fatalf("%T: got %#v", v, r.Redact(v))
+		}
+		if m["pw"] != "[REDACTED]" || m["pin"] != "[REDACTED]" || m["note"] != "[REDACTED]" || m["APIToken"] != "[REDACTED]" {
+			t.Fatalf("%T: not masked: %v", v, m)
+		}
+		if m["name"] != "bob" || m["email"] != r.hash("mail@4711") {
+			t.Fatalf("%T: got %v", v, m)
+		}
+		if _, ok := m["avatar"]; ok {
+			t.Fatalf("%T: the omitted field is there: %v", v, m)
+		}
+		boss := m["boss"].(map[string]interface{})
+		if boss["pw"] != "[REDACTED]" || boss["name"] != "alice" {
+			t.Fatalf("%T: the boss %v", v, boss)
+		}
+		db := m["extra"].(map[string]interface{})["db"].(map[string]interface{})
+		if db["db_password"] != "[REDACTED]" || db["host"] != "db1" {
+			t.Fatalf("%T: the extra %v", v, db)
+		}
+	}
+
+	if !reflect.DeepEqual(user, makeRedactUser()) {
+		t.Fatalf("the struct modified: %+v", user)
+	}
+
+	// the types with nothing to redact are left as they are
+	type plain struct{ A, B string }
+	p := &plain{"a", "b"}
+	if out := r.Redact(p); out != p {
+		t.Fatalf("got %#v", out)
+	}
+}
+
+func TestRedactHash(t *testing.T) {
+	r := MakeDefaultRedactor()
+	keyed := &Redactor{HashKey: []byte("k1"), Mask: "***"}
+	h := r.hash("mail@4711")
+	if !strings.HasPrefix(h, "sha256:") || len(h) != len("sha256:")+32 || h != r.hash([]byte("mail@4711")) {
+		t.Fatalf("got %q", h)
+	}
+	if h == r.hash("mail@4712") || h == keyed.hash("mail@4711") {
+		t.Fatal("the same hash of the different values (or keys)")
+	}
+	if keyed.hash("mail@4711") != keyed.hash("mail@4711") {
+		t.Fatal("the keyed hash differs")
+	}
+	if m := keyed.Redact(redactCreds{Password: "x"}).(map[string]interface{}); m["pw"] != "***" {
+		t.Fatalf("got %v", m)
+	}
+}
+
+// The keys matching the KeyPatterns, at any level of the maps and inside the json.RawMessage;
+// the caller's maps are never changed, and the Fields with nothing to redact not even copied
+func TestRedactKeys(t *testing.T) {
+	r := MakeDefaultRedactor()
+	raw := json.RawMessage(`{"a":{"Password":"raw-pw-4711","n":1},"list":[{"Api_Key":"raw-key-4711"}],"b":12345678901234567890}`)
+	clean := json.RawMessage(`{"a":1}`)
+	nested := map[string]interface{}{"auth": map[string]interface{}{"Token": "tok-4711", "user": "bob"}}
+	fields := map[string]interface{}{
+		"session_token": "field-4711",
+		"nested":        nested,
+		"list":          []interface{}{map[string]interface{}{"cookie": "cookie-4711"}},
+		"typed":         map[string]string{"X-Secret": "hdr-4711", "ok": "1"},
+		"hdr":           map[string][]string{"Authorization": {"hdr-4711"}, "Accept": {"*/*"}},
+		"raw":           raw,
+		"rawptr":        &raw,
+		"clean":         clean,
+	}
+	before, _ := json.Marshal(fields)
+
+	out := r.RedactFields(fields)
+	if after, _ := json.Marshal(fields); string(after) != string(before) {
+		t.Fatalf("the Fields modified:\n%s\n%s", before, after)
+	}
+	b, err := json.Marshal(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range redactSecrets {
+		if strings.Contains(string(b), s) {
+			t.Fatalf("%q in %s", s, b)
+		}
+	}
+	for _, s := range []string{`"user":"bob"`, `"ok":"1"`, `"Accept":["*/*"]`, `"n":1`, `12345678901234567890`} {
+		if !strings.Contains(string(b), s) {
+			t.Fatalf("no %s in %s", s, b)
+		}
+	}
+	if c, ok := out["clean"].(json.RawMessage); !ok || &c[0] != &clean[0] {
+		t.Fatalf("the clean JSON copied: %#v", out["clean"])
+	}
+
+	safe := map[string]interface{}{"a": 1, "b": map[string]interface{}{"c": "d"}}
+	if out := r.RedactFields(safe); reflect.ValueOf(out).Pointer() != reflect.ValueOf(safe).Pointer() {
+		t.Fatal("the Fields copied with nothing to redact")
+	}
+}
+
+// Whichever way the line is logged and encoded, the secrets aren't in it, and the Fields of
+// the entry are left as they were
+func TestRedactLine(t *testing.T) {
+	for _, enc := range []Encoder{&JSONEncoder{Safe: true}, &LogfmtEncoder{}} {
+		entry := testEntry()
+		entry.Encoder = enc
+		entry.Redactor = MakeDefaultRedactor()
+		user := makeRedactUser()
+		entry.Fields["user"] = &user
+		entry.Fields["api_key"] = "field-4711"
+
+		entry.Logft([]string{"INFO"}, "login")
+		entry.Event("INFO").Object("u", user).Str("x_secret", "hdr-4711").Any("raw", json.RawMessage(`{"password":"raw-pw-4711"}`)).Msg("event")
+		entry.LogFields([]string{"INFO"}, "fields", String("cookie", "cookie-4711"), Any("m", map[string]string{"Token": "tok-4711"}))
+		if _, ok := enc.(*JSONEncoder); ok {
+			ff := entry.MakeFastforward([]string{"INFO"}, "ff", "password", "user")
+			entry.LogFastforward(ff, FastforwardString("raw-key-4711"), FastforwardString("bob"))
+		}
+
+		for len(entry.LoggerCh) > 0 {
+			msg := <-entry.LoggerCh
+			for _, s := range redactSecrets {
+				if strings.Contains(string(msg.RawLine), s) {
+					t.Errorf("%T: %q in %s", enc, s, msg.RawLine)
+				}
+			}
+			if !strings.Contains(string(msg.RawLine), "[REDACTED]") {
+				t.Errorf("%T: nothing masked in %s", enc, msg.RawLine)
+			}
+			msg.release()
+		}
+		if entry.Fields["api_key"] != "field-4711" || user.Password != "pw-4711" || entry.Fields["user"] != &user {
+			t.Fatalf("%T: the Fields modified: %v", enc, entry.Fields)
+		}
+		if _, ok := entry.Fields["u"]; ok {
+			t.Fatalf("%T: the event's field left: %v", enc, entry.Fields)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package filtertag
+
+import (
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// appendReflect is the Safe mode replacement of json.Marshal, for the values json.Marshal
+// has failed on: it follows the encoding/json rules (json tags, MarshalJSON, MarshalText),
+// but puts the placeholders in place of what can't be encoded, instead of failing.
+func (st *jsonState) appendReflect(dst []byte, rv reflect.Value) ([]byte, error) {
+	if !rv.IsValid() {
+		return append(dst, "null"...), nil
+	}
+
+	if rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return append(dst, "null"...), nil
+		}
+	}
+	if rv.Type().Implements(jsonMarshalerType) && rv.CanInterface() {
+		b, err := rv.Interface().(json.Marshaler).MarshalJSON()
+		if err != nil {
+			return st.fail(dst, "error", fmt.Errorf("MarshalJSON of %v: %v", rv.Type(), err))
+		}
+		return st.appendRaw(dst, b)
+	}
+	if rv.Type().Implements(textMarshalerType) && rv.CanInterface() {
+		b, err := rv.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return st.fail(dst, "error", fmt.Errorf("MarshalText of %v: %v", rv.Type(), err))
+		}
+		return st.appendString(dst, string(b)), nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Bool:
+		return strconv.AppendBool(dst, rv.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.AppendInt(dst, rv.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.AppendUint(dst, rv.Uint(), 10), nil
+	case reflect.Float32:
+		return st.appendFloat(dst, rv.Float(), 32)
+	case reflect.Float64:
+		return st.appendFloat(dst, rv.Float(), 64)
+	case reflect.String:
+		return st.appendString(dst, rv.String()), nil
+	case reflect.Interface:
+		return st.appendReflect(dst, rv.Elem())
+	case reflect.Ptr:
+		if err := st.enter(rv.Pointer()); err != nil {
+			return st.enterFailed(dst, err)
+		}
+		defer st.leave()
+		return st.appendReflect(dst, rv.Elem())
+	case reflect.Map:
+		return st.appendReflectMap(dst, rv)
+	case reflect.Slice:
+		if rv.IsNil() {
+			return append(dst, "null"...), nil
+		}
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			dst = append(dst, '"')
+			dst = append(dst, base64.StdEncoding.EncodeToString(rv.Bytes())...)
+			return append(dst, '"'), nil
+		}
+		if err := st.enter(rv.Pointer()); err != nil {
+			return st.enterFailed(dst, err)
+		}
+		defer st.leave()
+		return st.appendReflectArray(dst, rv)
+	case reflect.Array:
+		if err := st.enter(0); err != nil {
+			return st.enterFailed(dst, err)
+		}
+		defer st.leave()
+		return st.appendReflectArray(dst, rv)
+	case reflect.Struct:
+		if err := st.enter(0); err != nil {
+			return st.enterFailed(dst, err)
+		}
+		defer st.leave()
+		n := 0
+		dst = append(dst, '{')
+		dst, err := st.appendReflectStructFields(dst, rv, &n)
+		if err != nil {
+			return dst, err
+		}
+		return append(dst, '}'), nil
+	}
+
+	// chan, func, complex, unsafe.Pointer
+	return st.fail(dst, rv.Kind().String(), fmt.Errorf("unsupported type %v", rv.Type()))
+}
+
+func (st *jsonState) appendReflectArray(dst []byte, rv reflect.Value) ([]byte, error) {
+	var err error
+	dst = append(dst, '[')
+	for i := 0; i < rv.Len(); i++ {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst, err = st.appendReflect(dst, rv.Index(i))
+		if err != nil {
+			return dst, err
+		}
+	}
+	return append(dst, ']'), nil
+}
+
+func (st *jsonState) appendReflectMap(dst []byte, rv reflect.Value) ([]byte, error) {
+	if rv.IsNil() {
+		return append(dst, "null"...), nil
+	}
+	if err := st.enter(rv.Pointer()); err != nil {
+		return st.enterFailed(dst, err)
+	}
+	defer st.leave()
+
+	type kv struct {
+		key   string
+		value reflect.Value
+	}
+	kvs := make([]kv, 0, rv.Len())
+	iter := rv.MapRange()
+	for iter.Next() {
+		kvs = append(kvs, kv{key: reflectMapKey(iter.Key()), value: iter.Value()})
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].key < kvs[j].key })
+
+	var err error
+	dst = append(dst, '{')
+	for i := range kvs {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = appendJSONString(dst, kvs[i].key)
+		dst = append(dst, ':')
+		dst, err = st.appendReflect(dst, kvs[i].value)
+		if err != nil {
+			return dst, err
+		}
+	}
+	return append(dst, '}'), nil
+}
+
+func reflectMapKey(k reflect.Value) string {
+	if k.Kind() == reflect.String {
+		return k.String()
+	}
+	if k.Type().Implements(textMarshalerType) && k.CanInterface() {
+		if b, err := k.Interface().(encoding.TextMarshaler).MarshalText(); err == nil {
+			return string(b)
+		}
+	}
+	switch k.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(k.Uint(), 10)
+	}
+	return fmt.Sprint(k.Interface())
+}
+
+// Appends the exported fields, with the embedded structs inlined, the way encoding/json does it
+// (without its name conflict resolution though, a duplicate name is simply written twice);
+// n counts the fields written so far, for the commas.
+func (st *jsonState) appendReflectStructFields(dst []byte, rv reflect.Value, n *int) ([]byte, error) {
+	var err error
+	t := rv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name, opts := sf.Name, ""
+		if tag, ok := sf.Tag.Lookup("json"); ok {
+			if tag == "-" {
+				continue
+			}
+			if j := strings.IndexByte(tag, ','); j >= 0 {
+				name, opts = tag[:j], tag[j:]
+			} else {
+				name = tag
+			}
+			if name == "" {
+				name = sf.Name
+			}
+		}
+		fv := rv.Field(i)
+
+		if sf.Anonymous && !strings.Contains(string(sf.Tag), `json:"`) {
+			ft := sf.Type
+			if ft.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					continue
+				}
+				ft, fv = ft.Elem(), fv.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				dst, err = st.appendReflectStructFields(dst, fv, n)
+				if err != nil {
+					return dst, err
+				}
+				continue
+			}
+		}
+		if sf.PkgPath != "" {
+			continue // unexported
+		}
+		if strings.Contains(opts, ",omitempty") && isEmptyValue(fv) {
+			continue
+		}
+
+		if *n > 0 {
+			dst = append(dst, ',')
+		}
+		*n++
+		dst = appendJSONString(dst, name)
+		dst = append(dst, ':')
+		dst, err = st.appendReflect(dst, fv)
+		if err != nil {
+			return dst, err
+		}
+	}
+	return dst, nil
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package filtertag
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type failingJSON struct{}
+
+func (failingJSON) MarshalJSON() ([]byte, error) { return nil, errors.New("boom") }
+
+type failingText struct{}
+
+func (failingText) MarshalText() ([]byte, error) { return nil, errors.New("bang") }
+
+type safeNode struct {
+	Name string
+	Next *safeNode `json:"next"`
+}
+
+type safeMixed struct {
+	A    int
+	C    chan int `json:"c"`
+	F    func()
+	Z    complex128
+	In   struct{ X float64 }
+	Skip chan int `json:"-"`
+	Opt  func()   `json:",omitempty"`
+}
+
+type safeMap map[string]interface{}
+
+// The values the encoding/json fails on get the placeholders, and the "marshalerrors" says why
+func TestSafeJSONPlaceholders(t *testing.T) {
+	cyclicMap := map[string]interface{}{"a": 1}
+	cyclicMap["self"] = cyclicMap
+	cyclicTyped := safeMap{"a": 1}
+	cyclicTyped["self"] = cyclicTyped
+	cyclicSlice := []interface{}{1, nil}
+	cyclicSlice[1] = cyclicSlice
+	node := &safeNode{Name: "a"}
+	node.Next = &safeNode{Name: "b", Next: node}
+
+	for _, c := range []struct {
+		name  string
+		value interface{}
+		want  string
+		errs  []string
+	}{
+		{"chan", make(chan int), `"!chan"`, []string{"v: unsupported type chan int"}},
+		{"func", func() {}, `"!func"`, []string{"v: unsupported type func()"}},
+		{"complex", complex(1, 2), `"!complex128"`, []string{"v: unsupported type complex128"}},
+		{"nan", math.NaN(), `"!NaN"`, nil},
+		{"struct", safeMixed{A: 1, C: make(chan int), In: struct{ X float64 }{math.Inf(-1)}},
+			`{"A":1,"c":"!chan","F":"!func","Z":"!complex128","In":{"X":"!-Inf"},"Opt":"!func"}`,
+			[]string{"v: unsupported type chan int", "v: unsupported type func()", "v: unsupported type complex128",
+				"v: unsupported value: -Inf", "v: unsupported type func()"}},
+		{"map", cyclicMap, `{"a":1,"self":"!cycle"}`, []string{"v: cycle detected"}},
+		{"typed map", cyclicTyped, `{"a":1,"self":"!cycle"}`, []string{"v: cycle detected"}},
+		{"slice", cyclicSlice, `[1,"!cycle"]`, []string{"v: cycle detected"}},
+		{"pointer", node, `{"Name":"a","next":{"Name":"b","next":"!cycle"}}`, []string{"v: cycle detected"}},
+		{"MarshalJSON", []interface{}{failingJSON{}}, `["!error"]`, []string{"v: MarshalJSON of filtertag.failingJSON: boom"}},
+		{"MarshalText", map[string]failingText{"k": {}}, `{"k":"!error"}`, []string{"v: MarshalText of filtertag.failingText: bang"}},
+	} {
+		line, err := (&JSONEncoder{Safe: true}).Encode(nil, map[string]interface{}{"v": c.value})
+		if err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		var fields struct {
+			V             json.RawMessage
+			MarshalErrors []string `json:"marshalerrors"`
+		}
+		if err := json.Unmarshal(line, &fields); err != nil {
+			t.Fatalf("%v: %s: %v", c.name, line, err)
+		}
+		if string(fields.V) != c.want {
+			t.Errorf("%v: got %s, want %s", c.name, fields.V, c.want)
+		}
+		if c.errs == nil {
+			if len(fields.MarshalErrors) != 1 || !strings.HasPrefix(fields.MarshalErrors[0], "v: ") {
+				t.Errorf("%v: got %q", c.name, fields.MarshalErrors)
+			}
+		} else if !reflect.DeepEqual(fields.MarshalErrors, c.errs) {
+			t.Errorf("%v: got %q, want %q", c.name, fields.MarshalErrors, c.errs)
+		}
+
+		// outside of the Safe mode, the line fails
+		if line, err := (&JSONEncoder{}).Encode(nil, map[string]interface{}{"v": c.value}); err == nil {
+			t.Errorf("%v: got %s", c.name, line)
+		}
+	}
+}
+
+// Nested deeper than the MaxDepth, by the maps and slices the encoder walks itself, and by
+// the structs walked by the reflection (when the json.Marshal has failed on them)
+func TestSafeJSONMaxDepth(t *testing.T) {
+	type deep struct {
+		In interface{} `json:"in"`
+	}
+	var walked, reflected interface{} = "bottom", struct{ C chan int }{make(chan int)}
+	for i := 0; i < 6; i++ {
+		if i%2 == 0 {
+			walked = map[string]interface{}{"m": walked}
+		} else {
+			walked = []interface{}{walked}
+		}
+		reflected = &deep{In: reflected}
+	}
+	enc := &JSONEncoder{Safe: true, MaxDepth: 4}
+	line, err := enc.Encode(nil, map[string]interface{}{"walked": walked, "reflected": reflected})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"reflected":{"in":{"in":"!maxdepth"}},"walked":[{"m":[{"m":"!maxdepth"}]}],` +
+		`"marshalerrors":["reflected: nesting deeper than 4","walked: nesting deeper than 4"]}` + "\n"
+	if string(line) != want {
+		t.Fatalf("got  %s\nwant %s", line, want)
+	}
+	if line, err := (&JSONEncoder{MaxDepth: 4}).Encode(nil, map[string]interface{}{"walked": walked}); err == nil {
+		t.Fatalf("got %s", line)
+	}
+	// within the DefaultMaxDepth
+	line, err = (&JSONEncoder{Safe: true}).Encode(nil, map[string]interface{}{"walked": walked})
+	if err != nil || strings.Contains(string(line), "marshalerrors") {
+		t.Fatalf("got %s, %v", line, err)
+	}
+}
+
+// The errors of all the fields are listed, the other fields are there as they are
+func TestSafeJSONMarshalErrors(t *testing.T) {
+	fields := map[string]interface{}{
+		"a":   make(chan int),
+		"b":   "ok",
+		"c":   failingJSON{},
+		"msg": "hello",
+	}
+	line, err := (&JSONEncoder{Safe: true}).Encode(nil, fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"a":"!chan","b":"ok","c":"!error","msg":"hello","marshalerrors":["a: unsupported type chan int","c: MarshalJSON of filtertag.failingJSON: boom"]}` + "\n"
+	if string(line) != want {
+		t.Fatalf("got  %s\nwant %s", line, want)
+	}
+}
@@ -0,0 +1,381 @@
+package filtertag
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The sinks are the io.Writer-s to be set as the Logger.Output. The logger goroutine calls
+// the Output.Write() exactly once per line, with the complete encoded line (its buffer is
+// reused after the Write returns, so a sink must copy whatever it keeps).
+//
+// The network sinks never block the logger goroutine: the lines go into a bounded
+// queue, and are sent from the sink's own goroutine, which ends with the ctx given to
+// the sink's Make...() function, or with its Close().
+
+var ErrSinkClosed = errors.New("filtertag: sink is closed")
+
+// How the lines are delimited on a stream. Framing_Newline sends the lines as they are: the
+// text encoders end them with "\n", and the lines of the binary encoders are length-prefixed
+// frames already, so Framing_LengthPrefix is for the text lines only.
+const (
+	Framing_Newline      int = iota
+	Framing_LengthPrefix     // 4 bytes big-endian length before every line
+)
+
+func appendFramed(dst []byte, line []byte, framing int) []byte {
+	if framing == Framing_LengthPrefix {
+		var hdr [FrameHeaderSize]byte
+		binary.BigEndian.PutUint32(hdr[:], uint32(len(line)))
+		dst = append(dst, hdr[:]...)
+	}
+	return append(dst, line...)
+}
+
+// Backoff is the exponential delay between the reconnects or retries, with a ±20% jitter
+type Backoff struct {
+	Min    time.Duration
+	Max    time.Duration
+	Factor float64
+}
+
+var DefaultBackoff = Backoff{
+	Min:    100 * time.Millisecond,
+	Max:    30 * time.Second,
+	Factor: 2,
+}
+
+func (b Backoff) Delay(attempt int) time.Duration {
+	if b.Min <= 0 {
+		b = DefaultBackoff
+	}
+	d := float64(b.Min)
+	for i := 0; i < attempt && d < float64(b.Max); i++ {
+		d *= b.Factor
+	}
+	if d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	d *= 0.8 + 0.4*rand.Float64()
+	return time.Duration(d)
+}
+
+// SinkStats are the counters of a sink, since it was made
+type SinkStats struct {
+	Lines      uint64 // accepted by Write()
+	Written    uint64 // delivered
+	Lost       uint64 // dropped: the buffer overflowed, or the retries ran out
+	Errors     uint64 // failed attempts to deliver (some of them delivered later on retry)
+	Reconnects uint64
+}
+
+// The counters are only touched atomically, they're read by Stats() from any goroutine
+type sinkCounters struct {
+	lines      uint64
+	written    uint64
+	lost       uint64
+	errors     uint64
+	reconnects uint64
+}
+
+func (c *sinkCounters) Stats() SinkStats {
+	return SinkStats{
+		Lines:      atomic.LoadUint64(&c.lines),
+		Written:    atomic.LoadUint64(&c.written),
+		Lost:       atomic.LoadUint64(&c.lost),
+		Errors:     atomic.LoadUint64(&c.errors),
+		Reconnects: atomic.LoadUint64(&c.reconnects),
+	}
+}
+
+// Encodes a line of the filtertag itself (the "filtertag" subsystem), for the places which
+// write right to a sink, not by an Entry
+func appendDiagnosticLine(enc Encoder, dst []byte, host, exe string, filtertags []string, msg string, err error) ([]byte, error) {
+	fields := map[string]interface{}{
+		"timestamp":  &Timestamp{Time: time.Now()},
+		"host":       host,
+		"service":    exe,
+		"subsystem":  "filtertag",
+		"filtertags": map[string][]string{"logger": filtertags},
+		"msg":        msg,
+		"err":        "",
+	}
+	if err != nil {
+		fields["err"] = err.Error()
+	}
+	return encodeRecovered(enc, dst, fields)
+}
+
+// DownReporter is implemented by the sinks which queue the lines (so their Write never
+// fails): Down returns why the lines can't be delivered right now (the connection is broken,
+// the batches fail), nil if they can. The ChainSink passes the lines by a link which is down
+// on to the next one.
+type DownReporter interface {
+	Down() error
+}
+
+// The Down() of a queueing sink, set by its goroutine on every delivery attempt
+type sinkHealth struct {
+	mu   sync.Mutex
+	down error
+}
+
+func (h *sinkHealth) Down() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.down
+}
+
+func (h *sinkHealth) setDown(err error) {
+	h.mu.Lock()
+	h.down = err
+	h.mu.Unlock()
+}
+
+// lineQueue is the bounded buffer between the Write() and the sink's goroutine. When it's
+// full (by the lines or by the bytes), the oldest lines are dropped to make room, and
+// counted as lost; or with the spill queue, the lines go to the disk instead, and come
+// back from there (by the refill) as the sink catches up.
+type lineQueue struct {
+	ch       chan []byte
+	bytes    int64 // atomic
+	maxBytes int64
+	counters *sinkCounters
+	spill    *SpillQueue
+}
+
+const (
+	DefaultBufferLines = 10000
+	DefaultBufferBytes = 8 << 20
+)
+
+func makeLineQueue(
+	maxLines int,
+	maxBytes int,
+	spill *SpillQueue,
+	counters *sinkCounters,
+) *lineQueue {
+	if maxLines <= 0 {
+		maxLines = DefaultBufferLines
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultBufferBytes
+	}
+	return &lineQueue{
+		ch:       make(chan []byte, maxLines),
+		maxBytes: int64(maxBytes),
+		counters: counters,
+		spill:    spill,
+	}
+}
+
+// Copies the line into the queue, never blocks
+func (q *lineQueue) push(p []byte) {
+	atomic.AddUint64(&q.counters.lines, 1)
+	if q.spill != nil && q.pushSpill(p) {
+		return
+	}
+	line := append([]byte(nil), p...)
+	for atomic.LoadInt64(&q.bytes)+int64(len(line)) > q.maxBytes {
+		if !q.dropOldest() {
+			break
+		}
+	}
+	for {
+		select {
+		case q.ch <- line:
+			atomic.AddInt64(&q.bytes, int64(len(line)))
+			return
+		default:
+			if !q.dropOldest() {
+				// somebody has just drained it, try again
+				continue
+			}
+		}
+	}
+}
+
+func (q *lineQueue) dropOldest() bool {
+	select {
+	case old := <-q.ch:
+		atomic.AddInt64(&q.bytes, -int64(len(old)))
+		atomic.AddUint64(&q.counters.lost, 1)
+		return true
+	default:
+		return false
+	}
+}
+
+// Once there's anything in the spill queue, all the lines go there, to stay in order; and
+// when the buffer is full. A line the spill queue fails to take (not because it's full)
+// goes to the buffer after all.
+func (q *lineQueue) pushSpill(p []byte) bool {
+	if q.spill.Len() == 0 && len(q.ch) < cap(q.ch) && atomic.LoadInt64(&q.bytes)+int64(len(p)) <= q.maxBytes {
+		return false
+	}
+	dropped, err := q.spill.append(p)
+	atomic.AddUint64(&q.counters.lost, uint64(dropped))
+	if err == errSpillFull {
+		atomic.AddUint64(&q.counters.lost, 1)
+		return true
+	}
+	return err == nil
+}
+
+// Moves the spilled lines back into the buffer, in order, as it has room for them; run by
+// the sink in a goroutine of its own, until the stop or the ctx. What's still spilled then
+// stays on the disk, for the next run.
+func (q *lineQueue) refill(ctx context.Context, stop <-chan struct{}) {
+	for {
+		line, pos, err := q.spill.peek()
+		if err != nil {
+			// closed, or the disk fails: the segment is dropped, not to get stuck on it
+			if err == errSpillClosed {
+				return
+			}
+			if dropped := q.spill.skipSegment(pos); dropped > 0 {
+				atomic.AddUint64(&q.counters.lost, uint64(dropped))
+				continue
+			}
+			select {
+			case <-time.After(time.Second):
+				continue
+			case <-ctx.Done():
+				return
+			case <-stop:
+				return
+			}
+		}
+		if line == nil {
+			select {
+			case <-q.spill.ready:
+				continue
+			case <-ctx.Done():
+				return
+			case <-stop:
+				return
+			}
+		}
+
+		select {
+		case q.ch <- line:
+			atomic.AddInt64(&q.bytes, int64(len(line)))
+			q.spill.pop(pos)
+		case <-ctx.Done():
+			return
+		case <-stop:
+			return
+		}
+	}
+}
+
+// For the consumer: every line received from q.ch must be passed here
+func (q *lineQueue) taken(line []byte) {
+	atomic.AddInt64(&q.bytes, -int64(len(line)))
+}
+
+// The time of the line, from its "timestamp" field; now, if there's none or it can't be parsed
+func lineTime(fields map[string]interface{}) time.Time {
+	switch ts := fields["timestamp"].(type) {
+	case string:
+		// the zone abbreviation of the local zone (where the line is made, usually) gets its offset
+		if t, err := time.ParseInLocation(TimestampLayout, ts, time.Local); err == nil {
+			return t
+		}
+		if t, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+			return t
+		}
+	case time.Time:
+		return ts
+	case *Timestamp:
+		if ts != nil {
+			return ts.Time
+		}
+	}
+	return time.Now()
+}
+
+// All the filtertags of the decoded line, of all the keys of the "filtertags" map, sorted
+func lineFiltertags(fields map[string]interface{}) []string {
+	var tags []string
+	add := func(v interface{}) {
+		switch v := v.(type) {
+		case []string:
+			tags = append(tags, v...)
+		case []interface{}:
+			for _, t := range v {
+				if s, ok := t.(string); ok {
+					tags = append(tags, s)
+				}
+			}
+		case string:
+			tags = append(tags, v)
+		}
+	}
+	switch ft := fields["filtertags"].(type) {
+	case map[string]interface{}:
+		for _, v := range ft {
+			add(v)
+		}
+	case map[string][]string:
+		for _, v := range ft {
+			add(v)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// The field as a string, "" if it's missing; the non-strings are formatted with fmt
+func fieldString(fields map[string]interface{}, key string) string {
+	switch v := fields[key].(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// fieldTemplate is a template with holes (see LogTemplate()) filled from the fields of a line,
+// like the "logs.{service}" topic of the NSQSink
+type fieldTemplate []templatePart
+
+func parseFieldTemplate(template string) fieldTemplate {
+	return fieldTemplate(parseTemplate(template))
+}
+
+// Whether the template has no holes, so there's no need to decode the lines for it
+func (t fieldTemplate) constant() bool {
+	for _, p := range t {
+		if p.hole {
+			return false
+		}
+	}
+	return true
+}
+
+func (t fieldTemplate) render(fields map[string]interface{}) string {
+	if len(t) == 1 && !t[0].hole {
+		return t[0].text
+	}
+	var b []byte
+	for _, p := range t {
+		if p.hole {
+			b = append(b, fieldString(fields, p.text)...)
+		} else {
+			b = append(b, p.text...)
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,77 @@
+package filtertag
+
+import (
+	"encoding/binary"
+)
+
+// appendSnappy compresses src in the snappy block format (what Loki wants for its protobuf
+// pushes): the varint length, then the literals and the copies. It's the simple greedy
+// matcher, not as tight as the reference implementation, but compatible with it.
+func appendSnappy(dst []byte, src []byte) []byte {
+	dst = appendProtoVarint(dst, uint64(len(src)))
+	if len(src) < 8 {
+		return appendSnappyLiteral(dst, src)
+	}
+
+	const tableBits = 14
+	var table [1 << tableBits]int32 // the position+1 of the last 4 bytes with this hash
+
+	lit := 0
+	for i := 0; i+4 <= len(src); {
+		cur := binary.LittleEndian.Uint32(src[i:])
+		h := (cur * 0x1e35a7bd) >> (32 - tableBits)
+		cand := int(table[h]) - 1
+		table[h] = int32(i + 1)
+
+		if cand < 0 || i-cand > 0xffff || binary.LittleEndian.Uint32(src[cand:]) != cur {
+			i++
+			continue
+		}
+
+		dst = appendSnappyLiteral(dst, src[lit:i])
+		n := 4
+		for i+n < len(src) && src[cand+n] == src[i+n] {
+			n++
+		}
+		dst = appendSnappyCopy(dst, i-cand, n)
+		i += n
+		lit = i
+	}
+	return appendSnappyLiteral(dst, src[lit:])
+}
+
+func appendSnappyLiteral(dst []byte, lit []byte) []byte {
+	n := len(lit) - 1
+	switch {
+	case n < 0:
+		return dst
+	case n < 60:
+		dst = append(dst, byte(n)<<2)
+	case n < 1<<8:
+		dst = append(dst, 60<<2, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+// A copy of n >= 4 bytes from the offset back, split into the elements of at most 64 bytes
+func appendSnappyCopy(dst []byte, offset int, n int) []byte {
+	for n >= 68 {
+		dst = append(dst, 63<<2|2, byte(offset), byte(offset>>8))
+		n -= 64
+	}
+	if n > 64 {
+		// leaves at least 4 for the last one
+		dst = append(dst, 59<<2|2, byte(offset), byte(offset>>8))
+		n -= 60
+	}
+	if n >= 12 || offset >= 2048 {
+		return append(dst, byte(n-1)<<2|2, byte(offset), byte(offset>>8))
+	}
+	return append(dst, byte(offset>>8)<<5|byte(n-4)<<2|1, byte(offset))
+}
@@ -0,0 +1,468 @@
+package filtertag
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	SpillEviction_DropOldest int = iota // the oldest segment goes to make room
+	SpillEviction_DropNewest            // the new lines are dropped while it's full
+)
+
+type SpillQueueConfig struct {
+	Dir          string // one queue per dir; it's created if missing
+	SegmentBytes int64  // 16MB if zero
+	MaxBytes     int64  // of the records in the queue, 1GB if zero
+	Eviction     int    // SpillEviction_DropOldest or SpillEviction_DropNewest
+
+	// Fsyncs every record; otherwise it's left to the OS, so a crash of the process loses
+	// nothing, but a crash of the machine may lose the last records
+	Sync bool
+}
+
+// SpillQueue is the write-ahead queue on the disk, where the lines go when a sink can't keep
+// up (see the Spill of the NetSinkConfig, BatchConfig and Logger), and come back from in the
+// same order. The records are in the segment files, every one with its CRC; the read
+// position is saved in the cursor file, so after a restart the queue goes on from where it
+// stopped (a few lines may come twice then, those read after the cursor was last saved).
+// A torn record at the end of a segment (of a crash) is cut off, a corrupt one in the middle
+// ends the segment; so does a record found corrupt when it's read (the file was damaged
+// after the start), the rest of the segment is dropped then.
+type SpillQueue struct {
+	Config SpillQueueConfig
+
+	mu       sync.Mutex
+	segments []*spillSegment // the first one is read, the last one written
+	w        *os.File        // the last segment
+	r        *os.File        // the first segment
+	readOff  int64
+	head     []byte // the record at the readOff, once read
+	count    int
+	bytes    int64
+	pops     int // since the cursor was saved
+	closed   bool
+
+	ready chan struct{} // signalled by the append
+}
+
+type spillSegment struct {
+	seq     uint64
+	size    int64 // up to the last valid record
+	records int
+}
+
+// The position of a record, to pop just the record which was peeked
+type spillPos struct {
+	seq uint64
+	off int64
+}
+
+var (
+	errSpillFull    = errors.New("filtertag: spill queue is full")
+	errSpillClosed  = errors.New("filtertag: spill queue is closed")
+	errSpillCorrupt = errors.New("filtertag: spill queue record is corrupt")
+)
+
+var spillCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+const (
+	spillRecordHeader = 8 // the length and the CRC32-C of the data, 4 bytes big-endian each
+	spillCursorEvery  = 100
+	spillSegmentExt   = ".seg"
+	spillCursorFile   = "cursor"
+)
+
+// Opens the queue in the Dir, with whatever is left there from the last run
+func MakeSpillQueue(config SpillQueueConfig) (*SpillQueue, error) {
+	if config.SegmentBytes <= 0 {
+		config.SegmentBytes = 16 << 20
+	}
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = 1 << 30
+	}
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, err
+	}
+	q := &SpillQueue{
+		Config: config,
+		ready:  make(chan struct{}, 1),
+	}
+	if err := q.recover(); err != nil {
+		q.closeFiles()
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *SpillQueue) segmentPath(seq uint64) string {
+	return filepath.Join(q.Config.Dir, fmt.Sprintf("%020d%s", seq, spillSegmentExt))
+}
+
+func (q *SpillQueue) recover() error {
+	entries, err := os.ReadDir(q.Config.Dir)
+	if err != nil {
+		return err
+	}
+	var seqs []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, spillSegmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spillSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	cursorSeq, cursorOff := q.readCursor()
+	for _, seq := range seqs {
+		if seq < cursorSeq {
+			// read completely, but not removed yet
+			os.Remove(q.segmentPath(seq))
+			continue
+		}
+		seg := &spillSegment{seq: seq}
+		from := int64(0)
+		if seq == cursorSeq {
+			from = cursorOff
+		}
+		if err := q.scanSegment(seg, from); err != nil {
+			return err
+		}
+		if seg.records == 0 {
+			os.Remove(q.segmentPath(seq))
+			continue
+		}
+		if len(q.segments) == 0 {
+			q.readOff = from
+		}
+		q.segments = append(q.segments, seg)
+		q.count += seg.records
+	}
+
+	next := uint64(0)
+	if len(q.segments) > 0 {
+		next = q.segments[len(q.segments)-1].seq + 1
+	}
+	// the writes always go to a new segment, whatever is at the end of the last one
+	return q.newSegment(next)
+}
+
+// Counts the valid records of the segment from the offset, and cuts off what's after them
+func (q *SpillQueue) scanSegment(seg *spillSegment, from int64) error {
+	f, err := os.OpenFile(q.segmentPath(seg.seq), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	off := from
+	var hdr [spillRecordHeader]byte
+	var data []byte
+	for {
+		if _, err := f.ReadAt(hdr[:], off); err != nil {
+			break
+		}
+		n := int64(binary.BigEndian.Uint32(hdr[:4]))
+		if off+spillRecordHeader+n > info.Size() {
+			break
+		}
+		if int64(cap(data)) < n {
+			data = make([]byte, n)
+		}
+		data = data[:n]
+		if _, err := f.ReadAt(data, off+spillRecordHeader); err != nil {
+			break
+		}
+		if crc32.Checksum(data, spillCRCTable) != binary.BigEndian.Uint32(hdr[4:]) {
+			break
+		}
+		off += spillRecordHeader + n
+		seg.records++
+		q.bytes += spillRecordHeader + n
+	}
+	seg.size = off
+	if off < info.Size() {
+		return f.Truncate(off)
+	}
+	return nil
+}
+
+func (q *SpillQueue) readCursor() (seq uint64, off int64) {
+	b, err := os.ReadFile(filepath.Join(q.Config.Dir, spillCursorFile))
+	if err != nil || len(b) != 16 {
+		return 0, 0
+	}
+	return binary.BigEndian.Uint64(b[:8]), int64(binary.BigEndian.Uint64(b[8:]))
+}
+
+// Written to a temp file and renamed, so it's either the old one or the new one
+func (q *SpillQueue) saveCursor() {
+	q.pops = 0
+	if len(q.segments) == 0 {
+		return
+	}
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], q.segments[0].seq)
+	binary.BigEndian.PutUint64(b[8:], uint64(q.readOff))
+	path := filepath.Join(q.Config.Dir, spillCursorFile)
+	if err := os.WriteFile(path+".tmp", b[:], 0644); err != nil {
+		return
+	}
+	os.Rename(path+".tmp", path)
+}
+
+func (q *SpillQueue) newSegment(seq uint64) error {
+	if q.w != nil {
+		if q.Config.Sync {
+			q.w.Sync()
+		}
+		q.w.Close()
+		q.w = nil
+	}
+	f, err := os.OpenFile(q.segmentPath(seq), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	q.w = f
+	q.segments = append(q.segments, &spillSegment{seq: seq})
+	return nil
+}
+
+// Appends the line; when the queue is full, either the oldest segments are dropped (and
+// their unread records are returned as the dropped), or the line is refused
+func (q *SpillQueue) append(line []byte) (dropped int, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return 0, errSpillClosed
+	}
+
+	size := int64(spillRecordHeader + len(line))
+	for q.bytes+size > q.Config.MaxBytes {
+		if q.Config.Eviction == SpillEviction_DropNewest || q.bytes == 0 {
+			return dropped, errSpillFull
+		}
+		if len(q.segments) == 1 {
+			// the one being written is the oldest too
+			if err := q.newSegment(q.segments[0].seq + 1); err != nil {
+				return dropped, err
+			}
+		}
+		dropped += q.dropFirstSegment()
+	}
+
+	last := q.segments[len(q.segments)-1]
+	if last.size > 0 && last.size+size > q.Config.SegmentBytes {
+		if err := q.newSegment(last.seq + 1); err != nil {
+			return dropped, err
+		}
+		last = q.segments[len(q.segments)-1]
+	}
+
+	rec := make([]byte, spillRecordHeader, size)
+	binary.BigEndian.PutUint32(rec[:4], uint32(len(line)))
+	binary.BigEndian.PutUint32(rec[4:8], crc32.Checksum(line, spillCRCTable))
+	rec = append(rec, line...)
+	if _, err := q.w.Write(rec); err != nil {
+		// the segment may end with a part of the record now, so no more writes to it
+		q.newSegment(last.seq + 1)
+		return dropped, err
+	}
+	if q.Config.Sync {
+		q.w.Sync()
+	}
+	last.size += size
+	last.records++
+	q.count++
+	q.bytes += size
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return dropped, nil
+}
+
+// Removes the first segment with its unread records, which are returned
+func (q *SpillQueue) dropFirstSegment() int {
+	seg := q.segments[0]
+	unread := seg.records
+	q.count -= unread
+	q.bytes -= seg.size - q.readOff
+	if q.r != nil {
+		q.r.Close()
+		q.r = nil
+	}
+	os.Remove(q.segmentPath(seg.seq))
+	q.segments = q.segments[1:]
+	q.readOff = 0
+	q.head = nil
+	q.saveCursor()
+	return unread
+}
+
+// Drops the first segment (which fails to be read) with its unread records, which are
+// returned
+func (q *SpillQueue) skipSegment(pos spillPos) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed || len(q.segments) == 0 || q.segments[0].seq != pos.seq {
+		return 0
+	}
+	if len(q.segments) == 1 {
+		if err := q.newSegment(pos.seq + 1); err != nil {
+			return 0
+		}
+	}
+	return q.dropFirstSegment()
+}
+
+// The oldest record, not removed yet (see the pop); nil if there's none. On an error the
+// segment can't be read on, drop it (see the skipSegment).
+func (q *SpillQueue) peek() ([]byte, spillPos, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil, spillPos{}, errSpillClosed
+	}
+	if q.count == 0 {
+		return nil, spillPos{}, nil
+	}
+	for q.segments[0].records == 0 {
+		// read up while it was the one being written too
+		q.nextSegment()
+	}
+	seg := q.segments[0]
+	pos := spillPos{seq: seg.seq, off: q.readOff}
+	if q.head != nil {
+		return q.head, pos, nil
+	}
+
+	if q.r == nil {
+		f, err := os.Open(q.segmentPath(seg.seq))
+		if err != nil {
+			return nil, pos, err
+		}
+		q.r = f
+	}
+	var hdr [spillRecordHeader]byte
+	if _, err := q.r.ReadAt(hdr[:], q.readOff); err != nil {
+		return nil, pos, err
+	}
+	n := int64(binary.BigEndian.Uint32(hdr[:4]))
+	if q.readOff+spillRecordHeader+n > seg.size {
+		return nil, pos, errSpillCorrupt
+	}
+	data := make([]byte, n)
+	if _, err := q.r.ReadAt(data, q.readOff+spillRecordHeader); err != nil && err != io.EOF {
+		return nil, pos, err
+	}
+	if crc32.Checksum(data, spillCRCTable) != binary.BigEndian.Uint32(hdr[4:]) {
+		return nil, pos, errSpillCorrupt
+	}
+	q.head = data
+	return data, pos, nil
+}
+
+// Removes the record peeked at the pos; if it was dropped meanwhile, does nothing
+func (q *SpillQueue) pop(pos spillPos) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed || q.count == 0 || q.segments[0].seq != pos.seq || q.readOff != pos.off {
+		return
+	}
+	if q.head == nil {
+		return
+	}
+	seg := q.segments[0]
+	size := int64(spillRecordHeader + len(q.head))
+	q.head = nil
+	q.readOff += size
+	seg.records--
+	q.count--
+	q.bytes -= size
+
+	if seg.records == 0 && len(q.segments) > 1 {
+		q.nextSegment()
+		return
+	}
+	q.pops++
+	if q.pops >= spillCursorEvery {
+		q.saveCursor()
+	}
+}
+
+// Removes the first segment, read completely
+func (q *SpillQueue) nextSegment() {
+	if q.r != nil {
+		q.r.Close()
+		q.r = nil
+	}
+	os.Remove(q.segmentPath(q.segments[0].seq))
+	q.segments = q.segments[1:]
+	q.readOff = 0
+	q.saveCursor()
+}
+
+// Len is the number of the records in the queue (0 once it's closed)
+func (q *SpillQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return 0
+	}
+	return q.count
+}
+
+// Bytes is the size of the records in the queue, on the disk
+func (q *SpillQueue) Bytes() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.bytes
+}
+
+// Close saves the cursor and closes the files; the records stay for the next run
+func (q *SpillQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	q.saveCursor()
+	var err error
+	if q.w != nil {
+		err = q.w.Sync()
+	}
+	q.closeFiles()
+	return err
+}
+
+func (q *SpillQueue) closeFiles() {
+	if q.w != nil {
+		q.w.Close()
+		q.w = nil
+	}
+	if q.r != nil {
+		q.r.Close()
+		q.r = nil
+	}
+}
@@ -0,0 +1,297 @@
+package filtertag
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func drainSpill(t *testing.T, q *SpillQueue) []string {
+	var out []string
+	for {
+		line, pos, err := q.peek()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == nil {
+			return out
+		}
+		out = append(out, string(line))
+		q.pop(pos)
+	}
+}
+
+func TestSpillQueueOrderAndRecovery(t *testing.T) {
+	dir := t.TempDir()
+	q, err := MakeSpillQueue(SpillQueueConfig{Dir: dir, SegmentBytes: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		q.append([]byte(fmt.Sprintf("line%03d", i)))
+	}
+	if q.Len() != 50 {
+		t.Fatal(q.Len())
+	}
+	// read 20 (some segments removed)
+	for i := 0; i < 20; i++ {
+		line, pos, _ := q.peek()
+		if string(line) != fmt.Sprintf("line%03d", i) {
+			t.Fatal(string(line))
+		}
+		q.pop(pos)
+	}
+	q.Close()
+
+	// torn tail on the last segment
+	m, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	last := m[len(m)-1]
+	f, _ := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0)
+	f.Write([]byte{0, 0, 0, 50, 1, 2})
+	f.Close()
+
+	q, err = MakeSpillQueue(SpillQueueConfig{Dir: dir, SegmentBytes: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Len() != 30 {
+		t.Fatal(q.Len())
+	}
+	q.append([]byte("new"))
+	out := drainSpill(t, q)
+	if len(out) != 31 || out[0] != "line020" || out[29] != "line049" || out[30] != "new" {
+		t.Fatal(out)
+	}
+	q.Close()
+	q, _ = MakeSpillQueue(SpillQueueConfig{Dir: dir})
+	if q.Len() != 0 {
+		t.Fatal(q.Len())
+	}
+	q.Close()
+}
+
+func TestSpillQueueCorruptAndEviction(t *testing.T) {
+	dir := t.TempDir()
+	q, _ := MakeSpillQueue(SpillQueueConfig{Dir: dir, SegmentBytes: 1000})
+	for i := 0; i < 5; i++ {
+		q.append([]byte("abcdefgh"))
+	}
+	q.Close()
+	m, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	b, _ := os.ReadFile(m[0])
+	b[16*2+10] ^= 0xff // 3rd record data
+	os.WriteFile(m[0], b, 0644)
+	q, _ = MakeSpillQueue(SpillQueueConfig{Dir: dir, SegmentBytes: 1000})
+	if q.Len() != 2 {
+		t.Fatal(q.Len())
+	}
+	q.Close()
+
+	dir = t.TempDir()
+	q, _ = MakeSpillQueue(SpillQueueConfig{Dir: dir, SegmentBytes: 32, MaxBytes: 64})
+	lost := 0
+	for i := 0; i < 10; i++ {
+		d, err := q.append([]byte(fmt.Sprintf("r%07d", i))) // 16 bytes each rec
+		if err != nil {
+			t.Fatal(err)
+		}
+		lost += d
+	}
+	out := drainSpill(t, q)
+	if len(out)+lost != 10 || out[len(out)-1] != "r0000009" || len(out) < 3 {
+		t.Fatal(out, lost)
+	}
+	q.Close()
+
+	q, _ = MakeSpillQueue(SpillQueueConfig{Dir: t.TempDir(), MaxBytes: 32, Eviction: SpillEviction_DropNewest})
+	q.append([]byte("r0000000"))
+	q.append([]byte("r0000001"))
+	if _, err := q.append([]byte("r0000002")); err != errSpillFull {
+		t.Fatal(err)
+	}
+	q.Close()
+}
+
+// A record damaged after the queue was opened: the rest of its segment is dropped
+func TestSpillQueueCorruptRead(t *testing.T) {
+	dir := t.TempDir()
+	q, err := MakeSpillQueue(SpillQueueConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	for i := 0; i < 5; i++ {
+		q.append([]byte(fmt.Sprintf("r%07d", i)))
+	}
+	m, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	f, err := os.OpenFile(m[0], os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{'X'}, 16*2+10) // the 3rd record's data
+	f.Close()
+
+	var out []string
+	for i := 0; i < 2; i++ {
+		line, pos, err := q.peek()
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, string(line))
+		q.pop(pos)
+	}
+	_, pos, err := q.peek()
+	if err != errSpillCorrupt {
+		t.Fatal("read the corrupt record", err)
+	}
+	if dropped := q.skipSegment(pos); dropped != 3 {
+		t.Fatal(dropped)
+	}
+	q.append([]byte("new"))
+	out = append(out, drainSpill(t, q)...)
+	if fmt.Sprint(out) != "[r0000000 r0000001 new]" {
+		t.Fatal(out)
+	}
+}
+
+func TestNetSinkSpill(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := ln.Addr().String()
+	ln.Close()
+	spill, err := MakeSpillQueue(SpillQueueConfig{Dir: t.TempDir(), SegmentBytes: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := MakeNetSink(context.Background(), NetSinkConfig{Network: "tcp", Address: addr, BufferLines: 5, Spill: spill,
+		Backoff: Backoff{Min: 10 * time.Millisecond, Max: 20 * time.Millisecond, Factor: 2}})
+	const n = 300
+	for i := 0; i < n; i++ {
+		sink.Write([]byte(strconv.Itoa(i) + "\n"))
+	}
+	time.Sleep(50 * time.Millisecond)
+	if spill.Len() == 0 {
+		t.Fatal("nothing spilled")
+	}
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := bufio.NewScanner(c)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < n; i++ {
+		if !sc.Scan() {
+			t.Fatalf("at %v: %v %+v", i, sc.Err(), sink.Stats())
+		}
+		if sc.Text() != strconv.Itoa(i) {
+			t.Fatalf("%v != %v", sc.Text(), i)
+		}
+	}
+	sink.Close()
+	spill.Close()
+	if st := sink.Stats(); st.Lost != 0 {
+		t.Fatal(st)
+	}
+}
+
+type slowWriter struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(50 * time.Microsecond)
+	w.mu.Lock()
+	w.lines = append(w.lines, string(p))
+	w.mu.Unlock()
+	return len(p), nil
+}
+
+func TestLoggerSpill(t *testing.T) {
+	entry := MakePrimordialEntryWithLogger(context.Background())
+	logger := entry.GetLogger()
+	w := &slowWriter{}
+	logger.Output = w
+	spill, _ := MakeSpillQueue(SpillQueueConfig{Dir: t.TempDir()})
+	logger.Spill = spill
+	logger.OverflowFunc = func() { t.Error("overflow") }
+	entry.SetLogger(logger)
+	entry.GetLogger()
+	entry.Encoder = &LogfmtEncoder{}
+	entry.Fields = map[string]interface{}{}
+	const n = 5000
+	for i := 0; i < n; i++ {
+		entry.Logft([]string{"INFO"}, "m%d", i)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		w.mu.Lock()
+		k := len(w.lines)
+		w.mu.Unlock()
+		if k == n {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.lines) != n {
+		t.Fatal(len(w.lines))
+	}
+	for i, l := range w.lines {
+		if !strings.Contains(l, fmt.Sprintf("msg=m%d ", i)) && !strings.Contains(l, fmt.Sprintf("msg=m%d\n", i)) {
+			t.Fatalf("%v: %q", i, l)
+		}
+	}
+}
+
+// A spilled line which fails to be written stays in the Spill, and is tried again after a
+// backoff, not in a busy loop; the lines logged meanwhile go after it
+func TestLoggerSpillWriteError(t *testing.T) {
+	entry := MakePrimordialEntryWithLogger(context.Background())
+	logger := entry.GetLogger()
+	w := &flakyWriter{fail: true}
+	logger.Output = w
+	spill, _ := MakeSpillQueue(SpillQueueConfig{Dir: t.TempDir()})
+	defer spill.Close()
+	for i := 0; i < 3; i++ {
+		spill.append([]byte(fmt.Sprintf("s%d\n", i)))
+	}
+	var errs uint32
+	logger.Spill = spill
+	logger.ErrorFunc = func(error) { atomic.AddUint32(&errs, 1) }
+	entry.SetLogger(logger)
+	entry.Encoder = &LogfmtEncoder{}
+	entry.Fields = map[string]interface{}{}
+	entry.Logft([]string{"INFO"}, "m0")
+
+	time.Sleep(300 * time.Millisecond)
+	w.mu.Lock()
+	calls := w.calls
+	w.fail = false
+	w.mu.Unlock()
+	if calls < 2 || calls > 10 || atomic.LoadUint32(&errs) == 0 {
+		t.Fatalf("%v writes, %v errors in 300ms", calls, atomic.LoadUint32(&errs))
+	}
+
+	waitFor(t, "the spill written", func() bool { return spill.Len() == 0 })
+	entry.GetLogger() // after the last line
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	got := w.buf.String()
+	if !strings.HasPrefix(got, "s0\ns1\ns2\n") || strings.Count(got, "\n") != 4 || !strings.Contains(got, "msg=m0") {
+		t.Fatalf("got %q", got)
+	}
+}
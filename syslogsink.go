@@ -0,0 +1,314 @@
+package filtertag
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	SyslogSeverity_Emerg int = iota
+	SyslogSeverity_Alert
+	SyslogSeverity_Crit
+	SyslogSeverity_Err
+	SyslogSeverity_Warning
+	SyslogSeverity_Notice
+	SyslogSeverity_Info
+	SyslogSeverity_Debug
+)
+
+const (
+	SyslogFacility_Kern int = iota
+	SyslogFacility_User
+	SyslogFacility_Mail
+	SyslogFacility_Daemon
+	SyslogFacility_Auth
+	SyslogFacility_Syslog
+	SyslogFacility_Lpr
+	SyslogFacility_News
+	SyslogFacility_Uucp
+	SyslogFacility_Cron
+	SyslogFacility_Authpriv
+	SyslogFacility_Ftp
+	SyslogFacility_Local0 int = iota + 4
+	SyslogFacility_Local1
+	SyslogFacility_Local2
+	SyslogFacility_Local3
+	SyslogFacility_Local4
+	SyslogFacility_Local5
+	SyslogFacility_Local6
+	SyslogFacility_Local7
+)
+
+const (
+	SyslogFormat_RFC5424 int = iota
+	SyslogFormat_RFC3164
+)
+
+// Which severity a line with such a filtertag gets; of several, the most severe one wins.
+// The ClassicEntry's filtertags are here too.
+var DefaultSyslogSeverities = map[string]int{
+	"WAKEMEINTHEMIDDLEOFTHENIGHT": SyslogSeverity_Crit,
+	"PANIC":                       SyslogSeverity_Alert,
+	"FATAL":                       SyslogSeverity_Crit,
+	"EXITFUNC":                    SyslogSeverity_Crit,
+	"ERROR":                       SyslogSeverity_Err,
+	"INVESTIGATETOMORROW":         SyslogSeverity_Warning,
+	"INPRODENV":                   SyslogSeverity_Info,
+	"INFO":                        SyslogSeverity_Info,
+	"DEBUG":                       SyslogSeverity_Debug,
+
+	"EMERGENCY":     SyslogSeverity_Emerg,
+	"ALERT":         SyslogSeverity_Alert,
+	"CRITICAL":      SyslogSeverity_Crit,
+	"WARNING":       SyslogSeverity_Warning,
+	"WARN":          SyslogSeverity_Warning,
+	"NOTICE":        SyslogSeverity_Notice,
+	"INFORMATIONAL": SyslogSeverity_Info,
+	"TRACE":         SyslogSeverity_Debug,
+}
+
+// SyslogSeverity is for the DefaultSeverity of the configs, which is a pointer, so that
+// the SyslogSeverity_Emerg (zero) can be told from the unset one
+func SyslogSeverity(severity int) *int {
+	return &severity
+}
+
+type SyslogSinkConfig struct {
+	// The transport; the local "/dev/log" if the Network is empty. The Framing is ignored,
+	// the stream connections use the octet counting of RFC 6587 (or the newlines, see below).
+	NetSinkConfig
+	NewlineFraming bool // for the old receivers which don't know the octet counting
+
+	Format   int // SyslogFormat_RFC5424 or SyslogFormat_RFC3164
+	Facility int // SyslogFacility_User if zero (the kern can't be sent from a process anyway)
+	AppName  string
+
+	Severities      map[string]int // DefaultSyslogSeverities if nil
+	DefaultSeverity *int           // for the lines without any of those filtertags; SyslogSeverity_Info if nil, see SyslogSeverity()
+
+	// The fields to go into the structured data (RFC 5424 only), under the SDID; the
+	// filtertags are repeated as the "filtertag" params. "filtertags", "subsystem", "err" if nil.
+	SDFields []string
+	SDID     string // "filtertag@32473" if empty (32473 is the example enterprise number)
+
+	FullLine bool // the MSG is the line as it is, not just its "msg" field
+
+	// Reads the lines back; must match the Entry.Encoder, JSONDecoder if nil
+	Decoder Decoder
+}
+
+// SyslogSink sends the lines as the syslog messages, over the NetSink
+type SyslogSink struct {
+	*NetSink
+	Config SyslogSinkConfig
+
+	pid     string
+	host    string
+	appName string
+	stream  bool
+}
+
+func MakeSyslogSink(ctx context.Context, config SyslogSinkConfig) *SyslogSink {
+	if config.Network == "" {
+		config.Network, config.Address = "unixgram", "/dev/log"
+	}
+	config.Framing = Framing_Newline
+	if config.Facility == 0 {
+		config.Facility = SyslogFacility_User
+	}
+	if config.Severities == nil {
+		config.Severities = DefaultSyslogSeverities
+	}
+	if config.DefaultSeverity == nil {
+		config.DefaultSeverity = SyslogSeverity(SyslogSeverity_Info)
+	}
+	if config.SDFields == nil {
+		config.SDFields = []string{"filtertags", "subsystem", "err"}
+	}
+	if config.SDID == "" {
+		config.SDID = "filtertag@32473"
+	}
+	if config.Decoder == nil {
+		config.Decoder = &JSONDecoder{}
+	}
+
+	sink := &SyslogSink{
+		Config:  config,
+		pid:     strconv.Itoa(os.Getpid()),
+		appName: config.AppName,
+	}
+	sink.host, _ = os.Hostname()
+	if sink.appName == "" {
+		sink.appName = filepath.Base(os.Args[0])
+	}
+	switch config.Network {
+	case "tcp", "tcp4", "tcp6", "unix":
+		sink.stream = true
+	}
+	sink.NetSink = MakeNetSink(ctx, config.NetSinkConfig)
+	return sink
+}
+
+func (sink *SyslogSink) Write(p []byte) (int, error) {
+	fields, err := sink.Config.Decoder.Decode(p)
+	if err != nil {
+		fields = map[string]interface{}{"msg": string(p)}
+	}
+
+	buf := getLineBuffer()
+	defer putLineBuffer(buf)
+	msg := sink.appendMessage(buf.b[:0], fields, p)
+	if sink.stream {
+		if sink.Config.NewlineFraming {
+			msg = append(msg, '\n')
+		} else {
+			frame := strconv.AppendInt(make([]byte, 0, len(msg)+8), int64(len(msg)), 10)
+			frame = append(frame, ' ')
+			msg = append(frame, msg...)
+		}
+	}
+	buf.b = msg
+
+	if _, err := sink.NetSink.Write(msg); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Not the NetSink's one, that would skip the formatting
+func (sink *SyslogSink) WriteLines(lines [][]byte) error {
+	return writeLinesEach(sink, lines)
+}
+
+// The most severe of the severities of the tags, or the def if none of them is mapped
+func syslogSeverity(severities map[string]int, def int, tags []string) int {
+	sev := -1
+	for _, tag := range tags {
+		if s, ok := severities[tag]; ok && (sev < 0 || s < sev) {
+			sev = s
+		}
+	}
+	if sev < 0 {
+		return def
+	}
+	return sev
+}
+
+func (sink *SyslogSink) appendMessage(dst []byte, fields map[string]interface{}, line []byte) []byte {
+	tags := lineFiltertags(fields)
+	t := lineTime(fields)
+
+	host := fieldString(fields, "host")
+	if host == "" {
+		host = sink.host
+	}
+
+	dst = append(dst, '<')
+	dst = strconv.AppendInt(dst, int64(sink.Config.Facility*8+syslogSeverity(sink.Config.Severities, *sink.Config.DefaultSeverity, tags)), 10)
+	dst = append(dst, '>')
+
+	if sink.Config.Format == SyslogFormat_RFC3164 {
+		// <PRI>Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG
+		dst = t.AppendFormat(dst, "Jan _2 15:04:05")
+		dst = append(dst, ' ')
+		dst = appendSyslogName(dst, host, 255)
+		dst = append(dst, ' ')
+		dst = appendSyslogName(dst, sink.appName, 32)
+		dst = append(dst, '[')
+		dst = append(dst, sink.pid...)
+		dst = append(dst, "]: "...)
+		return sink.appendMsg(dst, fields, line)
+	}
+
+	// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [SD-ID PARAM="VALUE"...] MSG
+	dst = append(dst, "1 "...)
+	dst = t.AppendFormat(dst, "2006-01-02T15:04:05.000000Z07:00")
+	dst = append(dst, ' ')
+	dst = appendSyslogName(dst, host, 255)
+	dst = append(dst, ' ')
+	dst = appendSyslogName(dst, sink.appName, 48)
+	dst = append(dst, ' ')
+	dst = append(dst, sink.pid...)
+	dst = append(dst, ' ')
+	dst = appendSyslogName(dst, fieldString(fields, "subsystem"), 32)
+	dst = append(dst, ' ')
+
+	sd := len(dst)
+	dst = append(dst, '[')
+	dst = append(dst, sink.Config.SDID...)
+	params := 0
+	for _, k := range sink.Config.SDFields {
+		if k == "filtertags" {
+			for _, tag := range tags {
+				dst = appendSyslogParam(dst, "filtertag", tag)
+				params++
+			}
+			continue
+		}
+		if v := fieldString(fields, k); v != "" {
+			dst = appendSyslogParam(dst, k, v)
+			params++
+		}
+	}
+	if params == 0 {
+		dst = append(dst[:sd], '-')
+	} else {
+		dst = append(dst, ']')
+	}
+
+	dst = append(dst, ' ')
+	return sink.appendMsg(dst, fields, line)
+}
+
+func (sink *SyslogSink) appendMsg(dst []byte, fields map[string]interface{}, line []byte) []byte {
+	if sink.Config.FullLine {
+		return append(dst, strings.TrimRight(string(line), "\n")...)
+	}
+	msg := fieldString(fields, "msg")
+	// a message goes in one line
+	return append(dst, strings.ReplaceAll(strings.TrimRight(msg, "\n"), "\n", " ")...)
+}
+
+// The header fields are printable ASCII without spaces, "-" if empty
+func appendSyslogName(dst []byte, s string, max int) []byte {
+	if s == "" {
+		return append(dst, '-')
+	}
+	if len(s) > max {
+		s = s[:max]
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c > '~' {
+			c = '_'
+		}
+		dst = append(dst, c)
+	}
+	return dst
+}
+
+func appendSyslogParam(dst []byte, name string, value string) []byte {
+	dst = append(dst, ' ')
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c <= ' ' || c > '~' || c == '=' || c == ']' || c == '"' {
+			c = '_'
+		}
+		dst = append(dst, c)
+	}
+	dst = append(dst, `="`...)
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c == '"' || c == '\\' || c == ']' {
+			dst = append(dst, '\\')
+		}
+		dst = append(dst, c)
+	}
+	return append(dst, '"')
+}
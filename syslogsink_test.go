@@ -0,0 +1,143 @@
+package filtertag
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslogSinkUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	sink := MakeSyslogSink(context.Background(), SyslogSinkConfig{
+		NetSinkConfig: NetSinkConfig{Network: "udp", Address: pc.LocalAddr().String()},
+		Facility:      SyslogFacility_Local0,
+		AppName:       "app",
+	})
+	defer sink.Close()
+	sink.Write([]byte(`{"timestamp":"2024-01-02 03:04:05.678 UTC","host":"h1","subsystem":"db","filtertags":{"logger":["INFO","WAKEMEINTHEMIDDLEOFTHENIGHT"]},"msg":"x \"y\" ]","err":"bad]"}` + "\n"))
+
+	buf := make([]byte, 2000)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(buf[:n])
+	if !strings.HasPrefix(got, "<130>1 2024-01-02T03:04:05.678000Z h1 app ") ||
+		!strings.Contains(got, ` db [filtertag@32473 filtertag="INFO" filtertag="WAKEMEINTHEMIDDLEOFTHENIGHT" subsystem="db" err="bad\]"] x "y" ]`) {
+		t.Fatalf("got %q", got)
+	}
+}
+
+// The octet counting framing of RFC 6587
+func TestSyslogSinkTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	got := make(chan string, 2)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		r := bufio.NewReader(c)
+		for {
+			size, err := r.ReadString(' ')
+			if err != nil {
+				return
+			}
+			n, err := strconv.Atoi(strings.TrimSuffix(size, " "))
+			if err != nil {
+				got <- "bad frame size " + size
+				return
+			}
+			msg := make([]byte, n)
+			if _, err := io.ReadFull(r, msg); err != nil {
+				return
+			}
+			got <- string(msg)
+		}
+	}()
+
+	sink := MakeSyslogSink(context.Background(), SyslogSinkConfig{
+		NetSinkConfig: NetSinkConfig{Network: "tcp", Address: ln.Addr().String()},
+		Format:        SyslogFormat_RFC3164,
+		AppName:       "app",
+	})
+	defer sink.Close()
+	sink.Write([]byte(`{"host":"h1","filtertags":{"logger":["INPRODENV"]},"msg":"hello"}` + "\n"))
+	sink.Write([]byte(`{"host":"h1","filtertags":{"logger":["WARN","L4"]},"msg":"world"}` + "\n"))
+
+	for _, want := range []struct{ pri, msg string }{{"<14>", "hello"}, {"<12>", "world"}} {
+		select {
+		case s := <-got:
+			if !strings.HasPrefix(s, want.pri) || !strings.Contains(s, " h1 app[") || !strings.HasSuffix(s, "]: "+want.msg) {
+				t.Fatalf("got %q", s)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no message")
+		}
+	}
+}
+
+func TestSyslogSeverities(t *testing.T) {
+	for _, c := range []struct {
+		tags []string
+		want int
+	}{
+		{[]string{"EMERGENCY", "L7"}, SyslogSeverity_Emerg},
+		{[]string{"ALERT", "L6"}, SyslogSeverity_Alert},
+		{[]string{"CRITICAL", "L7"}, SyslogSeverity_Crit},
+		{[]string{"WARNING", "L4"}, SyslogSeverity_Warning},
+		{[]string{"NOTICE", "L3"}, SyslogSeverity_Notice},
+		{[]string{"INFORMATIONAL", "L3"}, SyslogSeverity_Info},
+		{[]string{"TRACE", "L1"}, SyslogSeverity_Debug},
+		{[]string{"TRACE", "ERROR"}, SyslogSeverity_Err},
+		{[]string{"UNKNOWN"}, SyslogSeverity_Emerg},
+	} {
+		if got := syslogSeverity(DefaultSyslogSeverities, SyslogSeverity_Emerg, c.tags); got != c.want {
+			t.Errorf("the severity of %v is %v, want %v", c.tags, got, c.want)
+		}
+	}
+}
+
+// The DefaultSeverity can be the Emerg, which is zero
+func TestSyslogSinkDefaultSeverity(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	for _, c := range []struct {
+		def  *int
+		want string
+	}{{nil, "<14>"}, {SyslogSeverity(SyslogSeverity_Emerg), "<8>"}} {
+		sink := MakeSyslogSink(context.Background(), SyslogSinkConfig{
+			NetSinkConfig:   NetSinkConfig{Network: "udp", Address: pc.LocalAddr().String()},
+			DefaultSeverity: c.def,
+		})
+		sink.Write([]byte(`{"msg":"no tags"}` + "\n"))
+		buf := make([]byte, 2000)
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		sink.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(buf[:n]), c.want) {
+			t.Errorf("got %q, want the %v", buf[:n], c.want)
+		}
+	}
+}
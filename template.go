@@ -0,0 +1,202 @@
+package filtertag
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogTemplate logs a message template with named holes, like "user {User} paid {Amount}";
+// the args fill the holes in order. The rendered text goes into "msg", the template
+// itself into "msgtemplate", and every hole becomes its own field (typed by the arg),
+// so that the lines can be grouped and matched by the template, not the text.
+//
+// "{{" and "}}" are literal braces. A hole without an arg is left in the msg as it is,
+// the args without a hole are ignored. A hole named like a field of the line itself (msg,
+// timestamp, filtertag, host etc., see reservedHoleNames) has its field prefixed by "f_".
+func (entry *Entry) LogTemplate(
+	filtertags []string,
+	template string,
+	args ...interface{},
+) {
+	for i := range filtertags {
+		filtertags[i] = strings.ToUpper(filtertags[i])
+	}
+	if !entry.Passes(filtertags) {
+		return
+	}
+	entry.logTemplate(filtertags, template, args, nil)
+}
+
+// MsgTemplate is the Msg() with a message template, see LogTemplate().
+func (ev *Event) MsgTemplate(template string, args ...interface{}) {
+	if ev == nil {
+		return
+	}
+	ev.fields = ev.entry.logTemplate(ev.filtertags, template, args, ev.fields)
+	ev.release()
+}
+
+// Returns the fields, with the holes and the msgtemplate appended
+func (entry *Entry) logTemplate(filtertags []string, template string, args []interface{}, fields []Field) []Field {
+	parts := parseTemplate(template)
+
+	var msg []byte
+	holes := 0
+	for _, p := range parts {
+		if !p.hole {
+			msg = append(msg, p.text...)
+			continue
+		}
+		if holes >= len(args) {
+			msg = append(msg, '{')
+			msg = append(msg, p.text...)
+			msg = append(msg, '}')
+			continue
+		}
+		msg = appendTemplateArg(msg, args[holes])
+		fields = append(fields, fieldOf(p.key, args[holes]))
+		holes++
+	}
+	fields = append(fields, String("msgtemplate", template))
+
+	entry.logWith(nil, filtertags, string(msg), fields)
+	return fields
+}
+
+type templatePart struct {
+	text string
+	hole bool
+	key  string // of the hole's field
+}
+
+// The fields of the line itself, which the holes must not overwrite
+var reservedHoleNames = map[string]bool{
+	"timestamp":   true,
+	"host":        true,
+	"service":     true,
+	"subsystem":   true,
+	"filtertag":   true,
+	"filtertags":  true,
+	"ctxpretext":  true,
+	"err":         true,
+	"msg":         true,
+	"msgtemplate": true,
+}
+
+// template string -> []templatePart; the templates are meant to be constants, so the cache
+// stays small (don't build the templates dynamically, that's what the holes are for)
+var parsedTemplates sync.Map
+
+func parseTemplate(template string) []templatePart {
+	if parts, ok := parsedTemplates.Load(template); ok {
+		return parts.([]templatePart)
+	}
+
+	var parts []templatePart
+	var text strings.Builder
+	for i := 0; i < len(template); i++ {
+		c := template[i]
+		switch {
+		case c == '{' && i+1 < len(template) && template[i+1] == '{':
+			text.WriteByte('{')
+			i++
+		case c == '}' && i+1 < len(template) && template[i+1] == '}':
+			text.WriteByte('}')
+			i++
+		case c == '{':
+			end := strings.IndexByte(template[i+1:], '}')
+			name := ""
+			if end >= 0 {
+				name = template[i+1 : i+1+end]
+			}
+			if end < 0 || !validHoleName(name) {
+				text.WriteByte(c)
+				continue
+			}
+			if text.Len() > 0 {
+				parts = append(parts, templatePart{text: text.String()})
+				text.Reset()
+			}
+			key := name
+			if reservedHoleNames[name] {
+				key = "f_" + name
+			}
+			parts = append(parts, templatePart{text: name, hole: true, key: key})
+			i += end + 1
+		default:
+			text.WriteByte(c)
+		}
+	}
+	if text.Len() > 0 {
+		parts = append(parts, templatePart{text: text.String()})
+	}
+
+	parsedTemplates.Store(template, parts)
+	return parts
+}
+
+func validHoleName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func appendTemplateArg(dst []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case string:
+		return append(dst, v...)
+	case int:
+		return strconv.AppendInt(dst, int64(v), 10)
+	case int64:
+		return strconv.AppendInt(dst, v, 10)
+	case float64:
+		return strconv.AppendFloat(dst, v, 'g', -1, 64)
+	case bool:
+		return strconv.AppendBool(dst, v)
+	case time.Duration:
+		return append(dst, v.String()...)
+	case time.Time:
+		return v.AppendFormat(dst, time.RFC3339Nano)
+	case Field:
+		return appendTemplateArg(dst, v.Value())
+	case error:
+		return append(dst, v.Error()...)
+	}
+	return append(dst, fmt.Sprint(v)...)
+}
+
+// The typed Field for a plain Go value
+func fieldOf(key string, v interface{}) Field {
+	switch v := v.(type) {
+	case string:
+		return String(key, v)
+	case int:
+		return Int(key, v)
+	case int64:
+		return Int64(key, v)
+	case float64:
+		return Float64(key, v)
+	case bool:
+		return Bool(key, v)
+	case time.Duration:
+		return Dur(key, v)
+	case time.Time:
+		return Time(key, v)
+	case error:
+		return NamedErr(key, v)
+	case Field:
+		v.Key = key
+		return v
+	}
+	return Any(key, v)
+}
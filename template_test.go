@@ -0,0 +1,35 @@
+package filtertag
+
+import "testing"
+
+func TestLogTemplate(t *testing.T) {
+	entry := testEntry()
+	entry.LogTemplate([]string{"info"}, "user {User} paid {Amount} {{literal}} {Missing}", "bob", 12.5)
+	fields := readLine(t, entry)
+	if fields["msg"] != "user bob paid 12.5 {literal} {Missing}" || fields["User"] != "bob" || fields["Amount"] != 12.5 ||
+		fields["msgtemplate"] != "user {User} paid {Amount} {{literal}} {Missing}" {
+		t.Fatalf("got %v", fields)
+	}
+
+	entry.Event("info").Str("x", "y").MsgTemplate("n={N}", 3)
+	fields = readLine(t, entry)
+	if fields["msg"] != "n=3" || fields["N"] != 3.0 || fields["x"] != "y" {
+		t.Fatalf("got %v", fields)
+	}
+	if _, ok := entry.Fields["N"]; ok {
+		t.Error("the hole was left in the Fields")
+	}
+}
+
+// The holes named like the line's own fields don't overwrite them
+func TestLogTemplateReservedHoles(t *testing.T) {
+	entry := testEntry()
+	entry.LogTemplate([]string{"info"}, "{msg} at {timestamp} on {host}, {filtertag}", "m", "t", "h", "f")
+	fields := readLine(t, entry)
+	if fields["msg"] != "m at t on h, f" || fields["host"] != "testhost" || fields["timestamp"] == "t" || fields["filtertag"] == "f" {
+		t.Fatalf("got %v", fields)
+	}
+	if fields["f_msg"] != "m" || fields["f_timestamp"] != "t" || fields["f_host"] != "h" || fields["f_filtertag"] != "f" {
+		t.Fatalf("got %v", fields)
+	}
+}
@@ -0,0 +1,232 @@
+package filtertag
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type WatchdogSinkConfig struct {
+	Sink     io.Writer
+	Deadline time.Duration // of a write to the Sink, 1s if zero
+
+	// Where the lines go while the Sink is stuck; it's written right in the Write, so it
+	// must be a fast one, like a file or os.Stderr. Nil to drop the lines (counted as lost).
+	Fallback io.Writer
+
+	// The buffer in front of the Sink; DefaultBufferLines and DefaultBufferBytes if zero
+	BufferLines int
+	BufferBytes int
+
+	StuckFunc func(stuck bool) // called when the Sink gets stuck, and when it's back
+	ErrorFunc func(err error)  // called when a write to the Sink (or the Fallback) fails
+}
+
+// WatchdogSink moves a sink which may block (a pipe nobody reads, a stalled docker log
+// driver, a plain blocking net.Conn) off the logger goroutine: the lines go to a buffer,
+// and the sink is written from a goroutine of its own. When a write takes longer than the
+// Deadline, the sink is stuck: the buffered lines and the new ones go to the Fallback,
+// until the stuck write returns.
+type WatchdogSink struct {
+	sinkCounters // first, for the 64-bit alignment of the atomics
+
+	Config WatchdogSinkConfig
+
+	queue        *lineQueue
+	writeStarted int64 // atomic, the UnixNano of the write in progress, 0 if none
+	stuck        int32 // atomic
+	fallbackMu   sync.Mutex
+	closing      chan struct{}
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+func MakeWatchdogSink(ctx context.Context, config WatchdogSinkConfig) *WatchdogSink {
+	if config.Deadline <= 0 {
+		config.Deadline = time.Second
+	}
+	sink := &WatchdogSink{
+		Config:  config,
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	sink.queue = makeLineQueue(config.BufferLines, config.BufferBytes, nil, &sink.sinkCounters)
+
+	go sink.run(ctx)
+	go sink.watch(ctx)
+	return sink
+}
+
+// Write never blocks on the Sink, only on the Fallback while the Sink is stuck
+func (sink *WatchdogSink) Write(p []byte) (int, error) {
+	select {
+	case <-sink.closing:
+		atomic.AddUint64(&sink.lines, 1)
+		atomic.AddUint64(&sink.lost, 1)
+		return 0, ErrSinkClosed
+	default:
+	}
+	if sink.checkStuck() {
+		atomic.AddUint64(&sink.lines, 1)
+		sink.writeFallback(p)
+		return len(p), nil
+	}
+	sink.queue.push(p)
+	return len(p), nil
+}
+
+func (sink *WatchdogSink) WriteLines(lines [][]byte) error {
+	return writeLinesEach(sink, lines)
+}
+
+// Stuck tells whether the Sink is stuck in a write right now
+func (sink *WatchdogSink) Stuck() bool {
+	return atomic.LoadInt32(&sink.stuck) != 0
+}
+
+var errSinkStuck = errors.New("filtertag: the sink is stuck in a write")
+
+// Down is for the ChainSink (see DownReporter): without the Fallback, the lines written
+// while the Sink is stuck are lost, so it's down then
+func (sink *WatchdogSink) Down() error {
+	if sink.Config.Fallback == nil && sink.checkStuck() {
+		return errSinkStuck
+	}
+	return nil
+}
+
+// Whether the Sink is stuck; when it has just got so, the buffered lines go to the Fallback
+func (sink *WatchdogSink) checkStuck() bool {
+	if sink.Stuck() {
+		return true
+	}
+	started := atomic.LoadInt64(&sink.writeStarted)
+	if started == 0 || time.Since(time.Unix(0, started)) < sink.Config.Deadline {
+		return false
+	}
+	if !atomic.CompareAndSwapInt32(&sink.stuck, 0, 1) {
+		return true
+	}
+	if sink.Config.StuckFunc != nil {
+		sink.Config.StuckFunc(true)
+	}
+	for {
+		select {
+		case line := <-sink.queue.ch:
+			sink.queue.taken(line)
+			sink.writeFallback(line)
+		default:
+			return true
+		}
+	}
+}
+
+func (sink *WatchdogSink) writeFallback(p []byte) {
+	if sink.Config.Fallback == nil {
+		atomic.AddUint64(&sink.lost, 1)
+		return
+	}
+	sink.fallbackMu.Lock()
+	_, err := sink.Config.Fallback.Write(p)
+	sink.fallbackMu.Unlock()
+	if err != nil {
+		atomic.AddUint64(&sink.errors, 1)
+		atomic.AddUint64(&sink.lost, 1)
+		if sink.Config.ErrorFunc != nil {
+			sink.Config.ErrorFunc(err)
+		}
+		return
+	}
+	atomic.AddUint64(&sink.written, 1)
+}
+
+func (sink *WatchdogSink) run(ctx context.Context) {
+	defer close(sink.done)
+	closing := false
+	for {
+		var line []byte
+		if closing {
+			select {
+			case line = <-sink.queue.ch:
+			default:
+				return
+			}
+		} else {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sink.closing:
+				closing = true
+				continue
+			case line = <-sink.queue.ch:
+			}
+		}
+		sink.queue.taken(line)
+
+		atomic.StoreInt64(&sink.writeStarted, time.Now().UnixNano())
+		_, err := sink.Config.Sink.Write(line)
+		atomic.StoreInt64(&sink.writeStarted, 0)
+		if atomic.CompareAndSwapInt32(&sink.stuck, 1, 0) && sink.Config.StuckFunc != nil {
+			sink.Config.StuckFunc(false)
+		}
+
+		if err != nil {
+			atomic.AddUint64(&sink.errors, 1)
+			atomic.AddUint64(&sink.lost, 1)
+			if sink.Config.ErrorFunc != nil {
+				sink.Config.ErrorFunc(err)
+			}
+			continue
+		}
+		atomic.AddUint64(&sink.written, 1)
+	}
+}
+
+// A quarter of the Deadline, but not a busy loop for a tiny one (nor a zero, which the
+// NewTicker panics on)
+func (sink *WatchdogSink) checkEvery() time.Duration {
+	if every := sink.Config.Deadline / 4; every > time.Millisecond {
+		return every
+	}
+	return time.Millisecond
+}
+
+// Notices the stuck write even when there are no Writes to notice it
+func (sink *WatchdogSink) watch(ctx context.Context) {
+	ticker := time.NewTicker(sink.checkEvery())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sink.done:
+			return
+		case <-ticker.C:
+			sink.checkStuck()
+		}
+	}
+}
+
+// Close writes out what's still in the buffer, and waits for it; if the Sink gets stuck
+// meanwhile, the rest goes to the Fallback, and Close returns without waiting for the
+// stuck write.
+func (sink *WatchdogSink) Close() error {
+	sink.closeOnce.Do(func() {
+		close(sink.closing)
+	})
+	ticker := time.NewTicker(sink.checkEvery())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sink.done:
+			return nil
+		case <-ticker.C:
+			if sink.checkStuck() {
+				return nil
+			}
+		}
+	}
+}
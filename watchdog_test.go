@@ -0,0 +1,153 @@
+package filtertag
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type blockWriter struct {
+	mu      sync.Mutex
+	block   chan struct{}
+	written []string
+}
+
+func (w *blockWriter) Write(p []byte) (int, error) {
+	if w.block != nil {
+		<-w.block
+	}
+	w.mu.Lock()
+	w.written = append(w.written, string(p))
+	w.mu.Unlock()
+	return len(p), nil
+}
+
+type lockedBuf struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (w *lockedBuf) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.b.Write(p)
+}
+func (w *lockedBuf) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.b.String()
+}
+
+func TestWatchdog(t *testing.T) {
+	bw := &blockWriter{block: make(chan struct{})}
+	fb := &lockedBuf{}
+	var mu sync.Mutex
+	var events []bool
+	sink := MakeWatchdogSink(context.Background(), WatchdogSinkConfig{
+		Sink: bw, Deadline: 40 * time.Millisecond, Fallback: fb,
+		StuckFunc: func(s bool) { mu.Lock(); events = append(events, s); mu.Unlock() },
+	})
+	start := time.Now()
+	sink.Write([]byte("a\n"))
+	sink.Write([]byte("b\n"))
+	sink.Write([]byte("c\n"))
+	if time.Since(start) > 20*time.Millisecond {
+		t.Fatal("blocked")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !sink.Stuck() {
+		t.Fatal("not stuck")
+	}
+	if fb.String() != "b\nc\n" {
+		t.Fatalf("fallback %q", fb.String())
+	}
+	sink.Write([]byte("d\n"))
+	if fb.String() != "b\nc\nd\n" {
+		t.Fatalf("fallback %q", fb.String())
+	}
+	close(bw.block)
+	time.Sleep(20 * time.Millisecond)
+	if sink.Stuck() {
+		t.Fatal("still stuck")
+	}
+	sink.Write([]byte("e\n"))
+	sink.Close()
+	bw.mu.Lock()
+	if len(bw.written) != 2 || bw.written[0] != "a\n" || bw.written[1] != "e\n" {
+		t.Fatalf("sink %q", bw.written)
+	}
+	bw.mu.Unlock()
+	mu.Lock()
+	if len(events) != 2 || !events[0] || events[1] {
+		t.Fatalf("events %v", events)
+	}
+	mu.Unlock()
+	st := sink.Stats()
+	if st.Lines != 5 || st.Written != 5 || st.Lost != 0 {
+		t.Fatalf("%+v", st)
+	}
+}
+
+func TestWatchdogCloseStuck(t *testing.T) {
+	bw := &blockWriter{block: make(chan struct{})}
+	defer close(bw.block)
+	fb := &lockedBuf{}
+	sink := MakeWatchdogSink(context.Background(), WatchdogSinkConfig{Sink: bw, Deadline: 40 * time.Millisecond, Fallback: fb})
+	sink.Write([]byte("a\n"))
+	sink.Write([]byte("b\n"))
+	start := time.Now()
+	sink.Close()
+	if time.Since(start) > 200*time.Millisecond || fb.String() != "b\n" {
+		t.Fatalf("%v %q", time.Since(start), fb.String())
+	}
+}
+
+// A pipe nobody reads blocks the write once it's full; without the Fallback the sink is
+// down then, for the ChainSink
+func TestWatchdogPipe(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	sink := MakeWatchdogSink(context.Background(), WatchdogSinkConfig{Sink: w, Deadline: 20 * time.Millisecond})
+	line := []byte(strings.Repeat("x", 1023) + "\n")
+	start := time.Now()
+	for i := 0; i < 1000; i++ {
+		sink.Write(line)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("blocked")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !sink.Stuck() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if !sink.Stuck() || sink.Down() != errSinkStuck {
+		t.Fatal("not stuck")
+	}
+	sink.Write(line)
+	start = time.Now()
+	sink.Close()
+	if time.Since(start) > time.Second {
+		t.Fatal("the Close waited for the stuck write")
+	}
+	if st := sink.Stats(); st.Lines != 1001 || st.Lost == 0 || st.Written+st.Lost > st.Lines {
+		t.Fatalf("%+v", st)
+	}
+}
+
+// The checks are every quarter of the Deadline, but not more often than every 1ms
+func TestWatchdogTinyDeadline(t *testing.T) {
+	sink := MakeWatchdogSink(context.Background(), WatchdogSinkConfig{Sink: &blockWriter{}, Deadline: time.Nanosecond, Fallback: &lockedBuf{}})
+	if every := sink.checkEvery(); every != time.Millisecond {
+		t.Fatal(every)
+	}
+	sink.Write([]byte("a\n"))
+	sink.Close()
+}
@@ -0,0 +1,72 @@
+//go:build linux
+// +build linux
+
+package filtertag
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const maxIovecs = 1024 // the IOV_MAX
+
+// Writes the bufs to the file with the writev; ok is false if the file can't do it
+func writevFile(f *os.File, bufs net.Buffers) (ok bool, err error) {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return false, nil
+	}
+	var iovs []syscall.Iovec
+	var writeErr error
+	err = rc.Write(func(fd uintptr) bool {
+		for {
+			iovs = iovs[:0]
+			for i := range bufs {
+				if len(bufs[i]) == 0 {
+					continue
+				}
+				iov := syscall.Iovec{Base: &bufs[i][0]}
+				iov.SetLen(len(bufs[i]))
+				if iovs = append(iovs, iov); len(iovs) == maxIovecs {
+					break
+				}
+			}
+			if len(iovs) == 0 {
+				return true
+			}
+			n, _, errno := syscall.Syscall(syscall.SYS_WRITEV, fd, uintptr(unsafe.Pointer(&iovs[0])), uintptr(len(iovs)))
+			switch errno {
+			case 0:
+			case syscall.EINTR:
+				continue
+			case syscall.EAGAIN:
+				// the non-blocking pipe is full, wait for it
+				return false
+			default:
+				writeErr = &os.PathError{Op: "writev", Path: f.Name(), Err: errno}
+				return true
+			}
+			consumeBuffers(&bufs, int64(n))
+		}
+	})
+	if err == nil {
+		err = writeErr
+	}
+	return true, err
+}
+
+// Drops the n written bytes from the front of the bufs
+func consumeBuffers(bufs *net.Buffers, n int64) {
+	for len(*bufs) > 0 {
+		l := int64(len((*bufs)[0]))
+		if l > n {
+			(*bufs)[0] = (*bufs)[0][n:]
+			return
+		}
+		n -= l
+		(*bufs)[0] = nil
+		*bufs = (*bufs)[1:]
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package filtertag
+
+import (
+	"net"
+	"os"
+)
+
+// No writev for the files here, they get a Write per buffer
+func writevFile(f *os.File, bufs net.Buffers) (ok bool, err error) {
+	return false, nil
+}